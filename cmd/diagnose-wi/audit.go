@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+
+	"github.com/Harwayne/workload-identity/pkg/diagnose"
+)
+
+// sharedGSAs groups the KSAs by the GSA they are linked to, returning the KSAs of each GSA linked to
+// by at least threshold of them, which may be over-sharing the GSA. The KSAs are sorted by name.
+func sharedGSAs(ksaGSAs map[string]string, threshold int) map[string][]string {
+	byGSA := map[string][]string{}
+	for ksa, gsa := range ksaGSAs {
+		byGSA[gsa] = append(byGSA[gsa], ksa)
+	}
+	for gsa, ksas := range byGSA {
+		if len(ksas) < threshold {
+			delete(byGSA, gsa)
+			continue
+		}
+		sort.Strings(ksas)
+	}
+	return byGSA
+}
+
+// reportSharedGSAs reports, as breadcrumbs, the GSAs linked to by at least threshold of the KSAs.
+// Sharing may well be intentional, so it is not a failure.
+func reportSharedGSAs(ns string, ksaGSAs map[string]string, threshold int) {
+	shared := sharedGSAs(ksaGSAs, threshold)
+	for _, gsa := range sortedKeys(shared) {
+		breadcrumb("GSA %q is linked to by %d KSAs in namespace %q, which may be over-sharing it: %s",
+			gsa, len(shared[gsa]), ns, strings.Join(shared[gsa], ", "))
+	}
+}
+
+// unusedKSAs returns the KSAs that no Pod or controller uses, sorted by name.
+func unusedKSAs(ksaGSAs map[string]string, consumers map[string][]string) []string {
+	var unused []string
+	for _, ksa := range sortedKeys(ksaGSAs) {
+		if len(consumers[ksa]) == 0 {
+			unused = append(unused, ksa)
+		}
+	}
+	return unused
+}
+
+// reportUnusedKSAs logs the annotated KSAs that no Pod or controller uses. They are reported apart
+// from the diagnosis, as an unused KSA may be configured perfectly well.
+func reportUnusedKSAs(ns string, ksaGSAs map[string]string, consumers map[string][]string) {
+	unused := unusedKSAs(ksaGSAs, consumers)
+	for _, ksa := range unused {
+		log.Printf("Unused: KSA %q in namespace %q is linked to GSA %q, but no Pod or controller uses it, a candidate for cleanup.",
+			ksa, ns, ksaGSAs[ksa])
+	}
+	if len(unused) > 0 {
+		log.Printf("Audit: %d of %d annotated KSAs are unused.", len(unused), len(ksaGSAs))
+	}
+}
+
+// remediationsByProject groups the remediations of every result by the project of the GSA they are
+// about, dropping duplicates, such as the same GSA binding fix for several Pods. Commands keep the
+// order they were first found in.
+func remediationsByProject(results []*diagnose.Result) map[string][]string {
+	byProject := map[string][]string{}
+	seen := map[string]bool{}
+	for _, r := range results {
+		for _, c := range r.Checks {
+			for _, rem := range c.Remediations {
+				if seen[rem.Command] {
+					continue
+				}
+				seen[rem.Command] = true
+				project, ok := diagnose.GSAProject(rem.GSA)
+				if !ok {
+					project = ""
+				}
+				byProject[project] = append(byProject[project], rem.Command)
+			}
+		}
+	}
+	return byProject
+}
+
+// printRemediations prints the remediations of every result as a block of commands per GSA project,
+// ready to be copied.
+func printRemediations(results []*diagnose.Result) {
+	byProject := remediationsByProject(results)
+	for _, project := range sortedKeys(byProject) {
+		if project == "" {
+			fmt.Println("# Fixes for GSAs in an unknown project")
+		} else {
+			fmt.Printf("# Fixes for GSAs in project %s\n", project)
+		}
+		for _, c := range byProject[project] {
+			fmt.Println(c)
+		}
+		fmt.Println()
+	}
+}
+
+// gsaInventory is a GSA and the KSAs linked to it, as printed by --list-gsas.
+type gsaInventory struct {
+	GSA      string   `json:"gsa"`
+	KSACount int      `json:"ksaCount"`
+	KSAs     []string `json:"ksas"`
+}
+
+// listGSAs prints every GSA the KSAs in the namespace are annotated with, sorted by email, with the
+// number of KSAs linked to each. The text output has a tab separated line per GSA, to pipe into sort.
+func listGSAs(ns string, ksaGSAs map[string]string, output string) error {
+	byGSA := sharedGSAs(ksaGSAs, 1)
+	inventory := make([]gsaInventory, 0, len(byGSA))
+	for _, gsa := range sortedKeys(byGSA) {
+		inventory = append(inventory, gsaInventory{GSA: gsa, KSACount: len(byGSA[gsa]), KSAs: byGSA[gsa]})
+	}
+	if output == "json" {
+		b, err := json.MarshalIndent(inventory, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(b))
+		return nil
+	}
+	breadcrumb("%d GSAs are linked to by the %d annotated KSAs in namespace %q", len(inventory), len(ksaGSAs), ns)
+	for _, e := range inventory {
+		fmt.Printf("%d\t%s\t%s\n", e.KSACount, e.GSA, strings.Join(e.KSAs, ","))
+	}
+	return nil
+}
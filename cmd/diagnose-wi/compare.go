@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/Harwayne/workload-identity/pkg/diagnose"
+)
+
+// compareTarget resolves a --compare reference, pod/NAME, deployment/NAME, selector/SELECTOR or a KSA
+// name, into the target it refers to.
+func compareTarget(ctx context.Context, client kubernetes.Interface, ns, ref string) (diagnose.Target, error) {
+	kind, name := "", ref
+	if i := strings.Index(ref, "/"); i >= 0 {
+		kind, name = ref[:i], ref[i+1:]
+	}
+	switch kind {
+	case "":
+		return diagnose.Target{Namespace: ns, KSA: name}, diagnose.ValidateKSAName(name)
+	case "pod":
+		ksa, err := diagnose.GetPodKSA(ctx, client, ns, name)
+		return diagnose.Target{Namespace: ns, KSA: ksa, Pod: name}, err
+	case "deployment":
+		ksa, err := diagnose.GetDeploymentKSA(ctx, client, ns, name)
+		return diagnose.Target{Namespace: ns, KSA: ksa, Deployment: name}, err
+	case "selector":
+		return selectorTarget(ctx, client, ns, name)
+	}
+	return diagnose.Target{}, fmt.Errorf("%q is not a KSA name, pod/NAME, deployment/NAME or selector/SELECTOR", ref)
+}
+
+// selectorTarget resolves the Pods selected by the label selector, e.g. a rollout's canary Pods, into
+// a target for the KSA they use. It is an error if they use several KSAs, as they can't be compared
+// as one.
+func selectorTarget(ctx context.Context, client kubernetes.Interface, ns, selector string) (diagnose.Target, error) {
+	podKSAs, _, err := diagnose.GetPodsKSAs(ctx, client, ns, nil, selector)
+	if err != nil {
+		return diagnose.Target{}, err
+	}
+	pods := sortedKeys(podKSAs)
+	if len(pods) == 0 {
+		return diagnose.Target{}, fmt.Errorf("no Pods in namespace %q match selector %q", ns, selector)
+	}
+	byKSA := map[string][]string{}
+	for _, pod := range pods {
+		byKSA[podKSAs[pod]] = append(byKSA[podKSAs[pod]], pod)
+	}
+	if len(byKSA) > 1 {
+		var uses []string
+		for _, ksa := range sortedKeys(byKSA) {
+			uses = append(uses, fmt.Sprintf("KSA %q by %v", ksa, byKSA[ksa]))
+		}
+		return diagnose.Target{}, fmt.Errorf("the Pods selected by %q use %d KSAs: %s; narrow the selector", selector, len(byKSA), strings.Join(uses, ", "))
+	}
+	return diagnose.Target{Namespace: ns, KSA: podKSAs[pods[0]], Pod: pods[0], Selector: selector}, nil
+}
+
+// printComparison prints the two results side by side, marking the rows where they differ with a *,
+// as those explain why one works and the other doesn't.
+func printComparison(a, b *diagnose.Result) {
+	rows := [][3]string{
+		{"KSA", a.KSA, b.KSA},
+		{"GSA", a.GSA, b.GSA},
+		{"Has access", fmt.Sprint(a.HasAccess), fmt.Sprint(b.HasAccess)},
+		{"Access role", a.AccessRole, b.AccessRole},
+		{"Access member", a.AccessMember, b.AccessMember},
+		{"Roles", fmt.Sprint(a.Roles), fmt.Sprint(b.Roles)},
+		{"Passed", fmt.Sprint(a.Passed()), fmt.Sprint(b.Passed())},
+	}
+	bChecks := map[string]diagnose.CheckResult{}
+	for _, c := range b.Checks {
+		bChecks[c.Name] = c
+	}
+	for _, c := range a.Checks {
+		rows = append(rows, [3]string{"Check " + c.Name, string(c.Status), string(bChecks[c.Name].Status)})
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "\t\t%s\t%s\n", a.Target, b.Target)
+	for _, row := range rows {
+		marker := ""
+		if row[1] != row[2] {
+			marker = "*"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", marker, row[0], row[1], row[2])
+	}
+	w.Flush()
+
+	switch {
+	case a.GSA != b.GSA:
+		fmt.Printf("\nThe two use different GSAs, %q and %q.\n", a.GSA, b.GSA)
+	case a.HasAccess != b.HasAccess:
+		fmt.Printf("\nThe two use the same GSA, %q, but only one's KSA may act as it.\n", a.GSA)
+	default:
+		fmt.Printf("\nThe two use the same GSA, %q, with the same binding status.\n", a.GSA)
+	}
+
+	for _, c := range a.Checks {
+		if bc := bChecks[c.Name]; c.Status != bc.Status {
+			fmt.Printf("\n%s differs:\n  %s: %s\n  %s: %s\n", c.Name, a.Target, c.Message, b.Target, bc.Message)
+		}
+	}
+}
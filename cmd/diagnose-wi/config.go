@@ -0,0 +1,74 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/user"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// defaultConfigPath returns the config file used when --config is not set.
+func defaultConfigPath() string {
+	usr, err := user.Current()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(usr.HomeDir, ".config", "diagnose-wi.yaml")
+}
+
+// applyConfigFile sets every flag not given on the command line to its value in the YAML config file,
+// which maps flag names to values, e.g. `clusterProject: my-project`. Lists are joined with commas.
+// A missing file is only an error if it was explicitly requested.
+func applyConfigFile(path string, explicit bool) error {
+	b, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) && !explicit {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	values := map[string]interface{}{}
+	if err := yaml.Unmarshal(b, &values); err != nil {
+		return err
+	}
+
+	setOnCommandLine := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) {
+		setOnCommandLine[f.Name] = true
+	})
+
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if flag.Lookup(name) == nil || name == "config" {
+			return fmt.Errorf("%q is not a flag that can be set in the config file", name)
+		}
+		if setOnCommandLine[name] {
+			continue
+		}
+		if err := flag.Set(name, configValue(values[name])); err != nil {
+			return fmt.Errorf("setting %q: %w", name, err)
+		}
+	}
+	return nil
+}
+
+func configValue(v interface{}) string {
+	if l, ok := v.([]interface{}); ok {
+		s := make([]string, 0, len(l))
+		for _, e := range l {
+			s = append(s, fmt.Sprint(e))
+		}
+		return strings.Join(s, ",")
+	}
+	return fmt.Sprint(v)
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/Harwayne/workload-identity/pkg/diagnose"
+)
+
+// runContexts diagnoses the same KSA in the cluster of each kubeconfig context, then reports where the
+// clusters disagree, e.g. the KSA being annotated in one cluster but not another. It returns the
+// process exit code.
+func runContexts(ctx context.Context, contexts []string, ns, ksaName string, checks []diagnose.Check, printResult func(*diagnose.Result)) int {
+	project, err := determineProject(*projectFlag)
+	if err != nil {
+		log.Printf("Error getting project: %s", errorText(err))
+		return 1
+	}
+	breadcrumb("Namespace: %s", ns)
+	breadcrumb("Project: %s", project)
+
+	failed := false
+	results := make(map[string]*diagnose.Result, len(contexts))
+	for _, kubeContext := range contexts {
+		breadcrumb("Context: %s", kubeContext)
+		cfg, err := GetRESTConfig(*serverFlag, *kubeconfigFlag, kubeContext)
+		if err != nil {
+			log.Printf("Error building the REST config of context %q: %v", kubeContext, err)
+			failed = true
+			continue
+		}
+		env := newEnv(kubernetes.NewForConfigOrDie(cfg), kubeContext)
+		if *checkConfigConnectorFlag {
+			env.Dynamic = dynamic.NewForConfigOrDie(cfg)
+		}
+		env.Project = project
+		r := diagnose.Run(ctx, diagnose.NewInput(env, diagnose.Target{Namespace: ns, KSA: ksaName}), checks)
+		printResult(r)
+		if !r.Passed() {
+			failed = true
+		}
+		results[kubeContext] = r
+	}
+
+	if inconsistencies := compareContexts(results); len(inconsistencies) > 0 {
+		for _, i := range inconsistencies {
+			log.Printf("Inconsistent across contexts: %s", i)
+		}
+		failed = true
+	}
+	if failed {
+		return 1
+	}
+	return 0
+}
+
+// compareContexts describes how the results for the same KSA differ between contexts.
+func compareContexts(results map[string]*diagnose.Result) []string {
+	byGSA := map[string][]string{}
+	byAccess := map[bool][]string{}
+	for _, kubeContext := range sortedKeys(results) {
+		r := results[kubeContext]
+		byGSA[r.GSA] = append(byGSA[r.GSA], kubeContext)
+		if r.GSA != "" {
+			byAccess[r.HasAccess] = append(byAccess[r.HasAccess], kubeContext)
+		}
+	}
+
+	var inconsistencies []string
+	if len(byGSA) > 1 {
+		var links []string
+		for _, gsa := range sortedKeys(byGSA) {
+			linksTo := fmt.Sprintf("links to GSA %q", gsa)
+			if gsa == "" {
+				linksTo = "has no valid WI annotation"
+			}
+			links = append(links, fmt.Sprintf("the KSA %s in %s", linksTo, strings.Join(byGSA[gsa], ", ")))
+		}
+		inconsistencies = append(inconsistencies, strings.Join(links, "; "))
+	}
+	if len(byAccess) > 1 {
+		inconsistencies = append(inconsistencies, fmt.Sprintf("the GSA grants the KSA access in %s, but not in %s",
+			strings.Join(byAccess[true], ", "), strings.Join(byAccess[false], ", ")))
+	}
+	return inconsistencies
+}
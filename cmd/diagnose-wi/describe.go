@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/Harwayne/workload-identity/pkg/diagnose"
+)
+
+// runDescribeOnly is the half of the diagnosis that only needs access to the cluster. For each target
+// it prints the KSA's GSA, its IAM member, and what a GCP admin should verify, with the commands to
+// do so, for users who can't read IAM policies themselves. Without --assume-pool, the cluster's WI
+// pool is taken to be its project's, which is the pool GKE uses. It returns the process exit code.
+func runDescribeOnly(ctx context.Context, client kubernetes.Interface, kubeContext string, targets []diagnose.Target) int {
+	env := &diagnose.Env{Kube: client}
+	setCluster(env, kubeContext)
+	wiPool := *assumePoolFlag
+	if wiPool == "" {
+		if env.ClusterProject == "" {
+			log.Print("The cluster's project is unknown, pass --clusterProject or --assume-pool.")
+			return 1
+		}
+		wiPool = env.ClusterProject + ".svc.id.goog"
+	}
+	breadcrumb("WI pool: %s (not read from GCP)", wiPool)
+
+	code := 0
+	for _, t := range targets {
+		sa, err := client.CoreV1().ServiceAccounts(t.Namespace).Get(ctx, t.KSA, v1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			log.Printf("%s, which does not exist. To fix: %s", t, diagnose.CreateKSACommand(t.Namespace, t.KSA))
+			code = 1
+			continue
+		} else if err != nil {
+			log.Printf("Error getting KSA %s/%s: %v", t.Namespace, t.KSA, err)
+			code = 1
+			continue
+		}
+		gsa := diagnose.CleanGSAAnnotation(sa.Annotations[diagnose.WIGSAAnnotation])
+		if gsa == "" {
+			log.Printf("%s, which does not have the WI annotation, %q. Decide on its GSA, then: %s",
+				t, diagnose.WIGSAAnnotation, diagnose.AnnotateKSACommand(t.Namespace, t.KSA, "GSA_EMAIL"))
+			code = 1
+			continue
+		}
+		if err := diagnose.ValidateGSAEmail(gsa); err != nil {
+			log.Printf("%s, whose WI annotation is invalid: %v. Decide on its GSA, then: %s",
+				t, err, diagnose.AnnotateKSACommand(t.Namespace, t.KSA, "GSA_EMAIL"))
+			code = 1
+			continue
+		}
+		member := diagnose.KSAIAMPolicyMember(wiPool, t.Namespace, t.KSA)
+		project, ok := diagnose.GSAProject(gsa)
+		if !ok {
+			project = "PROJECT"
+		}
+		fmt.Printf("%s, which links to GSA %q, as IAM member %s. Ask your GCP admin to verify that:\n", t, gsa, member)
+		fmt.Printf("  1. GSA %s grants %s to %s, or else run:\n       %s\n",
+			gsa, workloadIdentityUserRole, member, diagnose.GrantKSAAccessCommand(wiPool, t.Namespace, t.KSA, gsa))
+		fmt.Printf("     To check: gcloud iam service-accounts get-iam-policy %s --flatten=bindings --filter='bindings.members:%s' --format='value(bindings.role)'\n",
+			gsa, member)
+		fmt.Printf("  2. GSA %s has the roles the workload needs on the projects it uses.\n", gsa)
+		fmt.Printf("     To check: gcloud projects get-iam-policy %s --flatten=bindings --filter='bindings.members:serviceAccount:%s' --format='value(bindings.role)'\n",
+			project, gsa)
+	}
+	return code
+}
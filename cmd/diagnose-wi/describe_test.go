@@ -0,0 +1,39 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"github.com/Harwayne/workload-identity/pkg/diagnose"
+)
+
+func TestRunDescribeOnlyValidatesGSA(t *testing.T) {
+	t.Setenv("KUBECONFIG", filepath.Join(t.TempDir(), "missing"))
+	defer func(pool string) { *assumePoolFlag = pool }(*assumePoolFlag)
+	*assumePoolFlag = "my-project.svc.id.goog"
+
+	for _, tc := range []struct {
+		annotation string
+		wantCode   int
+	}{
+		{annotation: "app-sa@my-project.iam.gserviceaccount.com", wantCode: 0},
+		{annotation: `"app-sa@my-project.iam.gserviceaccount.com"`, wantCode: 0},
+		{annotation: "app-sa@my-project.iam.gserviceacount.com", wantCode: 1},
+		{annotation: "123456789012345678901", wantCode: 1},
+	} {
+		client := fake.NewSimpleClientset(&corev1.ServiceAccount{ObjectMeta: v1.ObjectMeta{
+			Name:        "agent",
+			Namespace:   "my-ns",
+			Annotations: map[string]string{diagnose.WIGSAAnnotation: tc.annotation},
+		}})
+		targets := []diagnose.Target{{Namespace: "my-ns", KSA: "agent"}}
+		if code := runDescribeOnly(context.Background(), client, "", targets); code != tc.wantCode {
+			t.Errorf("runDescribeOnly with annotation %q = %d, want %d", tc.annotation, code, tc.wantCode)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	corev1 "k8s.io/api/core/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/Harwayne/workload-identity/pkg/diagnose"
+)
+
+const (
+	// eventReason is the reason of the Events recorded by --record-event.
+	eventReason = "WorkloadIdentityDiagnosis"
+	// maxEventMessageLength keeps the Event's message within what the API server accepts.
+	maxEventMessageLength = 1024
+)
+
+// recordEvent records the result as an Event on the Pod or Deployment it was found through, or else
+// on the KSA, so it shows up in `kubectl describe`. Results that failed are Warning Events.
+func recordEvent(ctx context.Context, client kubernetes.Interface, r *diagnose.Result) error {
+	ref := corev1.ObjectReference{Namespace: r.Namespace}
+	switch {
+	case r.Pod != "":
+		pod, err := client.CoreV1().Pods(r.Namespace).Get(ctx, r.Pod, v1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		ref.Kind, ref.APIVersion, ref.Name, ref.UID = "Pod", "v1", pod.Name, pod.UID
+	case r.Deployment != "":
+		d, err := client.AppsV1().Deployments(r.Namespace).Get(ctx, r.Deployment, v1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		ref.Kind, ref.APIVersion, ref.Name, ref.UID = "Deployment", "apps/v1", d.Name, d.UID
+	default:
+		sa, err := client.CoreV1().ServiceAccounts(r.Namespace).Get(ctx, r.KSA, v1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		ref.Kind, ref.APIVersion, ref.Name, ref.UID = "ServiceAccount", "v1", sa.Name, sa.UID
+	}
+
+	eventType, message := corev1.EventTypeNormal, verdict(r)
+	if !r.Passed() {
+		var problems []string
+		for _, c := range r.Checks {
+			if c.Status == diagnose.StatusFail || c.Status == diagnose.StatusError {
+				problems = append(problems, fmt.Sprintf("%s: %s", c.Name, c.Message))
+			}
+		}
+		eventType, message = corev1.EventTypeWarning, strings.Join(problems, "; ")
+	}
+	message = truncateEventMessage(message)
+
+	now := v1.Now()
+	_, err := client.CoreV1().Events(r.Namespace).Create(ctx, &corev1.Event{
+		ObjectMeta:     v1.ObjectMeta{GenerateName: ref.Name + ".", Namespace: r.Namespace},
+		InvolvedObject: ref,
+		Reason:         eventReason,
+		Message:        message,
+		Type:           eventType,
+		Source:         corev1.EventSource{Component: "diagnose-wi"},
+		FirstTimestamp: now,
+		LastTimestamp:  now,
+		Count:          1,
+	}, v1.CreateOptions{})
+	return err
+}
+
+// truncateEventMessage cuts the message to maxEventMessageLength bytes, marking the cut with "...".
+// The cut backs up to the start of a rune, as messages quote user data that may not be ASCII.
+func truncateEventMessage(message string) string {
+	if len(message) <= maxEventMessageLength {
+		return message
+	}
+	cut := maxEventMessageLength - len("...")
+	for cut > 0 && !utf8.RuneStart(message[cut]) {
+		cut--
+	}
+	return message[:cut] + "..."
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestTruncateEventMessage(t *testing.T) {
+	for _, message := range []string{
+		strings.Repeat("a", maxEventMessageLength),
+		strings.Repeat("a", maxEventMessageLength+1),
+		// The cut falls inside the multi-byte runes at every offset.
+		strings.Repeat("a", maxEventMessageLength-5) + strings.Repeat("é", 10),
+		strings.Repeat("a", maxEventMessageLength-6) + strings.Repeat("é", 10),
+		strings.Repeat("€", maxEventMessageLength),
+	} {
+		got := truncateEventMessage(message)
+		if len(got) > maxEventMessageLength || !utf8.ValidString(got) {
+			t.Errorf("truncateEventMessage of %d bytes = %d bytes, valid UTF-8 %v, want at most %d bytes of valid UTF-8",
+				len(message), len(got), utf8.ValidString(got), maxEventMessageLength)
+		}
+		if len(message) <= maxEventMessageLength && got != message {
+			t.Errorf("truncateEventMessage cut a message of %d bytes, want it unchanged", len(message))
+		}
+		if len(message) > maxEventMessageLength && !strings.HasSuffix(got, "...") {
+			t.Errorf("truncateEventMessage of %d bytes = %q, want it ending in ...", len(message), got[len(got)-10:])
+		}
+	}
+}
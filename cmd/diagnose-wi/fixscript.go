@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/Harwayne/workload-identity/pkg/diagnose"
+)
+
+// writeFixScript writes an executable bash script with the remediations of every result to path, to
+// review and run instead of copying commands one at a time. Each command is preceded by comments on
+// what it fixes, and commands several KSAs need only appear once.
+func writeFixScript(path string, results []*diagnose.Result) error {
+	var b strings.Builder
+	b.WriteString("#!/usr/bin/env bash\n")
+	b.WriteString("# Fixes for the Workload Identity problems found by diagnose-wi. Review before running.\n")
+	b.WriteString("set -euo pipefail\n")
+	seen := map[string]bool{}
+	for _, r := range results {
+		for _, c := range r.Checks {
+			for _, rem := range c.Remediations {
+				if seen[rem.Command] {
+					continue
+				}
+				seen[rem.Command] = true
+				fmt.Fprintf(&b, "\n# %s in namespace %q, check %s:\n", r.Target, r.Namespace, c.Name)
+				for _, line := range strings.Split(c.Message, "\n") {
+					fmt.Fprintf(&b, "#   %s\n", line)
+				}
+				b.WriteString(rem.Command + "\n")
+			}
+		}
+	}
+	if len(seen) == 0 {
+		b.WriteString("\n# Nothing to fix.\n")
+	}
+	if err := os.WriteFile(path, []byte(b.String()), 0o755); err != nil {
+		return err
+	}
+	// WriteFile keeps the mode of an existing file.
+	return os.Chmod(path, 0o755)
+}
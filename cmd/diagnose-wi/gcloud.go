@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"os/exec"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2"
+	"google.golang.org/api/option"
+
+	"github.com/Harwayne/workload-identity/pkg/diagnose"
+)
+
+func getGCPOptions() []option.ClientOption {
+	var options []option.ClientOption
+	if ts := getTokenSource(); ts != nil {
+		options = append(options, option.WithTokenSource(ts))
+	}
+	if *requestReasonFlag != "" {
+		options = append(options, option.WithRequestReason(*requestReasonFlag))
+	}
+	options = withRateLimit(options)
+	for api, endpoint := range map[string]string{
+		diagnose.IAMAPI:                  *iamEndpointFlag,
+		diagnose.ContainerAPI:            *containerEndpointFlag,
+		diagnose.CloudResourceManagerAPI: *crmEndpointFlag,
+	} {
+		if endpoint != "" {
+			options = append(options, diagnose.WithAPIEndpoint(api, endpoint))
+		}
+	}
+	return options
+}
+
+// endpointFlags are the flags overriding GCP API endpoints, by name.
+var endpointFlags = map[string]*string{
+	"iam-endpoint":       iamEndpointFlag,
+	"container-endpoint": containerEndpointFlag,
+	"crm-endpoint":       crmEndpointFlag,
+}
+
+// validateEndpoint checks that the endpoint, if set, is an absolute http or https URL.
+func validateEndpoint(endpoint string) error {
+	if endpoint == "" {
+		return nil
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("%q is not an http or https URL", endpoint)
+	}
+	return nil
+}
+
+// gcloudTokenLifetime is how long a token from gcloud is reused before gcloud is asked again. gcloud
+// doesn't say when its tokens expire, and returns the same token until shortly before it does, so
+// asking often keeps long runs, such as --serve-webhook, from using an expired token.
+const gcloudTokenLifetime = 5 * time.Minute
+
+// getTokenSource returns a TokenSource of gcloud's access tokens, or nil if gcloud can't print one,
+// in which case the clients use Application Default Credentials.
+func getTokenSource() oauth2.TokenSource {
+	src := gcloudTokenSource{}
+	t, err := src.Token()
+	if err != nil {
+		return nil
+	}
+	return oauth2.ReuseTokenSource(t, src)
+}
+
+// gcloudTokenSource runs gcloud for every token.
+type gcloudTokenSource struct{}
+
+func (gcloudTokenSource) Token() (*oauth2.Token, error) {
+	gct, err := getGcloudToken()
+	if err != nil {
+		return nil, fmt.Errorf("getting an access token from gcloud: %w", err)
+	}
+	return &oauth2.Token{
+		AccessToken: gct,
+		TokenType:   "Bearer",
+		Expiry:      time.Now().Add(gcloudTokenLifetime),
+	}, nil
+}
+
+func getGcloudToken() (string, error) {
+	cmd := exec.Command("gcloud", "auth", "print-access-token")
+	o, err := cmd.Output()
+	if err != nil {
+		return "", err
+	}
+	t := string(o)
+	return strings.TrimSpace(t), nil
+}
+
+func determineProject(projectFlagValue string) (string, error) {
+	if projectFlagValue != "" {
+		return projectFlagValue, nil
+	}
+	cmd := exec.Command("gcloud", "config", "get-value", "core/project")
+	o, err := cmd.Output()
+	if err != nil {
+		return "", err
+	}
+	p := string(o)
+	return strings.TrimSpace(p), nil
+}
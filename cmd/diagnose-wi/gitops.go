@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"log"
+	"path/filepath"
+	"strings"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/Harwayne/workload-identity/pkg/diagnose"
+)
+
+// gitopsTargets reads the ServiceAccounts declared by the manifests under dir, e.g. a Config Sync
+// repository, and logs where the cluster has drifted from them: declared KSAs that don't exist, or
+// whose WI annotation differs. The declared KSAs with the WI annotation that exist are returned to be
+// diagnosed, along with the number of drifted KSAs. KSAs without a namespace are in ns.
+func gitopsTargets(ctx context.Context, client kubernetes.Interface, dir, ns string) ([]diagnose.Target, int, error) {
+	var targets []diagnose.Target
+	drifted := 0
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		switch strings.ToLower(filepath.Ext(path)) {
+		case ".yaml", ".yml", ".json":
+		default:
+			return nil
+		}
+		sas, err := readServiceAccounts(path)
+		if err != nil {
+			return fmt.Errorf("reading %q: %w", path, err)
+		}
+		for _, declared := range sas {
+			if declared.Namespace == "" {
+				declared.Namespace = ns
+			}
+			t := diagnose.Target{Namespace: declared.Namespace, KSA: declared.Name}
+			want, wantPresent := declared.Annotations[diagnose.WIGSAAnnotation]
+			live, err := client.CoreV1().ServiceAccounts(t.Namespace).Get(ctx, t.KSA, v1.GetOptions{})
+			if apierrors.IsNotFound(err) {
+				log.Printf("Drift: KSA %s/%s is declared in %q, but does not exist in the cluster.", t.Namespace, t.KSA, path)
+				drifted++
+				continue
+			} else if err != nil {
+				return fmt.Errorf("getting KSA %s/%s: %w", t.Namespace, t.KSA, err)
+			}
+			got, gotPresent := live.Annotations[diagnose.WIGSAAnnotation]
+			if want != got || wantPresent != gotPresent {
+				log.Printf("Drift: KSA %s/%s is declared in %q with WI annotation %s, but the cluster's has %s.",
+					t.Namespace, t.KSA, path, describeAnnotation(want, wantPresent), describeAnnotation(got, gotPresent))
+				drifted++
+			}
+			if wantPresent {
+				targets = append(targets, t)
+			}
+		}
+		return nil
+	})
+	return targets, drifted, err
+}
+
+// describeAnnotation describes the value of an annotation that may not be present.
+func describeAnnotation(value string, present bool) string {
+	if !present {
+		return "none"
+	}
+	return fmt.Sprintf("%q", value)
+}
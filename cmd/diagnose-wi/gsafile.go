@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/Harwayne/workload-identity/pkg/diagnose"
+	"google.golang.org/api/option"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// The states of a KSA granted access to a GSA, as reported by --gsa-file.
+const (
+	ksaExists  = "exists"
+	ksaMissing = "missing"
+	// ksaOtherPool is a KSA in another cluster's WI pool, which can't be looked up in this cluster.
+	ksaOtherPool = "other-pool"
+)
+
+// gsaKSABinding is a KSA member granted roles/iam.workloadIdentityUser on a GSA.
+type gsaKSABinding struct {
+	Member    string `json:"member"`
+	Pool      string `json:"pool"`
+	Namespace string `json:"namespace"`
+	KSA       string `json:"ksa"`
+	State     string `json:"state"`
+}
+
+// gsaReport is the KSAs bound to one of the GSAs of a --gsa-file.
+type gsaReport struct {
+	GSA   string          `json:"gsa"`
+	KSAs  []gsaKSABinding `json:"ksas"`
+	Error string          `json:"error,omitempty"`
+}
+
+// readGSAFile reads the GSA emails listed in a --gsa-file, one per line, dropping duplicates. Blank
+// lines, and everything after a #, are ignored.
+func readGSAFile(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var gsas []string
+	seen := map[string]bool{}
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		entry := scanner.Text()
+		if i := strings.Index(entry, "#"); i >= 0 {
+			entry = entry[:i]
+		}
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		if err := diagnose.ValidateGSAEmail(entry); err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		if !seen[entry] {
+			seen[entry] = true
+			gsas = append(gsas, entry)
+		}
+	}
+	return gsas, scanner.Err()
+}
+
+// runGSAFile reports, for each GSA, the KSA members granted roles/iam.workloadIdentityUser on it and
+// whether those in the cluster's WI pool exist. The GSAs' policies are read by up to workers at a
+// time. It returns the exit code: 1 if any policy could not be read.
+func runGSAFile(ctx context.Context, client kubernetes.Interface, opts []option.ClientOption, wiPool string, gsas []string, workers int, output string) int {
+	reports := make([]gsaReport, len(gsas))
+	// KSAs are often bound to several GSAs, so each is only looked up once.
+	var mu sync.Mutex
+	states := map[string]string{}
+	lookup := func(ns, ksa string) (string, error) {
+		key := ns + "/" + ksa
+		mu.Lock()
+		state, present := states[key]
+		mu.Unlock()
+		if present {
+			return state, nil
+		}
+		_, err := client.CoreV1().ServiceAccounts(ns).Get(ctx, ksa, v1.GetOptions{})
+		switch {
+		case apierrors.IsNotFound(err):
+			state = ksaMissing
+		case err != nil:
+			return "", fmt.Errorf("getting KSA %s: %w", key, err)
+		default:
+			state = ksaExists
+		}
+		mu.Lock()
+		states[key] = state
+		mu.Unlock()
+		return state, nil
+	}
+
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				reports[i] = gsaKSAReport(ctx, opts, wiPool, gsas[i], lookup)
+			}
+		}()
+	}
+	for i := range gsas {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+
+	code := 0
+	for _, r := range reports {
+		if r.Error != "" {
+			log.Printf("Error reading GSA %q: %s", r.GSA, r.Error)
+			code = 1
+		}
+	}
+	if err := printGSAReports(reports, output); err != nil {
+		log.Fatalf("Error writing the results: %v", err)
+	}
+	return code
+}
+
+// gsaKSAReport reads the GSA's policy and looks up each KSA member it grants
+// roles/iam.workloadIdentityUser to.
+func gsaKSAReport(ctx context.Context, opts []option.ClientOption, wiPool, gsa string, lookup func(ns, ksa string) (string, error)) gsaReport {
+	r := gsaReport{GSA: gsa}
+	policy, err := diagnose.GetGSAIAMPolicy(ctx, opts, gsa, *policyVersionFlag)
+	if err != nil {
+		r.Error = errorText(err)
+		return r
+	}
+	for _, b := range policy.Bindings {
+		if b.Role != "roles/iam.workloadIdentityUser" {
+			continue
+		}
+		for _, member := range b.Members {
+			pool, ns, ksa, ok := diagnose.ParseKSAIAMPolicyMember(member)
+			if !ok {
+				continue
+			}
+			binding := gsaKSABinding{Member: member, Pool: pool, Namespace: ns, KSA: ksa, State: ksaOtherPool}
+			if pool == wiPool {
+				if binding.State, err = lookup(ns, ksa); err != nil {
+					r.Error = err.Error()
+					return r
+				}
+			}
+			r.KSAs = append(r.KSAs, binding)
+		}
+	}
+	return r
+}
+
+// printGSAReports prints the reports as JSON, CSV or TSV with a row per KSA, or text.
+func printGSAReports(reports []gsaReport, output string) error {
+	switch output {
+	case "json":
+		b, err := json.MarshalIndent(reports, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(b))
+		return nil
+	case "csv", "tsv":
+		w := csv.NewWriter(os.Stdout)
+		if output == "tsv" {
+			w.Comma = '\t'
+		}
+		if err := w.Write([]string{"gsa", "member", "pool", "namespace", "ksa", "state"}); err != nil {
+			return err
+		}
+		for _, r := range reports {
+			for _, k := range r.KSAs {
+				if err := w.Write([]string{r.GSA, k.Member, k.Pool, k.Namespace, k.KSA, k.State}); err != nil {
+					return err
+				}
+			}
+		}
+		w.Flush()
+		return w.Error()
+	}
+	for _, r := range reports {
+		if r.Error != "" {
+			continue
+		}
+		if len(r.KSAs) == 0 {
+			fmt.Printf("GSA %q grants roles/iam.workloadIdentityUser to no KSAs\n", r.GSA)
+			continue
+		}
+		fmt.Printf("GSA %q grants roles/iam.workloadIdentityUser to %d KSAs:\n", r.GSA, len(r.KSAs))
+		for _, k := range r.KSAs {
+			fmt.Printf("  %s\t%s\n", k.State, k.Member)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/Harwayne/workload-identity/pkg/diagnose"
+)
+
+// runGSAOnly reports what can be found out about the KSA's access to the GSA without access to the
+// cluster: the GSA's roles on the project, and the members it lets act as it. Without the cluster,
+// its WI pool is unknown, so the KSA's exact member can't be matched. Members naming the KSA in any
+// pool are pointed out instead. The KSA must be bound in each of the expectedPools, e.g. those of the
+// clusters in other projects that share the GSA. It returns the process exit code.
+func runGSAOnly(ctx context.Context, gsa, ns, ksaName, project string, expectedPools []string) int {
+	if err := diagnose.ValidateGSAEmail(gsa); err != nil {
+		log.Printf("Invalid --gsa: %v", err)
+		return 1
+	}
+	opts := getGCPOptions()
+	breadcrumb("Project: %s", project)
+
+	policy, err := diagnose.GetGSAIAMPolicy(ctx, opts, gsa, *policyVersionFlag)
+	if err != nil {
+		log.Printf("Error getting the GSA's IAM policy: %s", errorText(err))
+		return 1
+	}
+	fmt.Printf("GSA %q lets these members act as it with %q:\n", gsa, workloadIdentityUserRole)
+	for _, binding := range policy.Bindings {
+		if binding.Role != workloadIdentityUserRole {
+			continue
+		}
+		for _, member := range binding.Members {
+			if _, mNS, mKSA, ok := diagnose.ParseKSAIAMPolicyMember(member); ok && mNS == ns && mKSA == ksaName {
+				fmt.Printf("  %s (names KSA %q in namespace %q)\n", member, ksaName, ns)
+			} else {
+				fmt.Printf("  %s\n", member)
+			}
+		}
+	}
+
+	pools := diagnose.MemberPools(policy)
+	fmt.Printf("GSA %q's KSA members are in the WI pools %v\n", gsa, pools)
+	code := 0
+	for _, pool := range expectedPools {
+		if _, _, ok := diagnose.KSAAccess(policy, pool, ns, ksaName); !ok {
+			log.Printf("GSA %q does not let KSA %q in namespace %q of WI pool %q act as it. To fix: %s",
+				gsa, ksaName, ns, pool, diagnose.GrantKSAAccessCommand(pool, ns, ksaName, gsa))
+			code = 1
+		}
+	}
+
+	roles, err := diagnose.GetGSAsRolesOnProject(ctx, opts, project, gsa, *policyVersionFlag)
+	if err != nil {
+		log.Printf("Error getting the GSA's roles: %s", errorText(err))
+		return 1
+	}
+	fmt.Printf("GSA %q's roles on the project %q are %v\n", gsa, project, roles)
+	log.Printf("Note: the cluster's WI pool is unknown without the cluster, so whether the GSA grants access to exactly %q was not checked.",
+		diagnose.KSAIAMPolicyMember("POOL", ns, ksaName))
+	return code
+}
+
+// runExpectKSAs checks that the KSAs the GSA lets act as it are exactly the expected members, no
+// more and no less, for GSAs that should only be used by a fixed set of workloads. It returns the
+// process exit code.
+func runExpectKSAs(ctx context.Context, gsa string, expected []string) int {
+	if err := diagnose.ValidateGSAEmail(gsa); err != nil {
+		log.Printf("Invalid --gsa: %v", err)
+		return 1
+	}
+	policy, err := diagnose.GetGSAIAMPolicy(ctx, getGCPOptions(), gsa, *policyVersionFlag)
+	if err != nil {
+		log.Printf("Error getting the GSA's IAM policy: %s", errorText(err))
+		return 1
+	}
+	missing, surplus := diagnose.CompareKSAMembers(policy, expected)
+	for _, member := range missing {
+		pool, ns, ksaName, _ := diagnose.ParseKSAIAMPolicyMember(member)
+		log.Printf("Missing: GSA %q does not let expected member %s act as it. To fix: %s",
+			gsa, member, diagnose.GrantKSAAccessCommand(pool, ns, ksaName, gsa))
+	}
+	for _, member := range surplus {
+		log.Printf("Unexpected: GSA %q lets %s act as it, which is not in --expect-ksas.", gsa, member)
+	}
+	if len(missing) > 0 || len(surplus) > 0 {
+		log.Printf("GSA %q's KSA members do not match: %d missing, %d unexpected.", gsa, len(missing), len(surplus))
+		return 1
+	}
+	fmt.Printf("GSA %q lets exactly the %d expected KSA members act as it.\n", gsa, len(expected))
+	return 0
+}
+
+// expectedKSAMembers returns the IAM members named by the --expect-ksas entries. An entry is either a
+// member, POOL[NS/KSA], or NS/KSA, which names the KSA in each of the pools.
+func expectedKSAMembers(entries, pools []string) ([]string, error) {
+	var members []string
+	for _, entry := range entries {
+		if wiPool, ns, ksaName, ok := diagnose.ParseKSAIAMPolicyMember("serviceAccount:" + strings.TrimPrefix(entry, "serviceAccount:")); ok {
+			members = append(members, diagnose.KSAIAMPolicyMember(wiPool, ns, ksaName))
+			continue
+		}
+		nsKSA := strings.SplitN(entry, "/", 2)
+		if len(nsKSA) != 2 || nsKSA[0] == "" || nsKSA[1] == "" {
+			return nil, fmt.Errorf("%q is neither NS/KSA nor POOL[NS/KSA]", entry)
+		}
+		if len(pools) == 0 {
+			return nil, fmt.Errorf("%q does not name its pool, use POOL[NS/KSA] or --expect-pools", entry)
+		}
+		for _, pool := range pools {
+			members = append(members, diagnose.KSAIAMPolicyMember(pool, nsKSA[0], nsKSA[1]))
+		}
+	}
+	return members, nil
+}
+
+// expectedPool returns the WI pool named by an --expect-pools entry, which is either a pool or the
+// project of a cluster whose pool is the project's default one.
+func expectedPool(entry string) string {
+	if strings.Contains(entry, ".") {
+		return entry
+	}
+	return entry + ".svc.id.goog"
+}
+
+// workloadIdentityUserRole is the role that lets a KSA act as a GSA.
+const workloadIdentityUserRole = "roles/iam.workloadIdentityUser"
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/Harwayne/workload-identity/pkg/diagnose"
+)
+
+// readKSAFile reads the targets listed in a --ksa-file, one NAMESPACE/KSA per line. Blank lines, and
+// everything after a #, are ignored.
+func readKSAFile(path string) ([]diagnose.Target, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var targets []diagnose.Target
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		entry := scanner.Text()
+		if i := strings.Index(entry, "#"); i >= 0 {
+			entry = entry[:i]
+		}
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		nsKSA := strings.SplitN(entry, "/", 2)
+		if len(nsKSA) != 2 {
+			return nil, fmt.Errorf("line %d: %q is not NAMESPACE/KSA", line, entry)
+		}
+		if err := diagnose.ValidateNamespace(nsKSA[0]); err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		if err := diagnose.ValidateKSAName(nsKSA[1]); err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		targets = append(targets, diagnose.Target{Namespace: nsKSA[0], KSA: nsKSA[1]})
+	}
+	return targets, scanner.Err()
+}
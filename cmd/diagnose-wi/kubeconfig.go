@@ -0,0 +1,143 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
+)
+
+func GetRESTConfig(serverURL, kubeconfig, kubeContext string) (*rest.Config, error) {
+	// A specific context can only come from a kubeconfig file.
+	if kubeContext != "" {
+		rules := clientcmd.NewDefaultClientConfigLoadingRules()
+		rules.ExplicitPath = kubeconfig
+		overrides := &clientcmd.ConfigOverrides{
+			CurrentContext: kubeContext,
+			ClusterInfo:    clientcmdapi.Cluster{Server: serverURL},
+		}
+		return clientcmd.NewNonInteractiveDeferredLoadingClientConfig(rules, overrides).ClientConfig()
+	}
+
+	// If we have an explicit indication of where the kubernetes config lives, read that.
+	if kubeconfig != "" {
+		c, err := clientcmd.BuildConfigFromFlags(serverURL, kubeconfig)
+		if err != nil {
+			return nil, err
+		}
+		return c, nil
+	}
+
+	// If not, try the in-cluster config.
+	if c, err := rest.InClusterConfig(); err == nil {
+		return c, nil
+	}
+
+	// If no in-cluster config, try the default location in the user's home directory.
+	if usr, err := user.Current(); err == nil {
+		if c, err := clientcmd.BuildConfigFromFlags("", filepath.Join(usr.HomeDir, ".kube", "config")); err == nil {
+			return c, nil
+		}
+	}
+
+	return nil, errors.New("could not create a valid kubeconfig, pass --kubeconfig, or --server with --token or --token-file and --ca-cert")
+}
+
+// kubeconfigNamespace returns the namespace of the first of the kubeconfig contexts, or of the current
+// context if there are none. It returns "default" if the context doesn't set one, or there is no
+// kubeconfig. In a Pod without a kubeconfig, it is the Pod's namespace.
+func kubeconfigNamespace(kubeconfig string, kubeContexts []string) string {
+	rules := clientcmd.NewDefaultClientConfigLoadingRules()
+	rules.ExplicitPath = kubeconfig
+	overrides := &clientcmd.ConfigOverrides{}
+	if len(kubeContexts) > 0 {
+		overrides.CurrentContext = kubeContexts[0]
+	}
+	ns, _, err := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(rules, overrides).Namespace()
+	if err != nil || ns == "" {
+		return "default"
+	}
+	return ns
+}
+
+// GetTokenRESTConfig returns the REST config for an API server reached with a bearer token, for
+// environments with a token but no kubeconfig. Exactly one of token and tokenFile must be set, along
+// with the server's URL and the path of its CA certificate.
+func GetTokenRESTConfig(serverURL, token, tokenFile, caCertFile string) (*rest.Config, error) {
+	switch {
+	case token != "" && tokenFile != "":
+		return nil, errors.New("only one of --token and --token-file can be given")
+	case serverURL == "" || caCertFile == "":
+		return nil, errors.New("--token and --token-file require --server and --ca-cert")
+	}
+	if _, err := os.Stat(caCertFile); err != nil {
+		return nil, fmt.Errorf("reading --ca-cert: %w", err)
+	}
+	if tokenFile != "" {
+		if _, err := os.Stat(tokenFile); err != nil {
+			return nil, fmt.Errorf("reading --token-file: %w", err)
+		}
+	}
+	return &rest.Config{
+		Host:            serverURL,
+		BearerToken:     token,
+		BearerTokenFile: tokenFile,
+		TLSClientConfig: rest.TLSClientConfig{CAFile: caCertFile},
+	}, nil
+}
+
+// connectGatewayServerRegexp matches the server URL of a kubeconfig cluster that is reached through
+// the Connect gateway, capturing the fleet project, the optional location and the membership.
+var connectGatewayServerRegexp = regexp.MustCompile(
+	`connectgateway\.googleapis\.com/v[^/]+/projects/([^/]+)/(?:locations/([^/]+)/)?(?:gkeMemberships|memberships)/([^/]+)`)
+
+// kubeconfigCluster is the cluster pointed at by a kubeconfig context. GKE contexts name the cluster
+// directly, Connect gateway contexts name the fleet membership the cluster is registered as.
+type kubeconfigCluster struct {
+	project    string
+	location   string
+	name       string
+	membership string
+}
+
+// getClusterFromKubeconfig returns the cluster the kubeconfig context points at, or the current
+// context if kubeContext is empty. Like kubectl, the kubeconfig is the file at the path, or else the
+// files in KUBECONFIG, or else ~/.kube/config.
+func getClusterFromKubeconfig(kubeconfig, kubeContext string) (kubeconfigCluster, error) {
+	rules := clientcmd.NewDefaultClientConfigLoadingRules()
+	rules.ExplicitPath = kubeconfig
+	kc, err := rules.Load()
+	if err != nil {
+		return kubeconfigCluster{}, err
+	}
+
+	if kubeContext == "" {
+		kubeContext = kc.CurrentContext
+	}
+	server := ""
+	if c, present := kc.Contexts[kubeContext]; present {
+		if cl, present := kc.Clusters[c.Cluster]; present {
+			server = cl.Server
+		}
+	}
+	if m := connectGatewayServerRegexp.FindStringSubmatch(server); m != nil {
+		location := m[2]
+		if location == "" {
+			location = "global"
+		}
+		return kubeconfigCluster{project: m[1], location: location, membership: m[3]}, nil
+	}
+
+	sp := strings.Split(kubeContext, "_")
+	if len(sp) != 4 || sp[0] != "gke" {
+		return kubeconfigCluster{}, fmt.Errorf("context %q is neither a GKE nor a Connect gateway context", kubeContext)
+	}
+	return kubeconfigCluster{project: sp[1], location: sp[2], name: sp[3]}, nil
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const testKubeconfig = `apiVersion: v1
+kind: Config
+current-context: gke_my-project_us-central1_my-cluster
+contexts:
+- name: gke_my-project_us-central1_my-cluster
+  context:
+    cluster: gke_my-project_us-central1_my-cluster
+- name: fleet
+  context:
+    cluster: fleet
+clusters:
+- name: gke_my-project_us-central1_my-cluster
+  cluster:
+    server: https://10.0.0.1
+- name: fleet
+  cluster:
+    server: https://connectgateway.googleapis.com/v1/projects/123/locations/us-east1/gkeMemberships/my-membership
+`
+
+func TestGetClusterFromKubeconfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config")
+	if err := os.WriteFile(path, []byte(testKubeconfig), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	// The explicit path must be read over KUBECONFIG.
+	t.Setenv("KUBECONFIG", filepath.Join(t.TempDir(), "missing"))
+
+	for _, tc := range []struct {
+		context string
+		want    kubeconfigCluster
+	}{
+		{context: "", want: kubeconfigCluster{project: "my-project", location: "us-central1", name: "my-cluster"}},
+		{context: "fleet", want: kubeconfigCluster{project: "123", location: "us-east1", membership: "my-membership"}},
+	} {
+		got, err := getClusterFromKubeconfig(path, tc.context)
+		if err != nil {
+			t.Fatalf("getClusterFromKubeconfig(%q): %v", tc.context, err)
+		}
+		if got != tc.want {
+			t.Errorf("getClusterFromKubeconfig(%q) = %+v, want %+v", tc.context, got, tc.want)
+		}
+	}
+
+	// Without the path, KUBECONFIG is read.
+	t.Setenv("KUBECONFIG", path)
+	if got, err := getClusterFromKubeconfig("", "fleet"); err != nil || got.membership != "my-membership" {
+		t.Errorf("getClusterFromKubeconfig with KUBECONFIG = %+v, %v, want membership my-membership", got, err)
+	}
+}
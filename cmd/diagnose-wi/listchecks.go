@@ -0,0 +1,29 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/Harwayne/workload-identity/pkg/diagnose"
+)
+
+// listChecks prints the checks, as a table or, with --output json, as a JSON array.
+func listChecks(checks []diagnose.Check, output string) error {
+	infos := diagnose.DescribeChecks(checks)
+	if output == "json" {
+		b, err := json.MarshalIndent(infos, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(b))
+		return nil
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tSEVERITY\tDESCRIPTION")
+	for _, info := range infos {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", info.Name, info.Severity, info.Description)
+	}
+	return w.Flush()
+}
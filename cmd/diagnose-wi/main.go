@@ -5,319 +5,1000 @@ import (
 	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"os"
-	"os/exec"
-	"os/user"
-	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 
-	"golang.org/x/oauth2"
-	"google.golang.org/api/option"
-
-	"gopkg.in/yaml.v2"
-
-	"google.golang.org/api/cloudresourcemanager/v1"
-	"google.golang.org/api/container/v1"
-	"google.golang.org/api/iam/v1"
-	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
-	"k8s.io/client-go/tools/clientcmd"
 
-	_ "k8s.io/client-go/plugin/pkg/client/auth/gcp"
-)
+	"github.com/Harwayne/workload-identity/pkg/diagnose"
 
-const (
-	wiGSAAnnotation = "iam.gke.io/gcp-service-account"
+	_ "k8s.io/client-go/plugin/pkg/client/auth/gcp"
 )
 
 var (
 	serverFlag = flag.String("server", "",
 		"The address of the Kubernetes API server. Overrides any value in kubeconfig. Only required if out-of-cluster.")
+	contextFlag = flag.String("context", "",
+		"Kubeconfig context to use, instead of the current context. A comma separated list diagnoses the KSA in each context and compares the results.")
 	kubeconfigFlag = flag.String("kubeconfig", os.Getenv("KUBECONFIG"),
 		"Path to a kubeconfig. Only required if out-of-cluster.")
+	tokenFlag = flag.String("token", "",
+		"Bearer token for the API server given by --server, instead of a kubeconfig. Requires --ca-cert.")
+	tokenFileFlag = flag.String("token-file", "",
+		"Path to a file containing the bearer token for the API server given by --server, instead of a kubeconfig. Requires --ca-cert.")
+	caCertFlag = flag.String("ca-cert", "",
+		"Path to the CA certificate of the API server given by --server, with --token or --token-file.")
+)
+
+var (
+	configFlag = flag.String("config", "",
+		"Path to a YAML file of flag defaults. Defaults to ~/.config/diagnose-wi.yaml. Command line flags take precedence.")
 )
 
 var (
 	ksaFlag     = flag.String("ksa", "", "KSA name")
-	nsFlag      = flag.String("ns", "default", "Pod Namespace")
-	podFlag     = flag.String("pod", "", "Pod name")
+	nsFlag      = flag.String("ns", "", "Pod Namespace. Defaults to the kubeconfig context's namespace, or else default.")
+	podFlag     = flag.String("pod", "", "Pod name, or a comma separated list of Pod names")
 	projectFlag = flag.String("project", "", "Project ID")
 
+	gsaProjectFlag = flag.Bool("gsa-project", false,
+		"Read the GSA's roles from the project in its email, rather than --project.")
+
+	selectorFlag   = flag.String("selector", "", "Label selector of the Pods to diagnose")
+	deploymentFlag = flag.String("deployment", "", "Deployment name")
+
 	clusterProjectFlag  = flag.String("clusterProject", "", "Cluster Project")
 	clusterLocationFlag = flag.String("clusterLocation", "", "Cluster Location")
 	clusterNameFlag     = flag.String("clusterName", "", "Cluster Name")
-)
+	clusterFlag         = flag.String("cluster", "",
+		"The cluster's resource name, projects/PROJECT/locations/LOCATION/clusters/NAME, instead of the kubeconfig context or the other cluster flags.")
+	clusterSelectorFlag = flag.String("cluster-selector", "",
+		"Select the cluster in --clusterProject by its GKE resource labels, e.g. env=prod, instead of the kubeconfig context or --clusterName.")
+
+	gsaFlag = flag.String("gsa", "",
+		"GSA email. With --ksa and no cluster access, lists the GSA's members and roles instead of diagnosing the KSA. On its own, diagnoses the KSAs in --ns annotated with the GSA.")
+	expectPoolsFlag = flag.String("expect-pools", "",
+		"With --gsa, comma separated WI pools, or projects of clusters using their default pool, each of which must bind the KSA to the GSA.")
+	expectKSAsFlag = flag.String("expect-ksas", "",
+		"With --gsa, comma separated KSAs, each NS/KSA in every --expect-pools pool or POOL[NS/KSA], that must be exactly the KSAs the GSA lets act as it.")
+
+	compareFlag = flag.String("compare", "",
+		"Two comma separated references, each a KSA name, pod/NAME, deployment/NAME or selector/SELECTOR, to diagnose and compare side by side.")
+	compareSelectorsFlag = flag.String("compare-selectors", "",
+		"Two semicolon separated Pod label selectors, e.g. version=stable;version=canary, whose Pods' KSAs to diagnose and compare side by side.")
+
+	auditFlag = flag.Bool("audit", false,
+		"Diagnose every KSA in the namespace with the WI annotation, and point out GSAs shared by many of them.")
+	listGSAsFlag = flag.Bool("list-gsas", false,
+		"List the GSAs the KSAs in the namespace are annotated with, and how many KSAs use each, instead of diagnosing them.")
+	gsaFileFlag = flag.String("gsa-file", "",
+		"File listing GSA emails, one per line, for each of which to report the KSAs granted roles/iam.workloadIdentityUser and whether they exist in the cluster, instead of diagnosing.")
+	gsaFileWorkersFlag = flag.Int("gsa-file-workers", 8,
+		"With --gsa-file, how many GSAs' IAM policies to read at a time.")
+	gitopsDirFlag = flag.String("gitops-dir", "",
+		"Directory of manifests, e.g. a Config Sync repository, whose ServiceAccounts are compared with the cluster's and diagnosed.")
+	ksaFileFlag = flag.String("ksa-file", "",
+		"File listing the KSAs to diagnose, one NAMESPACE/KSA per line. Blank lines and # comments are ignored.")
+	auditSharedGSAThresholdFlag = flag.Int("audit-shared-gsa-threshold", 3,
+		"With --audit, the number of KSAs linked to the same GSA at which it is pointed out.")
+	auditUnusedFlag = flag.Bool("audit-unused", false,
+		"With --audit, also point out the annotated KSAs that no Pod or controller uses, as candidates for cleanup.")
+
+	assumePoolFlag = flag.String("assume-pool", "",
+		"Use this WI pool instead of reading the cluster's, e.g. PROJECT.svc.id.goog, to check whether the bindings would work once WI is enabled.")
+
+	wifProviderFlag = flag.String("wif-provider", "",
+		"For a cluster outside of GKE and not in a fleet, the Workload Identity Federation pool provider its KSAs are federated through, projects/PROJECT_NUMBER/locations/global/workloadIdentityPools/POOL/providers/PROVIDER. The KSA is then matched by its principal in the provider's pool.")
+
+	expectGSAFlag = flag.String("expect-gsa", "",
+		"GSA email the KSA's WI annotation must exactly match. Useful in CI to detect annotation drift.")
+
+	additionalGSAsFlag = flag.String("additional-gsas", "",
+		"Comma separated GSAs, besides the annotated one, that the workload acts as through explicit credential configuration. Each is checked for the KSA's access and its roles.")
+
+	serveWebhookFlag = flag.String("serve-webhook", "",
+		"Address, e.g. :8443, to serve a validating admission webhook for ServiceAccounts on, at /validate, instead of diagnosing.")
+	tlsCertFlag         = flag.String("tls-cert", "", "With --serve-webhook, the path of the TLS certificate.")
+	tlsKeyFlag          = flag.String("tls-key", "", "With --serve-webhook, the path of the TLS certificate's key.")
+	webhookWarnOnlyFlag = flag.Bool("webhook-warn-only", false,
+		"With --serve-webhook, admit ServiceAccounts that fail the checks, with the failures as warnings.")
+	webhookFailOpenFlag = flag.Bool("webhook-fail-open", false,
+		"With --serve-webhook, admit ServiceAccounts whose checks can't complete, e.g. during a GCP API outage, with the errors as warnings, rather than rejecting them.")
 
-var (
-	ksaRoles = map[string]struct{}{
-		"roles/iam.workloadIdentityUser":       {},
-		"roles/iam.serviceAccountTokenCreator": {},
-		"roles/editor":                         {},
-		"roles/owner":                          {},
-	}
+	describeOnlyFlag = flag.Bool("describe-only", false,
+		"Only read the cluster, not GCP, and print the IAM bindings and roles to ask a GCP admin to verify.")
+
+	planFlag = flag.String("plan", "",
+		"YAML file declaring the GSA each KSA should act as and the GSA's roles. Prints the commands that make the live state match it.")
+
+	offlineFlag = flag.Bool("offline", false,
+		"Only run the checks that don't need access to the cluster or GCP, such as name and GSA email validity.")
+	fromFileFlag = flag.String("from-file", "",
+		"Path to a manifest containing the KSA, used instead of reading it from the cluster. Requires --offline.")
+
+	policyVersionFlag = flag.Int64("policy-version", 3,
+		"IAM policy version to request, 1 or 3. Version 3 is required to see conditional role bindings.")
+
+	allowedGSAProjectsFlag = flag.String("allowed-gsa-projects", "",
+		"Comma separated projects, besides the cluster's own, whose GSAs workloads are expected to use.")
+	skipGSAProjectCheckFlag = flag.Bool("skip-gsa-project-check", false,
+		"Do not warn when the GSA is in a project other than the cluster's or those in --allowed-gsa-projects. Same as --disable-check=gsa-project.")
+
+	checkStaleBindingsFlag = flag.Bool("check-stale-bindings", false,
+		"Also check that every KSA in this cluster that the GSA grants access to still exists. Costs an API call per KSA.")
+
+	checkGSAKeysFlag = flag.Bool("check-gsa-keys", false,
+		"Also warn about the GSA's user-managed keys, which WI makes unnecessary, and report whether org policy disables creating them.")
+
+	checkKSAProjectRolesFlag = flag.Bool("check-ksa-project-roles", false,
+		"Also report roles granted to the KSA directly on the project, rather than through the GSA.")
+
+	checkLeastPrivilegeFlag = flag.Bool("check-least-privilege", false,
+		"Also warn about the GSA's basic roles on the project, and suggest the IAM Recommender's smaller roles, which needs the Recommender API.")
+
+	noBroadRolesFlag = flag.Bool("no-broad-roles", false,
+		"Fail if the GSA only grants the KSA access through roles/editor or roles/owner, rather than roles/iam.workloadIdentityUser.")
+
+	failOnUnevaluableConditionsFlag = flag.Bool("fail-on-unevaluable-conditions", false,
+		"Fail if the GSA only grants the KSA access under an IAM condition, which can't be evaluated, rather than warning and assuming access.")
+
+	checkTokenRBACFlag = flag.Bool("check-token-rbac", false,
+		"Also report whether the KSA's RBAC lets it create tokens for other KSAs, through which it can act as their GSAs.")
+
+	probeTokenFlag = flag.Bool("probe-token", false,
+		"Also mint an access token for the GSA with your credentials, which needs roles/iam.serviceAccountTokenCreator on the GSA.")
+
+	checkConfigConnectorFlag = flag.Bool("check-config-connector", false,
+		"Also check that a ready Config Connector IAMPolicyMember in the namespace declares the KSA's binding on the GSA.")
+
+	checkIDTokenFlag = flag.Bool("check-id-token", false,
+		"Also check that the KSA may get OIDC ID tokens for the GSA, for workloads calling services that authenticate them, such as Cloud Run or IAP.")
+
+	troubleshootFlag = flag.Bool("troubleshoot", false,
+		"Also ask the Policy Troubleshooter API whether the KSA may act as the GSA, accounting for inherited policies and conditions.")
+	troubleshootPermissionsFlag = flag.String("troubleshoot-permissions", "",
+		"With --troubleshoot, comma separated permissions the workload needs, e.g. storage.objects.get, to ask whether the GSA has on the project.")
+
+	showGSADetailsFlag = flag.Bool("show-gsa-details", false,
+		"Also report the GSA's display name and description, to tell similarly named GSAs apart.")
+
+	followImpersonationFlag = flag.Bool("follow-impersonation", false,
+		"Also report the GSAs in the GSA's project that it can impersonate, directly or through other GSAs. Costs an API call per GSA in the project.")
+	maxDepthFlag = flag.Int("max-depth", diagnose.DefaultMaxImpersonationDepth,
+		"With --follow-impersonation, the most impersonation hops to follow.")
+
+	gsaNamePatternFlag = flag.String("gsa-name-pattern", "",
+		"Regular expression the whole name of the KSA's GSA, before the @, must match, e.g. 'wi-[a-z]+-[a-z]+'.")
+
+	roleFilterFlag = flag.String("role-filter", "",
+		"Regular expression limiting the GSA's reported roles to those it matches, e.g. storage.")
+
+	disableChecksFlag = flag.String("disable-check", "",
+		"Comma separated names of checks to skip. See --list-checks for the list of checks.")
+	profileFlag = flag.String("profile", "",
+		"Named set of checks to run: connectivity, security or full. security and full also turn on their opt-in checks. See the README for the checks of each.")
+	listChecksFlag = flag.Bool("list-checks", false,
+		"Print the name, severity and description of every check, as JSON with --output json, and exit.")
+
+	showPathsFlag = flag.Bool("show-paths", false,
+		"Also print where a correctly configured workload in the cluster reads its GCP credentials from.")
+
+	showProjectDetailsFlag = flag.Bool("show-project-details", false,
+		"Also print the project's display name and parent folder or organization. Costs an extra API call.")
+
+	explainErrorFlag = flag.Bool("explain-error", false,
+		"Decode GCP API errors into their status, message, missing permission and help links, rather than printing the raw error.")
+
+	breadcrumbsOnStderrFlag = flag.Bool("format-member-only-on-stderr", false,
+		"Write diagnostic breadcrumbs (namespace, cluster, WI pool, project) to stderr, leaving only the result on stdout.")
+
+	waitFlag = flag.Bool("wait", false,
+		"Re-run the diagnosis until it passes or -wait-timeout elapses, e.g. right after applying a fix while IAM changes propagate.")
+	waitTimeoutFlag = flag.Duration("wait-timeout", 2*time.Minute, "How long -wait waits for the diagnosis to pass.")
+
+	showPolicyEtagsFlag = flag.Bool("show-policy-etags", false,
+		"Report the etags of the GSA's and the project's IAM policies. With -wait, also report whether they changed between attempts.")
+
+	recordEventFlag = flag.Bool("record-event", false,
+		"Also record the result as a Kubernetes Event on the Pod, Deployment or KSA, e.g. when running as a Job in the cluster.")
+
+	writeFixScriptFlag = flag.String("write-fix-script", "",
+		"Write the commands that fix the problems found, for every KSA, to this file as an executable bash script to review and run.")
+
+	statsFileFlag = flag.String("stats-file", "",
+		"Append a JSON line recording the outcome of the run, without any names, to this local file. Off by default.")
+
+	otelEndpointFlag = flag.String("otel-endpoint", "",
+		"OTLP/HTTP endpoint, e.g. http://localhost:4318, to export OpenTelemetry traces of the diagnosis to, with a span per KSA and check. Off by default.")
+
+	requestReasonFlag = flag.String("request-reason", "",
+		"Justification attached to every GCP API call as X-Goog-Request-Reason, which Cloud Audit Logs record, e.g. for Access Approval.")
+
+	qpsFlag = flag.Float64("qps", 10,
+		"Maximum GCP API requests per second, shared by every check and KSA. Requests rejected for quota are retried after their Retry-After. 0 disables both.")
+
+	// Advanced options, for Private Google Access or test doubles.
+	iamEndpointFlag       = flag.String("iam-endpoint", "", "Advanced: base URL of the IAM API, instead of the default.")
+	containerEndpointFlag = flag.String("container-endpoint", "", "Advanced: base URL of the GKE API, instead of the default.")
+	crmEndpointFlag       = flag.String("crm-endpoint", "", "Advanced: base URL of the Cloud Resource Manager API, instead of the default.")
+
+	outputFlag = flag.String("output", "text",
+		"Output format: text, json, jsonl with a line per KSA as soon as it is diagnosed, cloud-logging for jsonl in the Cloud Logging structured log format, csv or tsv with a row per KSA, terraform to print import blocks for the KSA's and GSA's IAM bindings, dot to print a Graphviz graph of them, or go-template or go-template-file to execute --output-template for each KSA.")
+	jsonShapeFlag = flag.String("json-shape", "array",
+		"With --output json, array to print a list of results, or map to key them by Pod, Deployment or KSA name.")
+	outputTemplateFlag = flag.String("output-template", "",
+		"With --output go-template, a Go text/template executed against each diagnose.Result, e.g. '{{.KSA}} {{.GSA}} {{.Passed}}'. With --output go-template-file, the file containing it.")
 )
 
+// profileOptIns are the flags of the opt-in checks each --profile turns on.
+var profileOptIns = map[string][]*bool{
+	"security": {checkStaleBindingsFlag, checkKSAProjectRolesFlag, checkLeastPrivilegeFlag, checkTokenRBACFlag, followImpersonationFlag,
+		checkGSAKeysFlag},
+	"full": {checkStaleBindingsFlag, checkKSAProjectRolesFlag, checkLeastPrivilegeFlag, checkTokenRBACFlag, followImpersonationFlag,
+		checkGSAKeysFlag, checkIDTokenFlag, showGSADetailsFlag},
+}
+
+// breadcrumbs receives the incidental information gathered during the diagnosis, which is everything
+// other than the final result.
+var breadcrumbs io.Writer = os.Stdout
+
 func main() {
 	flag.Parse()
+	if *configFlag != "" {
+		if err := applyConfigFile(*configFlag, true); err != nil {
+			log.Fatalf("Error reading config file %q: %v", *configFlag, err)
+		}
+	} else if p := defaultConfigPath(); p != "" {
+		if err := applyConfigFile(p, false); err != nil {
+			log.Fatalf("Error reading config file %q: %v", p, err)
+		}
+	}
+	if *breadcrumbsOnStderrFlag {
+		breadcrumbs = os.Stderr
+	}
+	// Without --profile, every check runs, leaving the opt-in ones to their flags.
+	var profile diagnose.Profile
+	if *profileFlag != "" {
+		var err error
+		if profile, err = diagnose.LookupProfile(*profileFlag); err != nil {
+			log.Fatalf("Error in --profile: %v", err)
+		}
+		for _, f := range profileOptIns[profile.Name] {
+			*f = true
+		}
+	}
+	if *listChecksFlag {
+		if err := listChecks(diagnose.ProfileChecks(diagnose.BuiltinChecks(), profile), *outputFlag); err != nil {
+			log.Fatalf("Error listing the checks: %v", err)
+		}
+		return
+	}
 
-	prefix := ""
-	pod := *podFlag
+	if *nsFlag == "" {
+		// Like kubectl, diagnose the context's namespace unless told otherwise.
+		*nsFlag = kubeconfigNamespace(*kubeconfigFlag, splitList(*contextFlag))
+	}
+
+	pods := splitList(*podFlag)
 	ksa := *ksaFlag
 
-	if (ksa != "") == (pod != "") {
-		log.Fatal("Exactly one of --ksa and --pod must be specified.")
+	if *offlineFlag {
+		if len(pods) > 0 || *selectorFlag != "" || *deploymentFlag != "" {
+			log.Fatal("--offline only supports --ksa and --from-file, Pods and Deployments must be read from the cluster.")
+		}
+		if ksa == "" && *fromFileFlag == "" {
+			log.Fatal("--offline requires --ksa or --from-file.")
+		}
+		os.Exit(runOffline(*nsFlag, ksa, *fromFileFlag, *clusterProjectFlag))
+	} else if *fromFileFlag != "" {
+		log.Fatal("--from-file is only supported with --offline.")
+	}
+
+	// --gsa on its own finds its KSAs by their annotation, with --ksa it names the KSA.
+	gsaKSAs := *gsaFlag != "" && ksa == "" && *expectKSAsFlag == ""
+	noTargets := *planFlag != "" || *serveWebhookFlag != "" || *listGSAsFlag || *expectKSAsFlag != "" || *gsaFileFlag != ""
+	if set := countSet(ksa != "", len(pods) > 0 || *selectorFlag != "", *deploymentFlag != "", *auditFlag, *compareFlag != "" || *compareSelectorsFlag != "", *gitopsDirFlag != "", *ksaFileFlag != "", gsaKSAs); noTargets && set != 0 {
+		log.Fatal("--plan, --serve-webhook, --list-gsas, --expect-ksas and --gsa-file get their KSAs elsewhere, --ksa, --pod, --selector, --deployment, --audit, --compare, --gitops-dir and --ksa-file can't be used with them.")
+	} else if !noTargets && set != 1 {
+		log.Fatal("Exactly one of --ksa, --pod (or --selector), --deployment, --audit, --compare, --gitops-dir, --ksa-file and --gsa must be specified.")
+	}
+	if *describeOnlyFlag && (noTargets || *clusterSelectorFlag != "" || len(splitList(*contextFlag)) > 1) {
+		log.Fatal("--describe-only only reads the current cluster, it can't be used with --plan, --serve-webhook, --list-gsas, --gsa-file, --cluster-selector or multiple --context values.")
+	}
+	compareRefs := splitList(*compareFlag)
+	if *compareFlag != "" && *compareSelectorsFlag != "" {
+		log.Fatal("Only one of --compare and --compare-selectors can be specified.")
+	} else if *compareFlag != "" && len(compareRefs) != 2 {
+		log.Fatalf("--compare takes exactly two references, not %d.", len(compareRefs))
+	} else if *compareSelectorsFlag != "" {
+		// Selectors contain commas, so they are given separately and turned into references.
+		for _, selector := range strings.Split(*compareSelectorsFlag, ";") {
+			if selector = strings.TrimSpace(selector); selector != "" {
+				compareRefs = append(compareRefs, "selector/"+selector)
+			}
+		}
+		if len(compareRefs) != 2 {
+			log.Fatalf("--compare-selectors takes exactly two selectors, not %d.", len(compareRefs))
+		}
+	}
+	if *serveWebhookFlag != "" && (*tlsCertFlag == "" || *tlsKeyFlag == "") {
+		log.Fatal("--serve-webhook requires --tls-cert and --tls-key.")
+	}
+	if !noTargets {
+		if err := validateNames(*nsFlag, ksa, pods, *deploymentFlag); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *clusterFlag != "" {
+		if *clusterProjectFlag != "" || *clusterLocationFlag != "" || *clusterNameFlag != "" || *clusterSelectorFlag != "" {
+			log.Fatal("--cluster names the cluster, it can't be used with --clusterProject, --clusterLocation, --clusterName or --cluster-selector.")
+		}
+		if len(splitList(*contextFlag)) > 1 {
+			log.Fatal("--cluster names a single cluster, it can't be used with multiple --context values.")
+		}
+		var err error
+		*clusterProjectFlag, *clusterLocationFlag, *clusterNameFlag, err = diagnose.ParseClusterAPIName(*clusterFlag)
+		if err != nil {
+			log.Fatalf("Error in --cluster: %v", err)
+		}
+	}
+	if *wifProviderFlag != "" {
+		if _, err := diagnose.ParseWIFProvider(*wifProviderFlag); err != nil {
+			log.Fatalf("Error in --wif-provider: %v", err)
+		}
+		if *assumePoolFlag != "" {
+			log.Fatal("--wif-provider and --assume-pool both name the WI pool, pass only one.")
+		}
+	}
+	for _, gsa := range splitList(*additionalGSAsFlag) {
+		if err := diagnose.ValidateGSAEmail(gsa); err != nil {
+			log.Fatalf("Error in --additional-gsas: %v", err)
+		}
+	}
+	if *clusterLocationFlag != "" {
+		if err := diagnose.ValidateClusterLocation(*clusterLocationFlag); err != nil {
+			log.Fatal(err)
+		}
+	}
+	// finishOutput prints whatever the output format collects from every result.
+	printResult, finishOutput := printText, func() {}
+	switch *outputFlag {
+	case "text":
+	case "terraform":
+		// Keep stdout valid HCL.
+		breadcrumbs = os.Stderr
+		printResult = newTerraformPrinter().print
+	case "dot":
+		breadcrumbs = os.Stderr
+		dp := newDotPrinter()
+		printResult, finishOutput = dp.print, dp.finish
+	case "json":
+		breadcrumbs = os.Stderr
+		jp := &jsonPrinter{}
+		switch *jsonShapeFlag {
+		case "array":
+		case "map":
+			jp.byName = true
+		default:
+			log.Fatalf("--json-shape must be array or map, not %q.", *jsonShapeFlag)
+		}
+		printResult, finishOutput = jp.print, jp.finish
+	case "jsonl":
+		breadcrumbs = os.Stderr
+		printResult = printJSONLine
+	case "cloud-logging":
+		breadcrumbs = os.Stderr
+		printResult = printCloudLogging
+	case "csv", "tsv":
+		breadcrumbs = os.Stderr
+		comma := ','
+		if *outputFlag == "tsv" {
+			comma = '\t'
+		}
+		cp := newCSVPrinter(comma)
+		printResult, finishOutput = cp.print, cp.finish
+	case "go-template", "go-template-file":
+		breadcrumbs = os.Stderr
+		text := *outputTemplateFlag
+		if *outputFlag == "go-template-file" {
+			b, err := os.ReadFile(*outputTemplateFlag)
+			if err != nil {
+				log.Fatalf("Error reading --output-template: %v", err)
+			}
+			text = string(b)
+		}
+		tp, err := newTemplatePrinter(text)
+		if err != nil {
+			log.Fatalf("Error in --output-template: %v", err)
+		}
+		printResult = tp.print
+	default:
+		log.Fatalf("--output must be text, json, jsonl, cloud-logging, csv, tsv, terraform, dot, go-template or go-template-file, not %q.", *outputFlag)
+	}
+	if *outputTemplateFlag != "" && *outputFlag != "go-template" && *outputFlag != "go-template-file" {
+		log.Fatal("--output-template requires --output go-template or go-template-file.")
+	}
+	if *auditUnusedFlag && !*auditFlag {
+		log.Fatal("--audit-unused requires --audit.")
+	}
+	if *policyVersionFlag != 1 && *policyVersionFlag != 3 {
+		log.Fatalf("--policy-version must be 1 or 3, not %d.", *policyVersionFlag)
+	}
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "request-reason" && strings.TrimSpace(*requestReasonFlag) == "" {
+			log.Fatal("--request-reason must not be empty.")
+		}
+	})
+	for name, endpoint := range endpointFlags {
+		if err := validateEndpoint(*endpoint); err != nil {
+			log.Fatalf("Error in --%s: %v", name, err)
+		}
+	}
+	if err := validateEndpoint(*otelEndpointFlag); err != nil {
+		log.Fatalf("Error in --otel-endpoint: %v", err)
+	}
+	if *otelEndpointFlag != "" {
+		tracer = newOTelTracer(*otelEndpointFlag)
+	}
+	if *expectKSAsFlag != "" {
+		if *gsaFlag == "" {
+			log.Fatal("--expect-ksas requires --gsa.")
+		}
+		var pools []string
+		for _, entry := range splitList(*expectPoolsFlag) {
+			pools = append(pools, expectedPool(entry))
+		}
+		expected, err := expectedKSAMembers(splitList(*expectKSAsFlag), pools)
+		if err != nil {
+			log.Fatalf("Error in --expect-ksas: %v", err)
+		}
+		exit(traceRun("expect-ksas", map[string]string{"diagnose.gsa": *gsaFlag}, func(ctx context.Context) int {
+			return runExpectKSAs(ctx, *gsaFlag, expected)
+		}))
+	}
+	if gsaKSAs {
+		if err := diagnose.ValidateGSAEmail(*gsaFlag); err != nil {
+			log.Fatalf("Error in --gsa: %v", err)
+		}
+	} else if *gsaFlag != "" {
+		project, err := determineProject(*projectFlag)
+		if err != nil {
+			log.Fatalf("Error getting project: %s", errorText(err))
+		}
+		var pools []string
+		for _, entry := range splitList(*expectPoolsFlag) {
+			pools = append(pools, expectedPool(entry))
+		}
+		exit(traceRun("gsa-only", map[string]string{"diagnose.gsa": *gsaFlag}, func(ctx context.Context) int {
+			return runGSAOnly(ctx, *gsaFlag, *nsFlag, ksa, project, pools)
+		}))
+	}
+	disabledChecks := splitList(*disableChecksFlag)
+	if *skipGSAProjectCheckFlag {
+		disabledChecks = append(disabledChecks, "gsa-project")
+	}
+	checks, err := diagnose.FilterChecks(diagnose.ProfileChecks(diagnose.BuiltinChecks(), profile), disabledChecks)
+	if err != nil {
+		log.Fatalf("Error in --disable-check: %v", err)
+	}
+	checks = tracer.wrap(checks)
+	if *maxDepthFlag < 1 {
+		log.Fatalf("--max-depth must be at least 1, not %d.", *maxDepthFlag)
+	}
+	if _, err := regexp.Compile(*gsaNamePatternFlag); err != nil {
+		log.Fatalf("Error in --gsa-name-pattern: %v", err)
+	}
+	if _, err := regexp.Compile(*roleFilterFlag); err != nil {
+		log.Fatalf("Error in --role-filter: %v", err)
 	}
 
 	ctx := context.Background()
 
-	cfg, err := GetRESTConfig(*serverFlag, *kubeconfigFlag)
+	contexts := splitList(*contextFlag)
+	if *clusterSelectorFlag != "" {
+		if len(contexts) > 1 {
+			log.Fatal("--cluster-selector selects a single cluster, it can't be used with multiple --context values.")
+		}
+		if err := selectCluster(ctx); err != nil {
+			log.Fatalf("Error in --cluster-selector: %v", err)
+		}
+	}
+	if len(contexts) > 1 {
+		if ksa == "" {
+			log.Fatal("Multiple --context values only support --ksa, as Pods and Deployments differ between clusters.")
+		}
+		code := runContexts(ctx, contexts, *nsFlag, ksa, checks, printResult)
+		finishOutput()
+		exit(code)
+	}
+	kubeContext := ""
+	if len(contexts) == 1 {
+		kubeContext = contexts[0]
+	}
+
+	var cfg *rest.Config
+	if *tokenFlag != "" || *tokenFileFlag != "" {
+		if kubeContext != "" {
+			log.Fatal("--context can't be used with --token or --token-file.")
+		}
+		cfg, err = GetTokenRESTConfig(*serverFlag, *tokenFlag, *tokenFileFlag, *caCertFlag)
+	} else {
+		cfg, err = GetRESTConfig(*serverFlag, *kubeconfigFlag, kubeContext)
+	}
 	if err != nil {
 		log.Fatal("Error building kubeconfig: ", err)
 	}
 
 	client := kubernetes.NewForConfigOrDie(cfg)
 
-	if pod != "" {
-		prefix = fmt.Sprintf("Pod %q uses ", pod)
-		var err error
-		ksa, err = getPodKSA(ctx, client, *nsFlag, pod)
+	if *listGSAsFlag {
+		ksaGSAs, err := diagnose.GetAnnotatedKSAs(ctx, client, *nsFlag)
+		if err != nil {
+			log.Fatalf("Error listing the KSAs: %v", err)
+		}
+		if err := listGSAs(*nsFlag, ksaGSAs, *outputFlag); err != nil {
+			log.Fatalf("Error listing the GSAs: %v", err)
+		}
+		return
+	}
+	if *gsaFileFlag != "" {
+		gsas, err := readGSAFile(*gsaFileFlag)
+		if err != nil {
+			log.Fatalf("Error reading --gsa-file %q: %v", *gsaFileFlag, err)
+		}
+		if *gsaFileWorkersFlag < 1 {
+			log.Fatalf("--gsa-file-workers must be at least 1, not %d.", *gsaFileWorkersFlag)
+		}
+		env := newEnv(client, kubeContext)
+		wiPool, err := env.WIPool(ctx)
+		if err != nil {
+			// The bindings can still be listed, but not whether their KSAs exist.
+			log.Printf("Warning: could not get the cluster's WI pool, so no KSA is looked up: %s", errorText(err))
+		}
+		exit(traceRun("gsa-file", map[string]string{"diagnose.gsa_file": *gsaFileFlag}, func(ctx context.Context) int {
+			return runGSAFile(ctx, client, env.GCPOptions, wiPool, gsas, *gsaFileWorkersFlag, *outputFlag)
+		}))
+	}
+
+	targets := []diagnose.Target{{Namespace: *nsFlag, KSA: ksa}}
+	var auditedKSAs map[string]string
+	drifted := 0
+	if len(compareRefs) == 2 {
+		targets = nil
+		for _, ref := range compareRefs {
+			t, err := compareTarget(ctx, client, *nsFlag, ref)
+			if err != nil {
+				log.Fatalf("Error in --compare: %v", err)
+			}
+			targets = append(targets, t)
+		}
+	} else if *auditFlag {
+		auditedKSAs, err = diagnose.GetAnnotatedKSAs(ctx, client, *nsFlag)
+		if err != nil {
+			log.Fatalf("Error listing the KSAs: %v", err)
+		}
+		targets = nil
+		for _, name := range sortedKeys(auditedKSAs) {
+			targets = append(targets, diagnose.Target{Namespace: *nsFlag, KSA: name})
+		}
+		if len(targets) == 0 {
+			log.Fatalf("No KSAs in namespace %q have the WI annotation.", *nsFlag)
+		}
+	} else if gsaKSAs {
+		ksas, err := diagnose.GetKSAsAnnotatedWith(ctx, client, *nsFlag, *gsaFlag)
+		if err != nil {
+			log.Fatalf("Error listing the KSAs: %v", err)
+		}
+		if len(ksas) == 0 {
+			log.Fatalf("No KSA in namespace %q is annotated with GSA %q.", *nsFlag, *gsaFlag)
+		}
+		breadcrumb("KSAs annotated with GSA %q: %s", *gsaFlag, strings.Join(ksas, ", "))
+		targets = nil
+		for _, name := range ksas {
+			targets = append(targets, diagnose.Target{Namespace: *nsFlag, KSA: name})
+		}
+	} else if *ksaFileFlag != "" {
+		targets, err = readKSAFile(*ksaFileFlag)
+		if err != nil {
+			log.Fatalf("Error reading --ksa-file %q: %v", *ksaFileFlag, err)
+		}
+		if len(targets) == 0 {
+			log.Fatalf("--ksa-file %q lists no KSAs.", *ksaFileFlag)
+		}
+	} else if *gitopsDirFlag != "" {
+		targets, drifted, err = gitopsTargets(ctx, client, *gitopsDirFlag, *nsFlag)
+		if err != nil {
+			log.Fatalf("Error in --gitops-dir: %v", err)
+		}
+		if len(targets) == 0 && drifted == 0 {
+			log.Fatalf("No KSAs declared in %q have the WI annotation.", *gitopsDirFlag)
+		} else if len(targets) == 0 {
+			log.Fatalf("%d KSAs declared in %q have drifted from the cluster, and none can be diagnosed.", drifted, *gitopsDirFlag)
+		}
+	} else if *deploymentFlag != "" {
+		ksa, err = diagnose.GetDeploymentKSA(ctx, client, *nsFlag, *deploymentFlag)
+		if err != nil {
+			log.Fatalf("Error getting the Deployment's KSA: %v", err)
+		}
+		targets = []diagnose.Target{{Namespace: *nsFlag, KSA: ksa, Deployment: *deploymentFlag}}
+	} else if len(pods) == 1 && *selectorFlag == "" {
+		ksa, err = diagnose.GetPodKSA(ctx, client, *nsFlag, pods[0])
 		if err != nil {
 			log.Fatalf("Error getting the Pod's KSA: %v", err)
 		}
+		targets = []diagnose.Target{{Namespace: *nsFlag, KSA: ksa, Pod: pods[0]}}
+	} else if ksa == "" {
+		podKSAs, missing, err := diagnose.GetPodsKSAs(ctx, client, *nsFlag, pods, *selectorFlag)
+		if err != nil {
+			log.Fatalf("Error getting the Pods' KSAs: %v", err)
+		}
+		for _, name := range missing {
+			log.Printf("Note: Pod %q was not found in namespace %q, it may have been deleted. Skipping it.", name, *nsFlag)
+		}
+		targets = nil
+		for _, name := range sortedKeys(podKSAs) {
+			targets = append(targets, diagnose.Target{Namespace: *nsFlag, KSA: podKSAs[name], Pod: name})
+		}
+		if len(targets) == 0 {
+			log.Fatalf("No Pods to diagnose in namespace %q.", *nsFlag)
+		}
 	}
 
-	gsa, err := getKSAsWIAnotation(ctx, client, *nsFlag, ksa)
-	if err != nil {
-		log.Fatalf("Error getting the KSA's WI annotation: %v", err)
+	if !noTargets && *ksaFileFlag == "" {
+		breadcrumb("Namespace: %s", *nsFlag)
 	}
-
-	clusterProject, clusterLocation, clusterName := "", "", ""
-	if p, l, n, err := getClusterFromKubeconfig(); err == nil {
-		clusterProject = p
-		clusterLocation = l
-		clusterName = n
-	} else {
-		clusterProject = *clusterProjectFlag
-		clusterLocation = *clusterLocationFlag
-		clusterName = *clusterNameFlag
+	if *describeOnlyFlag {
+		exit(runDescribeOnly(ctx, client, kubeContext, targets))
 	}
 
-	wiPool, err := getWIPool(ctx, getClusterAPIName(clusterProject, clusterLocation, clusterName))
-	if err != nil {
-		log.Fatalf("Error getting WI Pool: %v", err)
+	env := newEnv(client, kubeContext)
+	if *checkConfigConnectorFlag {
+		env.Dynamic = dynamic.NewForConfigOrDie(cfg)
 	}
-	if hasAccess, err := ksaHasAccessToGSA(ctx, wiPool, *nsFlag, ksa, gsa); err != nil {
-		log.Fatalf("Error checking the KSAs access on the GSA: %v", err)
-	} else if !hasAccess {
-		log.Fatalf("%sKSA %q, which links to GSA %q, but that GSA does not grant access to the KSA",
-			prefix, ksa, gsa)
+	wiPool, err := env.WIPool(ctx)
+	var permErr *diagnose.ClusterPermissionError
+	if errors.As(err, &permErr) {
+		log.Fatalf("Error getting WI Pool: %s. Or, if you know the cluster's WI pool, pass it with --assume-pool to skip reading the cluster.", errorText(err))
+	} else if err != nil {
+		log.Fatalf("Error getting WI Pool: %s", errorText(err))
 	}
-	project, err := determineProject(*projectFlag)
+	source, err := env.WIPoolSource(ctx)
 	if err != nil {
-		log.Fatalf("Error getting project: %w", err)
+		log.Fatalf("Error getting WI Pool: %s", errorText(err))
 	}
-	roles, err := getGSAsRolesOnProject(ctx, project, gsa)
-	if err != nil {
-		log.Fatalf("Error getting the GSA %q's roles on project %q: %v", gsa, project, err)
+	breadcrumb("WI pool: %s (%s)", wiPool, source)
+	if *showPathsFlag {
+		showPaths(env, wiPool)
 	}
 
-	fmt.Printf("%sKSA %q, which links to GSA %q, whose roles on the project %q are %v\n",
-		prefix, ksa, gsa, project, roles)
-}
-
-func getPodKSA(ctx context.Context, client kubernetes.Interface, ns, podName string) (string, error) {
-	pod, err := client.CoreV1().Pods(ns).Get(ctx, podName, v1.GetOptions{})
-	if err != nil {
-		return "", err
+	if *serveWebhookFlag != "" {
+		log.Fatal(serveWebhook(*serveWebhookFlag, *tlsCertFlag, *tlsKeyFlag, env, *webhookWarnOnlyFlag, *webhookFailOpenFlag))
 	}
-	return pod.Spec.ServiceAccountName, nil
-}
 
-func getKSAsWIAnotation(ctx context.Context, client kubernetes.Interface, ns, ksaName string) (string, error) {
-	ksa, err := client.CoreV1().ServiceAccounts(ns).Get(ctx, ksaName, v1.GetOptions{})
+	env.Project, err = determineProject(*projectFlag)
 	if err != nil {
-		return "", err
+		log.Fatalf("Error getting project: %s", errorText(err))
 	}
-	if gsa, present := ksa.Annotations[wiGSAAnnotation]; !present {
-		return "", fmt.Errorf("ksa does not have the WI annotation, %q", wiGSAAnnotation)
-	} else {
-		return gsa, nil
+	breadcrumb("Project: %s", env.Project)
+	if *showProjectDetailsFlag {
+		p, err := diagnose.GetProject(ctx, env.GCPOptions, env.Project)
+		if err != nil {
+			log.Fatalf("Error getting the details of project %q: %s", env.Project, errorText(err))
+		}
+		breadcrumb("%s", diagnose.DescribeProject(p))
 	}
-}
 
-func ksaHasAccessToGSA(ctx context.Context, wiPool, ns, ksaName, gsaEmail string) (bool, error) {
-	iamSVC, err := iam.NewService(ctx, getGCPOptions()...)
-	if err != nil {
-		return false, fmt.Errorf("creating IAM.Service: %w", err)
+	if *planFlag != "" {
+		exit(runPlan(ctx, env, *planFlag))
 	}
-	saSVC := iam.NewProjectsServiceAccountsService(iamSVC)
-	gsaAPIResource := getGSAAPIResource(gsaEmail)
-	gsaPolicy, err := saSVC.GetIamPolicy(gsaAPIResource).Do()
-	if err != nil {
-		return false, fmt.Errorf("getting GSA %q IAMPolicy: %w", gsaAPIResource, err)
-	}
-	ksaMember := ksaIAMPolicyMember(wiPool, ns, ksaName)
-	for _, binding := range gsaPolicy.Bindings {
-		for _, member := range binding.Members {
-			if member == ksaMember {
-				if _, present := ksaRoles[binding.Role]; present {
-					return true, nil
-				}
+
+	// --output jsonl and cloud-logging print each result as soon as it is ready, unless the results may be replaced by
+	// --wait's later attempts or are compared afterwards.
+	streamed := (*outputFlag == "jsonl" || *outputFlag == "cloud-logging") && !*waitFlag && len(compareRefs) != 2
+	var emit func(*diagnose.Result)
+	if streamed {
+		emit = printResult
+	}
+	deadline := time.Now().Add(*waitTimeoutFlag)
+	var results []*diagnose.Result
+	for attempt := 1; ; attempt++ {
+		previous := results
+		var failing int
+		results, failing = diagnoseTargets(ctx, env, targets, checks, emit)
+		if failing == 0 || !*waitFlag {
+			break
+		}
+		if *showPolicyEtagsFlag && previous != nil {
+			logUnchangedPolicies(previous, results)
+		}
+		if time.Now().Add(waitInterval).After(deadline) {
+			log.Printf("Gave up waiting after %v, %d of %d KSAs are still unhealthy.", *waitTimeoutFlag, failing, len(targets))
+			break
+		}
+		log.Printf("Attempt %d: %d of %d KSAs are unhealthy, retrying in %v.", attempt, failing, len(targets), waitInterval)
+		time.Sleep(waitInterval)
+	}
+	exportTraces()
+	if *auditFlag {
+		reportSharedGSAs(*nsFlag, auditedKSAs, *auditSharedGSAThresholdFlag)
+	}
+	if *auditUnusedFlag {
+		consumers, err := diagnose.GetKSAConsumers(ctx, client, *nsFlag)
+		if err != nil {
+			log.Fatalf("Error listing the KSAs' Pods and controllers: %v", err)
+		}
+		reportUnusedKSAs(*nsFlag, auditedKSAs, consumers)
+	}
+	if *writeFixScriptFlag != "" {
+		if err := writeFixScript(*writeFixScriptFlag, results); err != nil {
+			log.Fatalf("Error writing --write-fix-script %q: %v", *writeFixScriptFlag, err)
+		}
+		breadcrumb("Wrote the fixes to %s", *writeFixScriptFlag)
+	}
+	if *statsFileFlag != "" {
+		if err := appendStats(*statsFileFlag, results); err != nil {
+			log.Printf("Warning: could not append to --stats-file %q: %v", *statsFileFlag, err)
+		}
+	}
+	if len(compareRefs) == 2 {
+		for _, result := range results {
+			logChecks(result)
+		}
+		printComparison(results[0], results[1])
+		return
+	}
+	failing := 0
+	for _, result := range results {
+		if !streamed {
+			printResult(result)
+		}
+		if *recordEventFlag {
+			if err := recordEvent(ctx, client, result); err != nil {
+				log.Printf("Warning: could not record an Event for %s: %v", result.Target, err)
 			}
 		}
+		if !result.Passed() {
+			failing++
+		}
 	}
-	return false, nil
-}
-
-func getGCPOptions() []option.ClientOption {
-	var options []option.ClientOption
-	if ts := getTokenSource(); ts != nil {
-		options = append(options, option.WithTokenSource(ts))
+	finishOutput()
+	if *ksaFileFlag != "" && *outputFlag == "text" {
+		// The KSAs may be in different namespaces, which the results above don't say.
+		fmt.Println("Summary:")
+		for _, result := range results {
+			status := "pass"
+			if !result.Passed() {
+				status = "FAIL"
+			}
+			fmt.Printf("  %s %s/%s\n", status, result.Namespace, result.KSA)
+		}
+		fmt.Printf("%d of %d KSAs passed.\n", len(results)-failing, len(results))
 	}
-	return options
-}
-
-func getTokenSource() oauth2.TokenSource {
-	gct, err := getGcloudToken()
-	if err != nil {
-		return nil
+	if *auditFlag && failing > 0 {
+		log.Printf("Audit: %d of %d KSAs passed.", len(results)-failing, len(results))
+		if *outputFlag == "text" {
+			printRemediations(results)
+		}
 	}
-	return &ts{
-		token: gct,
+	if drifted > 0 {
+		log.Printf("%d KSAs declared in %q have drifted from the cluster.", drifted, *gitopsDirFlag)
 	}
-}
-
-type ts struct {
-	token string
-}
-
-func (ts *ts) Token() (*oauth2.Token, error) {
-	return &oauth2.Token{
-		AccessToken: ts.token,
-		TokenType:   "Bearer",
-	}, nil
-}
-
-func getGcloudToken() (string, error) {
-	cmd := exec.Command("gcloud", "auth", "print-access-token")
-	o, err := cmd.Output()
-	if err != nil {
-		return "", err
+	if failing > 0 || drifted > 0 {
+		exit(1)
 	}
-	t := string(o)
-	return strings.TrimSpace(t), nil
 }
 
-func getGSAAPIResource(gsaEmail string) string {
-	return fmt.Sprintf("projects/-/serviceAccounts/%s", gsaEmail)
+// newEnv returns the Env to diagnose KSAs in the cluster the kubeconfig context points at, or the
+// current context if kubeContext is empty. The cluster flags are used if the context doesn't name a
+// GKE cluster or fleet membership, or if --cluster-selector is set.
+func newEnv(client kubernetes.Interface, kubeContext string) *diagnose.Env {
+	env := &diagnose.Env{
+		Kube:                        client,
+		AssumePool:                  *assumePoolFlag,
+		WIFProvider:                 *wifProviderFlag,
+		GCPOptions:                  getGCPOptions(),
+		PolicyVersion:               *policyVersionFlag,
+		UseGSAProject:               *gsaProjectFlag,
+		ExpectGSA:                   *expectGSAFlag,
+		AllowedGSAProjects:          splitList(*allowedGSAProjectsFlag),
+		AdditionalGSAs:              splitList(*additionalGSAsFlag),
+		CheckStaleBindings:          *checkStaleBindingsFlag,
+		CheckKSAProjectRoles:        *checkKSAProjectRolesFlag,
+		CheckLeastPrivilege:         *checkLeastPrivilegeFlag,
+		CheckGSAKeys:                *checkGSAKeysFlag,
+		CheckTokenRBAC:              *checkTokenRBACFlag,
+		ProbeToken:                  *probeTokenFlag,
+		CheckIDToken:                *checkIDTokenFlag,
+		CheckConfigConnector:        *checkConfigConnectorFlag,
+		FollowImpersonation:         *followImpersonationFlag,
+		MaxImpersonationDepth:       *maxDepthFlag,
+		NoBroadRoles:                *noBroadRolesFlag,
+		FailOnUnevaluableConditions: *failOnUnevaluableConditionsFlag,
+		ShowGSADetails:              *showGSADetailsFlag,
+		ShowPolicyEtags:             *showPolicyEtagsFlag,
+		Troubleshoot:                *troubleshootFlag,
+		ExplainErrors:               *explainErrorFlag,
+	}
+	if *troubleshootFlag {
+		env.TroubleshootPermissions = splitList(*troubleshootPermissionsFlag)
+	}
+	// main has already checked the regular expressions compile.
+	if *roleFilterFlag != "" {
+		env.RoleFilter = regexp.MustCompile(*roleFilterFlag)
+	}
+	if *gsaNamePatternFlag != "" {
+		env.GSANamePattern = regexp.MustCompile("^(?:" + *gsaNamePatternFlag + ")$")
+	}
+	if env.WIFProvider != "" {
+		// The cluster is not in GKE, so there is nothing to read about it from GCP.
+		env.ClusterProject = *clusterProjectFlag
+		breadcrumb("Federated through: %s", env.WIFProvider)
+	} else {
+		setCluster(env, kubeContext)
+	}
+	return env
 }
 
-func ksaIAMPolicyMember(wiPool, ns, ksaName string) string {
-	return fmt.Sprintf("serviceAccount:%s[%s/%s]", wiPool, ns, ksaName)
+// setCluster sets the Env's cluster to the one the kubeconfig context points at, or the current
+// context if kubeContext is empty, falling back to the cluster flags.
+func setCluster(env *diagnose.Env, kubeContext string) {
+	kc, kcErr := getClusterFromKubeconfig(*kubeconfigFlag, kubeContext)
+	if *clusterSelectorFlag != "" {
+		// selectCluster has already set the cluster flags to the selected cluster.
+		kcErr = errors.New("the cluster was selected by --cluster-selector")
+	} else if *clusterFlag != "" {
+		// main has already set the cluster flags to the parts of --cluster.
+		kcErr = errors.New("the cluster was given by --cluster")
+	}
+	if kcErr == nil && kc.membership != "" {
+		env.ClusterProject = kc.project
+		env.MembershipAPIName = diagnose.MembershipAPIName(kc.project, kc.location, kc.membership)
+		breadcrumb("Fleet membership: %s", env.MembershipAPIName)
+	} else {
+		env.ClusterProject = *clusterProjectFlag
+		env.ClusterAPIName = diagnose.ClusterAPIName(*clusterProjectFlag, *clusterLocationFlag, *clusterNameFlag)
+		if kcErr == nil {
+			env.ClusterProject = kc.project
+			env.ClusterAPIName = diagnose.ClusterAPIName(kc.project, kc.location, kc.name)
+		}
+		breadcrumb("Cluster: %s", env.ClusterAPIName)
+	}
 }
 
-func getClusterAPIName(project, location, name string) string {
-	return fmt.Sprintf("projects/%s/locations/%s/clusters/%s", project, location, name)
-}
-func getWIPool(ctx context.Context, clusterAPIName string) (string, error) {
-	gkeSVC, err := container.NewService(ctx, getGCPOptions()...)
+// selectCluster sets --clusterLocation and --clusterName to the cluster in --clusterProject selected
+// by --cluster-selector.
+func selectCluster(ctx context.Context) error {
+	if *clusterProjectFlag == "" {
+		return errors.New("--clusterProject is required")
+	}
+	selector, err := labels.Parse(*clusterSelectorFlag)
 	if err != nil {
-		return "", fmt.Errorf("creating GKE.Service: %w", err)
+		return err
 	}
-
-	cluster, err := gkeSVC.Projects.Locations.Clusters.Get(clusterAPIName).Do()
+	cluster, err := diagnose.FindClusterByLabels(ctx, getGCPOptions(), *clusterProjectFlag, selector)
 	if err != nil {
-		return "", fmt.Errorf("getting GKE Cluster %q: %w", clusterAPIName, err)
+		return err
 	}
-	return cluster.WorkloadIdentityConfig.WorkloadPool, nil
+	breadcrumb("Selected cluster %q in %q by labels %q", cluster.Name, cluster.Location, selector)
+	*clusterLocationFlag = cluster.Location
+	*clusterNameFlag = cluster.Name
+	return nil
 }
 
-func getGSAsRolesOnProject(ctx context.Context, project, gsaEmail string) ([]string, error) {
-	crmSVC, err := cloudresourcemanager.NewService(ctx, getGCPOptions()...)
-	if err != nil {
-		return []string{}, fmt.Errorf("creating CloudResourceManager.Service: %w", err)
+// validateNames checks the names given on the command line are valid, so typos fail fast instead of
+// as a confusing 400 or 404 from the API server. Empty names weren't given, and are not checked.
+func validateNames(ns, ksaName string, pods []string, deployment string) error {
+	if err := diagnose.ValidateNamespace(ns); err != nil {
+		return err
 	}
-	projSVC := cloudresourcemanager.NewProjectsService(crmSVC)
-	iamPolicy, err := projSVC.GetIamPolicy(project, &cloudresourcemanager.GetIamPolicyRequest{}).Do()
-	if err != nil {
-		return []string{}, fmt.Errorf("getting Project %q IAMPolicy: %w", project, err)
-	}
-	gsaMember := gsaIAMPolicyMember(gsaEmail)
-	var roles []string
-	for _, binding := range iamPolicy.Bindings {
-		for _, member := range binding.Members {
-			if member == gsaMember {
-				roles = append(roles, binding.Role)
-				break
-			}
+	if ksaName != "" {
+		if err := diagnose.ValidateKSAName(ksaName); err != nil {
+			return err
 		}
 	}
-	return roles, nil
-}
-
-func gsaIAMPolicyMember(gsaEmail string) string {
-	return fmt.Sprintf("serviceAccount:%s", gsaEmail)
-}
-
-func determineProject(projectFlagValue string) (string, error) {
-	if projectFlagValue != "" {
-		return projectFlagValue, nil
+	for _, pod := range pods {
+		if err := diagnose.ValidateObjectName("Pod", pod); err != nil {
+			return err
+		}
 	}
-	cmd := exec.Command("gcloud", "config", "get-value", "core/project")
-	o, err := cmd.Output()
-	if err != nil {
-		return "", err
+	if deployment != "" {
+		return diagnose.ValidateObjectName("Deployment", deployment)
 	}
-	p := string(o)
-	return strings.TrimSpace(p), nil
+	return nil
 }
 
-func GetRESTConfig(serverURL, kubeconfig string) (*rest.Config, error) {
-	// If we have an explicit indication of where the kubernetes config lives, read that.
-	if kubeconfig != "" {
-		c, err := clientcmd.BuildConfigFromFlags(serverURL, kubeconfig)
-		if err != nil {
-			return nil, err
+// waitInterval is how long -wait waits between attempts.
+const waitInterval = 10 * time.Second
+
+// diagnoseTargets diagnoses every target, in order, returning the results and how many of them
+// failed. If emit is not nil, each result is passed to it as soon as it is ready.
+func diagnoseTargets(ctx context.Context, env *diagnose.Env, targets []diagnose.Target, checks []diagnose.Check, emit func(*diagnose.Result)) ([]*diagnose.Result, int) {
+	var results []*diagnose.Result
+	failing := 0
+	for _, t := range targets {
+		tctx, s := tracer.start(ctx, "diagnose "+t.Namespace+"/"+t.KSA, targetAttributes(t))
+		result := diagnose.Run(tctx, diagnose.NewInput(env, t), checks)
+		errMessage := ""
+		if !result.Passed() {
+			errMessage = "diagnosis failed"
+		}
+		s.end(map[string]string{"diagnose.gsa": result.GSA, "diagnose.passed": strconv.FormatBool(result.Passed())}, errMessage)
+		if emit != nil {
+			emit(result)
+		}
+		results = append(results, result)
+		if !result.Passed() {
+			failing++
 		}
-		return c, nil
 	}
+	return results, failing
+}
 
-	// If not, try the in-cluster config.
-	if c, err := rest.InClusterConfig(); err == nil {
-		return c, nil
+// logUnchangedPolicies points out the failing results whose IAM policies have the same etags as in
+// the previous attempt, in which case a fix that was just applied has not reached them, as opposed to
+// changed policies that IAM has yet to propagate. Both attempts diagnosed the same targets in order.
+func logUnchangedPolicies(previous, results []*diagnose.Result) {
+	for i, r := range results {
+		p := previous[i]
+		if r.Passed() || r.GSAPolicyEtag == "" {
+			continue
+		}
+		if r.GSAPolicyEtag == p.GSAPolicyEtag && r.ProjectPolicyEtag == p.ProjectPolicyEtag {
+			log.Printf("%s: the IAM policies have not changed since the last attempt, check the fix was applied.", r.Target)
+		} else {
+			log.Printf("%s: the IAM policies changed since the last attempt, waiting for IAM to propagate the change.", r.Target)
+		}
 	}
+}
 
-	// If no in-cluster config, try the default location in the user's home directory.
-	if usr, err := user.Current(); err == nil {
-		if c, err := clientcmd.BuildConfigFromFlags("", filepath.Join(usr.HomeDir, ".kube", "config")); err == nil {
-			return c, nil
+// countSet returns how many of the conditions are true.
+func countSet(conditions ...bool) int {
+	n := 0
+	for _, c := range conditions {
+		if c {
+			n++
 		}
 	}
-
-	return nil, errors.New("could not create a valid kubeconfig")
+	return n
 }
 
-func getClusterFromKubeconfig() (string, string, string, error) {
-	usr, err := user.Current()
-	if err != nil {
-		return "", "", "", nil
-	}
-	fp := filepath.Join(usr.HomeDir, ".kube", "config")
-	f, err := os.Open(fp)
-	if err != nil {
-		return "", "", "", err
+// splitList splits a comma separated flag value, dropping empty elements.
+func splitList(s string) []string {
+	var l []string
+	for _, e := range strings.Split(s, ",") {
+		if e = strings.TrimSpace(e); e != "" {
+			l = append(l, e)
+		}
 	}
-	d := yaml.NewDecoder(f)
-	type kubeconfig struct {
-		CurrentContext string `yaml:"current-context"`
+	return l
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
 	}
-	kc := &kubeconfig{}
-	err = d.Decode(kc)
-	if err != nil {
-		return "", "", "", err
+	sort.Strings(keys)
+	return keys
+}
+
+// errorText returns the error's message, with GCP API errors decoded if --explain-error is set.
+func errorText(err error) string {
+	if *explainErrorFlag {
+		return diagnose.ExplainError(err)
 	}
-	sp := strings.Split(kc.CurrentContext, "_")
-	return sp[1], sp[2], sp[3], nil
+	return err.Error()
+}
+
+func breadcrumb(format string, args ...interface{}) {
+	fmt.Fprintf(breadcrumbs, format+"\n", args...)
 }
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/yaml"
+
+	"github.com/Harwayne/workload-identity/pkg/diagnose"
+)
+
+// liveChecks are the parts of the diagnosis that need access to the cluster or to GCP, which are
+// skipped in offline mode.
+var liveChecks = []string{
+	"Reading the KSA from the cluster",
+	"Reading the cluster's WI pool",
+	"Checking the GSA grants the KSA access",
+	"Reading the GSA's roles on the project",
+}
+
+// offlineResult is the outcome of a single offline check. A non-empty skipped explains why the check
+// did not run. A non-empty warning is reported without failing the run, as the online check does.
+type offlineResult struct {
+	name    string
+	detail  string
+	err     error
+	skipped string
+	warning string
+}
+
+// runOffline performs every check that doesn't require API access and prints the results, reading
+// the KSA from manifestPath if it is not empty. It returns the process exit code.
+func runOffline(ns, ksaName, manifestPath, clusterProject string) int {
+	var sa *corev1.ServiceAccount
+	if manifestPath != "" {
+		var err error
+		sa, err = readServiceAccountManifest(manifestPath, ksaName)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error reading %q: %v\n", manifestPath, err)
+			return 1
+		}
+		ksaName = sa.Name
+		if sa.Namespace != "" {
+			ns = sa.Namespace
+		}
+	}
+
+	results := []offlineResult{
+		{name: "Namespace name", detail: ns, err: diagnose.ValidateNamespace(ns)},
+		{name: "KSA name", detail: ksaName, err: diagnose.ValidateKSAName(ksaName)},
+	}
+
+	gsa := ""
+	if sa == nil {
+		results = append(results,
+			offlineResult{name: "WI annotation", skipped: "requires live access, or a manifest via --from-file"},
+			offlineResult{name: "GSA email", skipped: "no WI annotation to check"})
+	} else if v, present := sa.Annotations[diagnose.WIGSAAnnotation]; !present {
+		results = append(results,
+			offlineResult{name: "WI annotation", err: fmt.Errorf("ksa does not have the WI annotation, %q", diagnose.WIGSAAnnotation)},
+			offlineResult{name: "GSA email", skipped: "no WI annotation to check"})
+	} else {
+		gsa = diagnose.CleanGSAAnnotation(v)
+		warning := ""
+		if gsa != v {
+			warning = fmt.Sprintf("annotation value %q has surrounding quotes or whitespace, using %q. Fix the template that sets it.", v, gsa)
+		}
+		results = append(results,
+			offlineResult{name: "WI annotation", detail: gsa, warning: warning},
+			offlineResult{name: "GSA email", detail: gsa, err: diagnose.ValidateGSAEmail(gsa)})
+	}
+
+	if clusterProject == "" {
+		results = append(results, offlineResult{name: "KSA member", skipped: "--clusterProject is needed to derive the WI pool"})
+	} else {
+		// GKE clusters use their project's pool, which is confirmed only by reading the cluster.
+		wiPool := fmt.Sprintf("%s.svc.id.goog", clusterProject)
+		results = append(results, offlineResult{name: "KSA member", detail: diagnose.KSAIAMPolicyMember(wiPool, ns, ksaName)})
+	}
+
+	for _, c := range liveChecks {
+		results = append(results, offlineResult{name: c, skipped: "requires live access"})
+	}
+
+	exitCode := 0
+	for _, r := range results {
+		switch {
+		case r.skipped != "":
+			fmt.Printf("SKIPPED  %s: %s\n", r.name, r.skipped)
+		case r.err != nil:
+			fmt.Printf("FAILED   %s: %v\n", r.name, r.err)
+			exitCode = 1
+		case r.warning != "":
+			fmt.Printf("WARNING  %s: %s\n", r.name, r.warning)
+		default:
+			fmt.Printf("OK       %s: %s\n", r.name, r.detail)
+		}
+	}
+	return exitCode
+}
+
+// readServiceAccountManifest returns the ServiceAccount named ksaName from the YAML or JSON manifest,
+// which may contain several documents. If ksaName is empty, the first ServiceAccount is returned.
+func readServiceAccountManifest(path, ksaName string) (*corev1.ServiceAccount, error) {
+	sas, err := readServiceAccounts(path)
+	if err != nil {
+		return nil, err
+	}
+	for _, sa := range sas {
+		if ksaName == "" || sa.Name == ksaName {
+			return sa, nil
+		}
+	}
+	if ksaName == "" {
+		return nil, fmt.Errorf("no ServiceAccount in the manifest")
+	}
+	return nil, fmt.Errorf("no ServiceAccount %q in the manifest", ksaName)
+}
+
+// readServiceAccounts returns every ServiceAccount in the YAML or JSON manifest, in order.
+func readServiceAccounts(path string) ([]*corev1.ServiceAccount, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	d := yaml.NewYAMLOrJSONDecoder(f, 4096)
+	var sas []*corev1.ServiceAccount
+	for {
+		sa := &corev1.ServiceAccount{}
+		if err := d.Decode(sa); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		if sa.Kind == "ServiceAccount" {
+			sas = append(sas, sa)
+		}
+	}
+	return sas, nil
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestRunOfflineAnnotationCleanup checks that, like the online ksa-annotation check, offline mode
+// only warns about annotation values that needed cleanup, and fails on invalid ones.
+func TestRunOfflineAnnotationCleanup(t *testing.T) {
+	for _, tc := range []struct {
+		value    string
+		wantCode int
+	}{
+		{value: "app-sa@my-project.iam.gserviceaccount.com", wantCode: 0},
+		{value: `'"app-sa@my-project.iam.gserviceaccount.com"'`, wantCode: 0},
+		{value: `"  app-sa@my-project.iam.gserviceaccount.com "`, wantCode: 0},
+		{value: "not-an-email", wantCode: 1},
+	} {
+		manifest := fmt.Sprintf(`apiVersion: v1
+kind: ServiceAccount
+metadata:
+  name: agent
+  namespace: my-ns
+  annotations:
+    iam.gke.io/gcp-service-account: %s
+`, tc.value)
+		path := filepath.Join(t.TempDir(), "sa.yaml")
+		if err := os.WriteFile(path, []byte(manifest), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if code := runOffline("", "", path, "my-project"); code != tc.wantCode {
+			t.Errorf("runOffline with annotation %s = %d, want %d", tc.value, code, tc.wantCode)
+		}
+	}
+}
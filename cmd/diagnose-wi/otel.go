@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Harwayne/workload-identity/pkg/diagnose"
+)
+
+// tracer records the diagnosis as OpenTelemetry spans, a span per target with a child span per check,
+// and exports them to --otel-endpoint. It is nil without --otel-endpoint, and a nil tracer records
+// nothing.
+var tracer *otelTracer
+
+// otelTracer collects the spans of a run, all in one trace, until they are exported with OTLP/HTTP's
+// JSON encoding. Runs are short, so the spans are kept in memory rather than batched.
+type otelTracer struct {
+	endpoint string
+	traceID  string
+
+	mu    sync.Mutex
+	spans []otlpSpan
+}
+
+func newOTelTracer(endpoint string) *otelTracer {
+	return &otelTracer{endpoint: endpoint, traceID: randomID(16)}
+}
+
+// span is a span in progress. end records it with its final attributes and status.
+type span struct {
+	t      *otelTracer
+	id     string
+	parent string
+	name   string
+	start  time.Time
+	attrs  []otlpAttribute
+}
+
+type parentSpanKey struct{}
+
+// start starts a span named name, a child of the span in ctx if there is one, and returns a context
+// for its children.
+func (t *otelTracer) start(ctx context.Context, name string, attrs map[string]string) (context.Context, *span) {
+	if t == nil {
+		return ctx, nil
+	}
+	s := &span{t: t, id: randomID(8), name: name, start: time.Now(), attrs: otlpAttributes(attrs)}
+	s.parent, _ = ctx.Value(parentSpanKey{}).(string)
+	return context.WithValue(ctx, parentSpanKey{}, s.id), s
+}
+
+// end records the span, adding the attributes. An error message marks the span as failed.
+func (s *span) end(attrs map[string]string, errMessage string) {
+	if s == nil {
+		return
+	}
+	status := otlpStatus{Code: otlpStatusOK}
+	if errMessage != "" {
+		status = otlpStatus{Code: otlpStatusError, Message: errMessage}
+	}
+	s.t.mu.Lock()
+	defer s.t.mu.Unlock()
+	s.t.spans = append(s.t.spans, otlpSpan{
+		TraceID:      s.t.traceID,
+		SpanID:       s.id,
+		ParentSpanID: s.parent,
+		Name:         s.name,
+		Kind:         otlpSpanKindInternal,
+		Start:        strconv.FormatInt(s.start.UnixNano(), 10),
+		End:          strconv.FormatInt(time.Now().UnixNano(), 10),
+		Attributes:   append(s.attrs, otlpAttributes(attrs)...),
+		Status:       status,
+	})
+}
+
+// wrap returns the checks, each recording a span of its run.
+func (t *otelTracer) wrap(checks []diagnose.Check) []diagnose.Check {
+	if t == nil {
+		return checks
+	}
+	var wrapped []diagnose.Check
+	for _, c := range checks {
+		wrapped = append(wrapped, tracedCheck{Check: c})
+	}
+	return wrapped
+}
+
+// tracedCheck records a span of each run of the check, with the names of the resources it was run on
+// and its outcome.
+type tracedCheck struct {
+	diagnose.Check
+}
+
+func (c tracedCheck) Run(ctx context.Context, in *diagnose.Input) (diagnose.CheckResult, error) {
+	ctx, s := tracer.start(ctx, "check "+c.Name(), map[string]string{"diagnose.check": c.Name()})
+	cr, err := c.Check.Run(ctx, in)
+	attrs := map[string]string{
+		"diagnose.gsa":     in.GSA,
+		"diagnose.wi_pool": in.WIPool,
+		"diagnose.status":  string(cr.Status),
+		"diagnose.message": cr.Message,
+	}
+	errMessage := ""
+	if err != nil {
+		attrs["diagnose.status"] = string(diagnose.StatusError)
+		errMessage = err.Error()
+	} else if cr.Status == diagnose.StatusError {
+		errMessage = cr.Message
+	}
+	s.end(attrs, errMessage)
+	return cr, err
+}
+
+// targetAttributes names the target's resources, as span attributes.
+func targetAttributes(t diagnose.Target) map[string]string {
+	return map[string]string{
+		"k8s.namespace.name":      t.Namespace,
+		"k8s.serviceaccount.name": t.KSA,
+		"k8s.pod.name":            t.Pod,
+		"k8s.deployment.name":     t.Deployment,
+	}
+}
+
+// export sends the spans recorded so far to --otel-endpoint, and forgets them.
+func (t *otelTracer) export(ctx context.Context) error {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	spans := t.spans
+	t.spans = nil
+	t.mu.Unlock()
+	if len(spans) == 0 {
+		return nil
+	}
+	body, err := json.Marshal(otlpTraces{ResourceSpans: []otlpResourceSpans{{
+		Resource: otlpResource{Attributes: otlpAttributes(map[string]string{"service.name": "diagnose-wi"})},
+		ScopeSpans: []otlpScopeSpans{{
+			Scope: otlpScope{Name: "github.com/Harwayne/workload-identity/cmd/diagnose-wi"},
+			Spans: spans,
+		}},
+	}}})
+	if err != nil {
+		return err
+	}
+	url := t.endpoint
+	if !strings.HasSuffix(url, "/v1/traces") {
+		url = strings.TrimSuffix(url, "/") + "/v1/traces"
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s returned %s", url, resp.Status)
+	}
+	return nil
+}
+
+// randomID returns n random bytes in hex, the encoding of trace and span IDs in OTLP's JSON.
+func randomID(n int) string {
+	b := make([]byte, n)
+	// crypto/rand.Read doesn't fail on the platforms the tool runs on.
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// otlpAttributes returns the attributes with values, sorted by key. Empty values are dropped.
+func otlpAttributes(attrs map[string]string) []otlpAttribute {
+	var l []otlpAttribute
+	for _, k := range sortedKeys(attrs) {
+		if attrs[k] != "" {
+			l = append(l, otlpAttribute{Key: k, Value: otlpValue{StringValue: attrs[k]}})
+		}
+	}
+	return l
+}
+
+// The subset of OTLP's JSON encoding of traces that the tool uses.
+// See https://opentelemetry.io/docs/specs/otlp/#json-protobuf-encoding.
+
+const (
+	otlpSpanKindInternal = 1
+	otlpStatusOK         = 1
+	otlpStatusError      = 2
+)
+
+type otlpTraces struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID      string          `json:"traceId"`
+	SpanID       string          `json:"spanId"`
+	ParentSpanID string          `json:"parentSpanId,omitempty"`
+	Name         string          `json:"name"`
+	Kind         int             `json:"kind"`
+	Start        string          `json:"startTimeUnixNano"`
+	End          string          `json:"endTimeUnixNano"`
+	Attributes   []otlpAttribute `json:"attributes,omitempty"`
+	Status       otlpStatus      `json:"status"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+// exportTraces exports the spans recorded so far, if --otel-endpoint is set.
+func exportTraces() {
+	if err := tracer.export(context.Background()); err != nil {
+		log.Printf("Warning: could not export traces to --otel-endpoint %q: %v", *otelEndpointFlag, err)
+	}
+}
+
+// exit exports the spans recorded so far, which os.Exit would drop, and exits with the code.
+func exit(code int) {
+	exportTraces()
+	os.Exit(code)
+}
+
+// traceRun runs a mode that doesn't run the checks, such as --gsa-file, in a span of its own, which
+// is failed if run returns a non-zero exit code. It returns the exit code.
+func traceRun(name string, attrs map[string]string, run func(ctx context.Context) int) int {
+	ctx, s := tracer.start(context.Background(), name, attrs)
+	code := run(ctx)
+	errMessage := ""
+	if code != 0 {
+		errMessage = fmt.Sprintf("exited with code %d", code)
+	}
+	s.end(nil, errMessage)
+	return code
+}
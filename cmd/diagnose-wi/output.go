@@ -0,0 +1,435 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/Harwayne/workload-identity/pkg/diagnose"
+)
+
+// printText prints the result for a person to read. Only the final verdict goes to stdout; warnings
+// and failures are logged, and informational results are breadcrumbs.
+func printText(r *diagnose.Result) {
+	logChecks(r)
+	if r.Passed() {
+		fmt.Println(verdict(r))
+		for _, g := range r.AdditionalGSAs {
+			fmt.Printf("%s, which also uses %s\n", r.Target, g)
+		}
+	}
+	logSkipped(r)
+}
+
+// logSkipped writes the checks that were skipped, and why, as breadcrumbs, so a clean result isn't
+// taken to cover them. The opt-in checks that weren't enabled share a line.
+func logSkipped(r *diagnose.Result) {
+	skipped := r.Skipped()
+	if len(skipped) == 0 {
+		return
+	}
+	breadcrumb("Skipped checks:")
+	var notEnabled []string
+	for _, c := range skipped {
+		if c.Message == diagnose.SkipNotEnabled {
+			notEnabled = append(notEnabled, c.Name)
+			continue
+		}
+		breadcrumb("  %s: %s", c.Name, c.Message)
+	}
+	if len(notEnabled) > 0 {
+		breadcrumb("  not enabled: %s", strings.Join(notEnabled, ", "))
+	}
+}
+
+// verdict describes a result that passed.
+func verdict(r *diagnose.Result) string {
+	switch {
+	case r.NodeGSA != "":
+		return fmt.Sprintf("%s, which runs as the node's GSA %q without WI, whose roles on the project %q are %v",
+			r.Target, r.NodeGSA, r.Project, r.Roles)
+	case r.PoolAssumed:
+		return fmt.Sprintf("Hypothetically, with WI pool %q: %s, which links to GSA %q, whose roles on the project %q are %v",
+			r.WIPool, r.Target, r.GSA, r.Project, r.Roles)
+	}
+	return fmt.Sprintf("%s, which links to GSA %q, whose roles on the project %q are %v", r.Target, r.GSA, r.Project, r.Roles)
+}
+
+// logChecks logs the warnings, failures and errors of the result's checks, and writes its
+// informational results as breadcrumbs.
+func logChecks(r *diagnose.Result) {
+	for _, c := range r.Checks {
+		switch c.Status {
+		case diagnose.StatusInfo:
+			breadcrumb("%s", c.Message)
+		case diagnose.StatusWarn:
+			log.Printf("Warning: %s", c.Message)
+		case diagnose.StatusFail:
+			log.Print(c.Message)
+		case diagnose.StatusError:
+			log.Printf("%s: error in check %q: %s", r.Target, c.Name, c.Message)
+		}
+		for _, rem := range c.Remediations {
+			log.Printf("  To fix: %s", rem.Command)
+		}
+	}
+}
+
+// terraformPrinter prints the IAM bindings found for each result as Terraform import blocks, each
+// followed by a stub of the resource it imports. Bindings shared by several results, such as the
+// roles of a GSA used by many Pods, are only printed once.
+type terraformPrinter struct {
+	printed map[string]bool
+	// names are the resource addresses already printed, which must be unique.
+	names map[string]bool
+}
+
+func newTerraformPrinter() *terraformPrinter {
+	return &terraformPrinter{printed: map[string]bool{}, names: map[string]bool{}}
+}
+
+func (p *terraformPrinter) print(r *diagnose.Result) {
+	logChecks(r)
+	if r.HasAccess {
+		gsaProject, ok := diagnose.GSAProject(r.GSA)
+		if !ok {
+			gsaProject = "-"
+		}
+		saID := fmt.Sprintf("projects/%s/serviceAccounts/%s", gsaProject, r.GSA)
+		member := r.AccessMember
+		p.printBinding("google_service_account_iam_member",
+			terraformName(gsaProject, strings.SplitN(r.GSA, "@", 2)[0], r.Namespace, r.KSA, roleName(r.AccessRole)),
+			fmt.Sprintf("%s %s %s", saID, r.AccessRole, member),
+			[][2]string{{"service_account_id", saID}, {"role", r.AccessRole}, {"member", member}})
+	}
+	// The roles are the node's GSA's if the KSA's workloads run as it.
+	gsa := r.GSA
+	if r.NodeGSA != "" {
+		gsa = r.NodeGSA
+	}
+	gsaName := strings.SplitN(gsa, "@", 2)[0]
+	gsaProject, ok := diagnose.GSAProject(gsa)
+	if !ok {
+		gsaProject = "-"
+	}
+	member := diagnose.GSAIAMPolicyMember(gsa)
+	for _, role := range r.Roles {
+		p.printBinding("google_project_iam_member",
+			terraformName(r.Project, gsaProject, gsaName, roleName(role)),
+			fmt.Sprintf("%s %s %s", r.Project, role, member),
+			[][2]string{{"project", r.Project}, {"role", role}, {"member", member}})
+	}
+}
+
+// printBinding prints the import block and resource stub of a single binding, unless it has already
+// been printed. If another binding already has the name, e.g. the same KSA's in two clusters' pools, a
+// number is appended to it.
+func (p *terraformPrinter) printBinding(resourceType, name, importID string, attrs [][2]string) {
+	if p.printed[resourceType+" "+importID] {
+		return
+	}
+	p.printed[resourceType+" "+importID] = true
+	for base, i := name, 2; p.names[resourceType+"."+name]; i++ {
+		name = fmt.Sprintf("%s_%d", base, i)
+	}
+	p.names[resourceType+"."+name] = true
+	fmt.Printf("import {\n  to = %s.%s\n  id = %q\n}\n\n", resourceType, name, importID)
+	fmt.Printf("resource %q %q {\n", resourceType, name)
+	for _, a := range attrs {
+		fmt.Printf("  %-18s = %q\n", a[0], a[1])
+	}
+	fmt.Print("}\n\n")
+}
+
+// roleName returns the role's name without the roles/ prefix of predefined roles, e.g.
+// "iam.workloadIdentityUser" for "roles/iam.workloadIdentityUser". Custom roles keep their project or
+// organization, so roles of the same name in different ones stay apart.
+func roleName(role string) string {
+	return strings.TrimPrefix(role, "roles/")
+}
+
+var terraformNameInvalidRegexp = regexp.MustCompile(`[^A-Za-z0-9_-]`)
+
+// terraformName joins the parts into a valid Terraform resource name.
+func terraformName(parts ...string) string {
+	name := terraformNameInvalidRegexp.ReplaceAllString(strings.Join(parts, "_"), "_")
+	if name == "" || (name[0] >= '0' && name[0] <= '9') || name[0] == '-' {
+		name = "_" + name
+	}
+	return name
+}
+
+// dotPrinter collects the results into a single Graphviz DOT graph of the Pods, KSAs, GSAs, WI pools
+// and projects they involve, printed by finish. Edges are labeled with how the nodes relate, and
+// broken relationships are drawn dashed in red.
+type dotPrinter struct {
+	nodes []string
+	edges []string
+	seen  map[string]bool
+}
+
+func newDotPrinter() *dotPrinter {
+	return &dotPrinter{seen: map[string]bool{}}
+}
+
+func (p *dotPrinter) node(id, shape string) string {
+	if !p.seen[id] {
+		p.seen[id] = true
+		p.nodes = append(p.nodes, fmt.Sprintf("  %q [shape=%s];", id, shape))
+	}
+	return id
+}
+
+func (p *dotPrinter) edge(from, to, label string, ok bool) {
+	style := ""
+	if !ok {
+		style = `, style=dashed, color=red`
+	}
+	e := fmt.Sprintf("  %q -> %q [label=%q%s];", from, to, label, style)
+	if !p.seen[e] {
+		p.seen[e] = true
+		p.edges = append(p.edges, e)
+	}
+}
+
+func (p *dotPrinter) print(r *diagnose.Result) {
+	logChecks(r)
+	ksa := p.node(fmt.Sprintf("KSA %s/%s", r.Namespace, r.KSA), "ellipse")
+	switch {
+	case r.Pod != "":
+		p.edge(p.node(fmt.Sprintf("Pod %s/%s", r.Namespace, r.Pod), "box"), ksa, "uses", true)
+	case r.Deployment != "":
+		p.edge(p.node(fmt.Sprintf("Deployment %s/%s", r.Namespace, r.Deployment), "box"), ksa, "uses", true)
+	}
+	if r.WIPool != "" {
+		p.edge(ksa, p.node("WI pool "+r.WIPool, "hexagon"), "member of", true)
+	}
+	project := p.node("Project "+r.Project, "folder")
+	if r.NodeGSA != "" {
+		nodeGSA := p.node("GSA "+r.NodeGSA, "ellipse")
+		p.edge(ksa, nodeGSA, "runs as, via the node", true)
+		p.edge(nodeGSA, project, fmt.Sprintf("roles %s", strings.Join(r.Roles, ", ")), len(r.Roles) > 0)
+		return
+	}
+	if r.GSA == "" {
+		return
+	}
+	gsa := p.node("GSA "+r.GSA, "ellipse")
+	p.edge(ksa, gsa, "annotated with", true)
+	if r.HasAccess {
+		p.edge(gsa, ksa, "grants "+r.AccessRole, true)
+	} else {
+		p.edge(gsa, ksa, "does not grant access", false)
+	}
+	p.edge(gsa, project, fmt.Sprintf("roles %s", strings.Join(r.Roles, ", ")), len(r.Roles) > 0)
+}
+
+// finish prints the graph of every result printed so far.
+func (p *dotPrinter) finish() {
+	fmt.Println("digraph workload_identity {")
+	for _, n := range p.nodes {
+		fmt.Println(n)
+	}
+	for _, e := range p.edges {
+		fmt.Println(e)
+	}
+	fmt.Println("}")
+}
+
+// jsonResult is a Result as printed by --output json.
+type jsonResult struct {
+	*diagnose.Result
+	Passed bool `json:"passed"`
+}
+
+// jsonPrinter collects the results, printed by finish as a JSON array, or as an object keyed by the
+// name of the Pod, Deployment or KSA each result was found through, e.g. for `jq '.["my-pod"]'`. If
+// the results are in several namespaces, the keys are NAMESPACE/NAME.
+type jsonPrinter struct {
+	byName  bool
+	results []jsonResult
+}
+
+func (p *jsonPrinter) print(r *diagnose.Result) {
+	logChecks(r)
+	p.results = append(p.results, jsonResult{Result: r, Passed: r.Passed()})
+}
+
+// finish prints every result printed so far.
+func (p *jsonPrinter) finish() {
+	var v interface{} = p.results
+	if p.byName {
+		namespaces := map[string]bool{}
+		for _, r := range p.results {
+			namespaces[r.Namespace] = true
+		}
+		m := make(map[string]jsonResult, len(p.results))
+		for _, r := range p.results {
+			key := resultName(r.Result)
+			if len(namespaces) > 1 {
+				key = r.Namespace + "/" + key
+			}
+			// The same KSA diagnosed in several contexts has no key of its own.
+			if _, present := m[key]; present {
+				log.Fatalf("Error encoding the results as JSON: several results are named %q, e.g. from different --context values, use --json-shape array.", key)
+			}
+			m[key] = r
+		}
+		v = m
+	}
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		log.Fatalf("Error encoding the results as JSON: %v", err)
+	}
+	fmt.Println(string(b))
+}
+
+// printJSONLine prints the result as a single line of JSON, for --output jsonl.
+func printJSONLine(r *diagnose.Result) {
+	logChecks(r)
+	b, err := json.Marshal(jsonResult{Result: r, Passed: r.Passed()})
+	if err != nil {
+		log.Fatalf("Error encoding the result as JSON: %v", err)
+	}
+	fmt.Println(string(b))
+}
+
+// cloudLoggingEntry is a result in the structured logging format that GKE's logging agent reads from
+// a container's stdout: severity and message become the log entry's own fields, the labels its labels,
+// and the rest its jsonPayload.
+type cloudLoggingEntry struct {
+	Severity string            `json:"severity"`
+	Message  string            `json:"message"`
+	Labels   map[string]string `json:"logging.googleapis.com/labels"`
+	jsonResult
+}
+
+// printCloudLogging prints the result as a single line of JSON in the Cloud Logging structured log
+// format, for --output cloud-logging. Failures and warnings are only in the line, as anything logged
+// to stderr would become a separate, unstructured, entry.
+func printCloudLogging(r *diagnose.Result) {
+	entry := cloudLoggingEntry{
+		Severity:   "INFO",
+		Labels:     map[string]string{"namespace": r.Namespace, "ksa": r.KSA},
+		jsonResult: jsonResult{Result: r, Passed: r.Passed()},
+	}
+	var problems []string
+	for _, c := range r.Checks {
+		switch c.Status {
+		case diagnose.StatusWarn:
+			if entry.Severity == "INFO" {
+				entry.Severity = "WARNING"
+			}
+			problems = append(problems, c.Message)
+		case diagnose.StatusFail, diagnose.StatusError:
+			entry.Severity = "ERROR"
+			problems = append(problems, c.Message)
+		}
+	}
+	switch {
+	case !r.Passed():
+		entry.Message = strings.Join(problems, "; ")
+	case len(problems) > 0:
+		entry.Message = verdict(r) + ". Warnings: " + strings.Join(problems, "; ")
+	default:
+		entry.Message = verdict(r)
+	}
+	if r.GSA != "" {
+		entry.Labels["gsa"] = r.GSA
+	}
+	b, err := json.Marshal(entry)
+	if err != nil {
+		log.Fatalf("Error encoding the result as JSON: %v", err)
+	}
+	fmt.Println(string(b))
+}
+
+// templatePrinter executes a user's template against each result, like kubectl's -o go-template, for
+// formats the tool doesn't have.
+type templatePrinter struct {
+	t *template.Template
+}
+
+func newTemplatePrinter(text string) (*templatePrinter, error) {
+	if strings.TrimSpace(text) == "" {
+		return nil, fmt.Errorf("the template is empty")
+	}
+	t, err := template.New("output").Funcs(template.FuncMap{"join": strings.Join}).Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	return &templatePrinter{t: t}, nil
+}
+
+// print executes the template against the result, ending its output with a newline if the template
+// doesn't.
+func (tp *templatePrinter) print(r *diagnose.Result) {
+	logChecks(r)
+	var b strings.Builder
+	if err := tp.t.Execute(&b, r); err != nil {
+		log.Fatalf("Error executing --output-template for %s: %v", r.Target, err)
+	}
+	out := b.String()
+	if !strings.HasSuffix(out, "\n") {
+		out += "\n"
+	}
+	fmt.Print(out)
+}
+
+// csvPrinter writes a row per result, for spreadsheets, e.g. of an --audit. Roles are joined by
+// commas in a single field, which the CSV writer quotes.
+type csvPrinter struct {
+	w      *csv.Writer
+	header bool
+}
+
+func newCSVPrinter(comma rune) *csvPrinter {
+	w := csv.NewWriter(os.Stdout)
+	w.Comma = comma
+	return &csvPrinter{w: w}
+}
+
+func (p *csvPrinter) print(r *diagnose.Result) {
+	logChecks(r)
+	if !p.header {
+		p.write("namespace", "ksa", "gsa", "binding_ok", "roles", "status")
+		p.header = true
+	}
+	status := "pass"
+	if !r.Passed() {
+		status = "fail"
+	}
+	p.write(r.Namespace, r.KSA, r.GSA, strconv.FormatBool(r.HasAccess), strings.Join(r.Roles, ","), status)
+}
+
+func (p *csvPrinter) write(record ...string) {
+	if err := p.w.Write(record); err != nil {
+		log.Fatalf("Error writing the results: %v", err)
+	}
+}
+
+// finish flushes the rows written so far.
+func (p *csvPrinter) finish() {
+	p.w.Flush()
+	if err := p.w.Error(); err != nil {
+		log.Fatalf("Error writing the results: %v", err)
+	}
+}
+
+// resultName is the name of the Pod or Deployment the result's KSA was found through, or else the
+// KSA's.
+func resultName(r *diagnose.Result) string {
+	switch {
+	case r.Pod != "":
+		return r.Pod
+	case r.Deployment != "":
+		return r.Deployment
+	}
+	return r.KSA
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"github.com/Harwayne/workload-identity/pkg/diagnose"
+)
+
+const (
+	// fleetTokenDir is where fleet registered clusters conventionally mount the KSA's projected token
+	// and the credential configuration that exchanges it for the GSA's.
+	fleetTokenDir = "/var/run/secrets/tokens/gcp-ksa"
+	// metadataServer is the address of the GKE metadata server that serves WI credentials.
+	metadataServer = "http://169.254.169.254/computeMetadata/v1/instance/service-accounts/default/token"
+)
+
+// showPaths prints where a correctly configured workload in the cluster reads its credentials from.
+// On GKE they come from the metadata server, so no file is involved. Fleet registered clusters outside
+// of GCP have no metadata server, and instead mount a projected token whose audience is the WI pool.
+func showPaths(env *diagnose.Env, wiPool string) {
+	if env.MembershipAPIName == "" {
+		breadcrumb("Credential paths: the GKE metadata server serves the GSA's tokens at %s.", metadataServer)
+		breadcrumb("  GOOGLE_APPLICATION_CREDENTIALS should be unset, so the client libraries use the metadata server.")
+		return
+	}
+	breadcrumb("Credential paths for fleet Workload Identity:")
+	breadcrumb("  Projected KSA token, with audience %q: %s/token", wiPool, fleetTokenDir)
+	breadcrumb("  GOOGLE_APPLICATION_CREDENTIALS: %s/google-application-credentials.json", fleetTokenDir)
+}
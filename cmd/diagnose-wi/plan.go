@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+
+	"google.golang.org/api/cloudresourcemanager/v1"
+	"gopkg.in/yaml.v2"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/Harwayne/workload-identity/pkg/diagnose"
+)
+
+// desiredState is the --plan file, declaring the GSA each KSA should act as and the roles that GSA
+// should have.
+type desiredState struct {
+	Bindings []desiredBinding `yaml:"bindings"`
+}
+
+type desiredBinding struct {
+	Namespace string `yaml:"namespace"`
+	KSA       string `yaml:"ksa"`
+	GSA       string `yaml:"gsa"`
+	// Project is the project the roles are granted on. It defaults to --project.
+	Project string   `yaml:"project"`
+	Roles   []string `yaml:"roles"`
+}
+
+// readDesiredState reads and validates the --plan file.
+func readDesiredState(path string) (*desiredState, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var ds desiredState
+	if err := yaml.UnmarshalStrict(b, &ds); err != nil {
+		return nil, err
+	}
+	for i, db := range ds.Bindings {
+		if db.Namespace == "" {
+			ds.Bindings[i].Namespace = "default"
+		}
+		if err := diagnose.ValidateNamespace(ds.Bindings[i].Namespace); err != nil {
+			return nil, fmt.Errorf("binding %d: %w", i, err)
+		}
+		if err := diagnose.ValidateKSAName(db.KSA); err != nil {
+			return nil, fmt.Errorf("binding %d: %w", i, err)
+		}
+		if err := diagnose.ValidateGSAEmail(db.GSA); err != nil {
+			return nil, fmt.Errorf("binding %d: %w", i, err)
+		}
+	}
+	return &ds, nil
+}
+
+// runPlan compares the desired state in the file at path with the live state, and prints the
+// commands that reconcile them. It returns the process exit code, which is 2 if there is anything to
+// do, so scripts can tell drift from errors.
+func runPlan(ctx context.Context, env *diagnose.Env, path string) int {
+	ds, err := readDesiredState(path)
+	if err != nil {
+		log.Printf("Error reading --plan %q: %v", path, err)
+		return 1
+	}
+	wiPool, err := env.WIPool(ctx)
+	if err != nil {
+		log.Printf("Error getting WI Pool: %v", err)
+		return 1
+	}
+	if wiPool == "" {
+		log.Print("Workload Identity is not enabled on the cluster")
+		return 1
+	}
+
+	projectPolicies := map[string]*cloudresourcemanager.Policy{}
+	var commands []string
+	for _, db := range ds.Bindings {
+		sa, err := env.Kube.CoreV1().ServiceAccounts(db.Namespace).Get(ctx, db.KSA, v1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			commands = append(commands, diagnose.CreateKSACommand(db.Namespace, db.KSA))
+		} else if err != nil {
+			log.Printf("Error getting KSA %s/%s: %v", db.Namespace, db.KSA, err)
+			return 1
+		}
+		if sa == nil || diagnose.CleanGSAAnnotation(sa.Annotations[diagnose.WIGSAAnnotation]) != db.GSA {
+			commands = append(commands, diagnose.AnnotateKSACommand(db.Namespace, db.KSA, db.GSA))
+		}
+
+		gsaPolicy, err := diagnose.GetGSAIAMPolicy(ctx, env.GCPOptions, db.GSA, env.PolicyVersion)
+		if err != nil {
+			log.Print(err)
+			return 1
+		}
+		if _, _, ok := diagnose.KSAAccess(gsaPolicy, wiPool, db.Namespace, db.KSA); !ok {
+			commands = append(commands, diagnose.GrantKSAAccessCommand(wiPool, db.Namespace, db.KSA, db.GSA))
+		}
+
+		project := db.Project
+		if project == "" {
+			project = env.Project
+		}
+		if len(db.Roles) == 0 {
+			continue
+		}
+		projectPolicy, present := projectPolicies[project]
+		if !present {
+			projectPolicy, err = diagnose.GetProjectIAMPolicy(ctx, env.GCPOptions, project, env.PolicyVersion)
+			if err != nil {
+				log.Print(err)
+				return 1
+			}
+			projectPolicies[project] = projectPolicy
+		}
+		has := map[string]bool{}
+		for _, role := range diagnose.GSARolesInPolicy(projectPolicy, db.GSA) {
+			has[role] = true
+		}
+		for _, role := range db.Roles {
+			if !has[role] {
+				commands = append(commands, diagnose.GrantProjectRoleCommand(project, role, db.GSA))
+			}
+		}
+	}
+
+	if len(commands) == 0 {
+		fmt.Println("The live state matches the plan, there is nothing to do.")
+		return 0
+	}
+	for _, c := range commands {
+		fmt.Println(c)
+	}
+	return 2
+}
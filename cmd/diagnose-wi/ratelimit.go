@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+	"google.golang.org/api/option"
+	htransport "google.golang.org/api/transport/http"
+)
+
+const (
+	// maxRetries is how many times a request the API rejected for quota is retried.
+	maxRetries = 4
+	// initialBackoff is the wait before the first retry of a response without Retry-After. It doubles
+	// with each retry.
+	initialBackoff = time.Second
+	// cloudPlatformScope covers every API the tool calls.
+	cloudPlatformScope = "https://www.googleapis.com/auth/cloud-platform"
+)
+
+var (
+	limiterOnce sync.Once
+	limiter     *rate.Limiter
+)
+
+// gcpLimiter returns the token bucket shared by every GCP API client, so that many KSAs diagnosed in
+// an --audit together stay within --qps.
+func gcpLimiter() *rate.Limiter {
+	limiterOnce.Do(func() {
+		burst := int(*qpsFlag)
+		if burst < 1 {
+			burst = 1
+		}
+		limiter = rate.NewLimiter(rate.Limit(*qpsFlag), burst)
+	})
+	return limiter
+}
+
+// withRateLimit returns the options with an HTTP client that is authenticated by them and that limits
+// and retries its requests. Without --qps, or if the client can't be created, the options are
+// returned as they are.
+func withRateLimit(options []option.ClientOption) []option.ClientOption {
+	if *qpsFlag <= 0 {
+		return options
+	}
+	base := &rateLimitedTransport{base: http.DefaultTransport, limiter: gcpLimiter()}
+	t, err := htransport.NewTransport(context.Background(), base, append(options, option.WithScopes(cloudPlatformScope))...)
+	if err != nil {
+		log.Printf("Not limiting GCP API requests to --qps, creating the HTTP client failed: %v", err)
+		return options
+	}
+	return append(options, option.WithHTTPClient(&http.Client{Transport: t}))
+}
+
+// rateLimitedTransport waits for the limiter before each request, and retries requests rejected with
+// 429 Too Many Requests or 503 Service Unavailable, after the response's Retry-After if it has one, or
+// else an exponential backoff.
+type rateLimitedTransport struct {
+	base    http.RoundTripper
+	limiter *rate.Limiter
+}
+
+func (t *rateLimitedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	backoff := initialBackoff
+	for attempt := 0; ; attempt++ {
+		if err := t.limiter.Wait(req.Context()); err != nil {
+			return nil, err
+		}
+		resp, err := t.base.RoundTrip(req)
+		if err != nil || attempt == maxRetries || (resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode != http.StatusServiceUnavailable) {
+			return resp, err
+		}
+		if req.Body != nil {
+			if req.GetBody == nil {
+				return resp, nil
+			}
+			body, err := req.GetBody()
+			if err != nil {
+				return resp, nil
+			}
+			req = req.Clone(req.Context())
+			req.Body = body
+		}
+		wait, ok := retryAfter(resp.Header.Get("Retry-After"))
+		if !ok {
+			wait = backoff
+			backoff *= 2
+		}
+		resp.Body.Close()
+		select {
+		case <-time.After(wait):
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+	}
+}
+
+// retryAfter parses a Retry-After header, which is either a number of seconds or an HTTP date.
+func retryAfter(header string) (time.Duration, bool) {
+	if header == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(header); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if at, err := http.ParseTime(header); err == nil {
+		return time.Until(at), true
+	}
+	return 0, false
+}
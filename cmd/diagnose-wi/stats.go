@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"time"
+
+	"github.com/Harwayne/workload-identity/pkg/diagnose"
+)
+
+// statsRecord is the outcome of a single run, as appended to --stats-file. It deliberately contains
+// no names of KSAs, GSAs, namespaces or projects.
+type statsRecord struct {
+	Time   time.Time `json:"time"`
+	KSAs   int       `json:"ksas"`
+	Failed int       `json:"failed"`
+	Warned int       `json:"warned"`
+	// Checks counts the KSAs each check failed, warned or errored on, keyed by check name and then
+	// status.
+	Checks map[string]map[diagnose.Status]int `json:"checks,omitempty"`
+}
+
+// appendStats appends a JSON line recording the run's outcome to the file at path, creating it if
+// needed. Nothing is sent anywhere.
+func appendStats(path string, results []*diagnose.Result) error {
+	rec := statsRecord{Time: time.Now().UTC(), KSAs: len(results)}
+	for _, r := range results {
+		warned := false
+		for _, c := range r.Checks {
+			switch c.Status {
+			case diagnose.StatusWarn:
+				warned = true
+			case diagnose.StatusFail, diagnose.StatusError:
+			default:
+				continue
+			}
+			if rec.Checks == nil {
+				rec.Checks = map[string]map[diagnose.Status]int{}
+			}
+			if rec.Checks[c.Name] == nil {
+				rec.Checks[c.Name] = map[diagnose.Status]int{}
+			}
+			rec.Checks[c.Name][c.Status]++
+		}
+		if !r.Passed() {
+			rec.Failed++
+		} else if warned {
+			rec.Warned++
+		}
+	}
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,21 @@
+package main
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/Harwayne/workload-identity/pkg/admission"
+	"github.com/Harwayne/workload-identity/pkg/diagnose"
+)
+
+// serveWebhook serves the validating admission webhook for ServiceAccounts on the address, with TLS,
+// until it fails.
+func serveWebhook(addr, certFile, keyFile string, env *diagnose.Env, warnOnly, failOpen bool) error {
+	mux := http.NewServeMux()
+	mux.Handle("/validate", &admission.Handler{Env: env, Checks: admission.Checks(), WarnOnly: warnOnly, FailOpen: failOpen})
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	log.Printf("Serving the admission webhook on %s", addr)
+	return http.ListenAndServeTLS(addr, certFile, keyFile, mux)
+}
@@ -0,0 +1,132 @@
+// Package admission serves the diagnosis as a Kubernetes validating admission webhook, so that a
+// ServiceAccount can't be created or updated to link to a GSA that doesn't grant it access.
+package admission
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/Harwayne/workload-identity/pkg/diagnose"
+)
+
+// checkNames are the checks run on admission. They only need the KSA and its GSA, not the KSA's
+// workloads or the project they use.
+var checkNames = map[string]bool{
+	"ksa-annotation": true,
+	"wi-pool":        true,
+	"gsa-binding":    true,
+}
+
+// Checks returns the built-in checks that are run on admission.
+func Checks() []diagnose.Check {
+	var checks []diagnose.Check
+	for _, c := range diagnose.BuiltinChecks() {
+		if checkNames[c.Name()] {
+			checks = append(checks, c)
+		}
+	}
+	return checks
+}
+
+// Handler is the http.Handler of the webhook. It speaks admission.k8s.io/v1 AdmissionReviews.
+type Handler struct {
+	Env    *diagnose.Env
+	Checks []diagnose.Check
+	// WarnOnly admits ServiceAccounts that fail the checks, returning the failures as warnings.
+	WarnOnly bool
+	// FailOpen admits ServiceAccounts whose checks can't complete, e.g. because a GCP API is
+	// unavailable or the webhook's credentials were rejected, returning the errors as warnings.
+	// Otherwise they are rejected, as they can't be shown to be correct.
+	FailOpen bool
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("reading the request: %v", err), http.StatusBadRequest)
+		return
+	}
+	review := &admissionv1.AdmissionReview{}
+	if err := json.Unmarshal(body, review); err != nil || review.Request == nil {
+		http.Error(w, fmt.Sprintf("decoding the AdmissionReview: %v", err), http.StatusBadRequest)
+		return
+	}
+	review.Response = h.review(r, review.Request)
+	review.Response.UID = review.Request.UID
+	review.Request = nil
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(review); err != nil {
+		http.Error(w, fmt.Sprintf("encoding the AdmissionReview: %v", err), http.StatusInternalServerError)
+	}
+}
+
+// review decides whether to admit the request. Checks that can't complete reject it, unless the
+// Handler fails open.
+func (h *Handler) review(r *http.Request, req *admissionv1.AdmissionRequest) *admissionv1.AdmissionResponse {
+	allow := &admissionv1.AdmissionResponse{Allowed: true}
+	if req.Kind.Kind != "ServiceAccount" || req.Operation == admissionv1.Delete {
+		return allow
+	}
+	sa := &corev1.ServiceAccount{}
+	if err := json.Unmarshal(req.Object.Raw, sa); err != nil {
+		return &admissionv1.AdmissionResponse{Result: &v1.Status{
+			Code:    http.StatusBadRequest,
+			Message: fmt.Sprintf("decoding the ServiceAccount: %v", err),
+		}}
+	}
+	if _, present := sa.Annotations[diagnose.WIGSAAnnotation]; !present {
+		return allow
+	}
+	if sa.Name == "" {
+		allow.Warnings = []string{"the ServiceAccount's WI annotation can't be checked until its name is generated"}
+		return allow
+	}
+	ns := sa.Namespace
+	if ns == "" {
+		ns = req.Namespace
+	}
+
+	in := diagnose.NewInput(h.Env, diagnose.Target{Namespace: ns, KSA: sa.Name})
+	in.ServiceAccount = sa
+	result := diagnose.Run(r.Context(), in, h.Checks)
+
+	var failures []string
+	for _, c := range result.Checks {
+		switch c.Status {
+		case diagnose.StatusWarn:
+			allow.Warnings = append(allow.Warnings, c.Message)
+		case diagnose.StatusError:
+			msg := fmt.Sprintf("check %q could not complete: %s", c.Name, c.Message)
+			if h.FailOpen {
+				allow.Warnings = append(allow.Warnings, msg)
+			} else {
+				failures = append(failures, msg)
+			}
+		case diagnose.StatusFail:
+			failures = append(failures, c.Message)
+		}
+	}
+	if len(failures) == 0 {
+		return allow
+	}
+	if h.WarnOnly {
+		allow.Warnings = append(allow.Warnings, failures...)
+		return allow
+	}
+	return &admissionv1.AdmissionResponse{
+		Warnings: allow.Warnings,
+		Result: &v1.Status{
+			Code:    http.StatusForbidden,
+			Reason:  v1.StatusReasonForbidden,
+			Message: strings.Join(failures, "; "),
+		},
+	}
+}
@@ -0,0 +1,57 @@
+package admission
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"google.golang.org/api/option"
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+
+	"github.com/Harwayne/workload-identity/pkg/diagnose"
+)
+
+// TestReviewAPIError checks that a ServiceAccount whose binding can't be read, here because the IAM
+// API rejects the webhook's credentials, is rejected unless the Handler fails open.
+func TestReviewAPIError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnauthorized)
+		io.WriteString(w, `{"error": {"code": 401, "message": "Request had invalid authentication credentials."}}`)
+	}))
+	defer server.Close()
+	env := &diagnose.Env{
+		AssumePool: "my-project.svc.id.goog",
+		GCPOptions: []option.ClientOption{diagnose.WithAPIEndpoint(diagnose.IAMAPI, server.URL+"/"), option.WithoutAuthentication()},
+	}
+	sa, err := json.Marshal(&corev1.ServiceAccount{ObjectMeta: v1.ObjectMeta{
+		Name:        "agent",
+		Namespace:   "my-ns",
+		Annotations: map[string]string{diagnose.WIGSAAnnotation: "app-sa@my-project.iam.gserviceaccount.com"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := &admissionv1.AdmissionRequest{
+		Kind:      v1.GroupVersionKind{Version: "v1", Kind: "ServiceAccount"},
+		Namespace: "my-ns",
+		Operation: admissionv1.Create,
+		Object:    runtime.RawExtension{Raw: sa},
+	}
+
+	for _, failOpen := range []bool{false, true} {
+		h := &Handler{Env: env, Checks: Checks(), FailOpen: failOpen}
+		resp := h.review(httptest.NewRequest(http.MethodPost, "/validate", nil), req)
+		if resp.Allowed != failOpen {
+			t.Errorf("FailOpen %v: Allowed = %v, want %v, result %+v", failOpen, resp.Allowed, failOpen, resp.Result)
+		}
+		if failOpen && len(resp.Warnings) == 0 {
+			t.Errorf("FailOpen %v: no warnings, want the check's error", failOpen)
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package diagnose
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// AdditionalGSA is the outcome of checking one of the Env's AdditionalGSAs.
+type AdditionalGSA struct {
+	GSA string `json:"gsa"`
+	// Status is StatusFail if the GSA does not let the KSA act as it, StatusWarn if it has no roles on
+	// its project, and StatusPass otherwise.
+	Status       Status   `json:"status"`
+	HasAccess    bool     `json:"hasAccess"`
+	AccessRole   string   `json:"accessRole,omitempty"`
+	AccessMember string   `json:"accessMember,omitempty"`
+	Project      string   `json:"project"`
+	Roles        []string `json:"roles"`
+}
+
+func (g AdditionalGSA) String() string {
+	switch {
+	case !g.HasAccess && g.AccessRole != "":
+		return fmt.Sprintf("GSA %q only grants access to the KSA with the broad role %q, which is not accepted", g.GSA, g.AccessRole)
+	case !g.HasAccess:
+		return fmt.Sprintf("GSA %q does not grant access to the KSA", g.GSA)
+	case len(g.Roles) == 0:
+		return fmt.Sprintf("GSA %q grants access to the KSA with role %q, but has no roles on project %q", g.GSA, g.AccessRole, g.Project)
+	}
+	return fmt.Sprintf("GSA %q grants access to the KSA with role %q, and its roles on project %q are %v", g.GSA, g.AccessRole, g.Project, g.Roles)
+}
+
+var additionalGSAsCheck = &check{
+	name:        "additional-gsas",
+	description: "Each of the additional GSAs the workload uses through explicit credential configuration lets the KSA act as it, and has roles on its project.",
+	severity:    StatusFail,
+	run: func(ctx context.Context, in *Input) (CheckResult, error) {
+		switch {
+		case len(in.AdditionalGSAs) == 0:
+			return Skip(SkipNotEnabled), nil
+		case in.WIPool == "":
+			return Skip("the cluster's WI pool is unknown"), nil
+		}
+		in.AdditionalGSAResults = nil
+		for _, gsa := range in.AdditionalGSAs {
+			g, err := checkAdditionalGSA(ctx, in, gsa)
+			if err != nil {
+				return CheckResult{}, fmt.Errorf("checking additional GSA %q: %w", gsa, err)
+			}
+			in.AdditionalGSAResults = append(in.AdditionalGSAResults, g)
+		}
+
+		status := StatusPass
+		var parts []string
+		for _, g := range in.AdditionalGSAResults {
+			parts = append(parts, g.String())
+			if g.Status == StatusFail || (g.Status == StatusWarn && status == StatusPass) {
+				status = g.Status
+			}
+		}
+		cr := CheckResult{Status: status, Message: fmt.Sprintf("%s, which also uses additional GSAs: %s", in.Target, strings.Join(parts, "; "))}
+		for _, g := range in.AdditionalGSAResults {
+			if !g.HasAccess {
+				cr = cr.WithRemediation(g.GSA, GrantKSAAccessCommand(in.WIPool, in.Namespace, in.KSA, g.GSA))
+			}
+		}
+		return cr, nil
+	},
+}
+
+// checkAdditionalGSA checks the KSA's access to the GSA, and the GSA's roles on the project its
+// roles are read from, which follows UseGSAProject as for the KSA's own GSA.
+func checkAdditionalGSA(ctx context.Context, in *Input, gsa string) (AdditionalGSA, error) {
+	g := AdditionalGSA{GSA: gsa, Project: in.Project}
+	if in.UseGSAProject {
+		if project, ok := GSAProject(gsa); ok {
+			g.Project = project
+		}
+	}
+	gsaPolicy, err := GetGSAIAMPolicy(ctx, in.GCPOptions, gsa, in.PolicyVersion)
+	if err != nil {
+		return AdditionalGSA{}, err
+	}
+	g.AccessRole, g.AccessMember, g.HasAccess = KSAAccess(gsaPolicy, in.WIPool, in.Namespace, in.KSA)
+	if in.NoBroadRoles && IsPrimitiveRole(g.AccessRole) {
+		g.AccessRole, g.AccessMember, g.HasAccess = ksaAccess(gsaPolicy, narrowKSARoles, newKSAMatcher(in.WIPool, in.Namespace, in.KSA).matches)
+	}
+
+	var roles []string
+	if g.Project == in.RolesProject() {
+		policy, err := in.ProjectPolicy(ctx)
+		if err != nil {
+			return AdditionalGSA{}, err
+		}
+		roles = GSARolesInPolicy(policy, gsa)
+	} else {
+		policy, err := GetProjectIAMPolicy(ctx, in.GCPOptions, g.Project, in.PolicyVersion)
+		if err != nil {
+			return AdditionalGSA{}, err
+		}
+		roles = GSARolesInPolicy(policy, gsa)
+	}
+	g.Roles = in.filterRoles(roles)
+
+	switch {
+	case !g.HasAccess:
+		g.Status = StatusFail
+	case len(roles) == 0:
+		g.Status = StatusWarn
+	default:
+		g.Status = StatusPass
+	}
+	return g, nil
+}
@@ -0,0 +1,118 @@
+package diagnose
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"google.golang.org/api/googleapi"
+)
+
+// The forms in which GCP APIs name the missing permission in a PERMISSION_DENIED message.
+var deniedPermissionRegexps = []*regexp.Regexp{
+	regexp.MustCompile(`Permission '([^']+)' denied on resource '([^']+)'`),
+	regexp.MustCompile(`Required '([^']+)' permission for '([^']+)'`),
+	regexp.MustCompile(`Permission '([^']+)' denied on '([^']+)'`),
+}
+
+// ExplainError returns the error's message with any GCP API error in it decoded: its status, the
+// server's message, the missing permission and the resource it is needed on, and the help links the
+// API sent, rather than the raw JSON. Other errors are returned as they are.
+func ExplainError(err error) string {
+	var apiErr *googleapi.Error
+	if !errors.As(err, &apiErr) {
+		return err.Error()
+	}
+	// Keep the context the error was wrapped in, e.g. which call failed.
+	prefix := strings.TrimSuffix(err.Error(), apiErr.Error())
+	if prefix == err.Error() {
+		prefix = ""
+	}
+	return prefix + explainAPIError(apiErr)
+}
+
+func explainAPIError(apiErr *googleapi.Error) string {
+	var parts []string
+	status := apiErrorStatus(apiErr)
+	if status != "" {
+		parts = append(parts, fmt.Sprintf("%s (HTTP %d)", status, apiErr.Code))
+	} else {
+		parts = append(parts, fmt.Sprintf("HTTP %d", apiErr.Code))
+	}
+	if apiErr.Message != "" {
+		parts = append(parts, strings.TrimSuffix(apiErr.Message, "."))
+	}
+
+	var reason, permission, resource string
+	var links []string
+	for _, d := range apiErr.Details {
+		m, ok := d.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		switch m["@type"] {
+		case "type.googleapis.com/google.rpc.ErrorInfo":
+			reason, _ = m["reason"].(string)
+			if md, ok := m["metadata"].(map[string]interface{}); ok {
+				permission, _ = md["permission"].(string)
+				resource, _ = md["resource"].(string)
+			}
+		case "type.googleapis.com/google.rpc.Help":
+			ls, _ := m["links"].([]interface{})
+			for _, l := range ls {
+				lm, ok := l.(map[string]interface{})
+				if !ok {
+					continue
+				}
+				url, _ := lm["url"].(string)
+				if url == "" {
+					continue
+				}
+				if desc, _ := lm["description"].(string); desc != "" {
+					url = desc + ": " + url
+				}
+				links = append(links, url)
+			}
+		}
+	}
+	if reason == "" && len(apiErr.Errors) > 0 {
+		reason = apiErr.Errors[0].Reason
+	}
+	if permission == "" {
+		for _, re := range deniedPermissionRegexps {
+			if m := re.FindStringSubmatch(apiErr.Message); m != nil {
+				permission, resource = m[1], m[2]
+				break
+			}
+		}
+	}
+	switch {
+	case permission != "" && resource != "":
+		parts = append(parts, fmt.Sprintf("You need permission %s on resource %s", permission, resource))
+	case permission != "":
+		parts = append(parts, fmt.Sprintf("You need permission %s", permission))
+	}
+	if reason != "" {
+		parts = append(parts, "Reason: "+reason)
+	}
+	if len(links) > 0 {
+		parts = append(parts, "See "+strings.Join(links, ", "))
+	}
+	return strings.Join(parts, ". ")
+}
+
+// apiErrorStatus returns the canonical status, e.g. PERMISSION_DENIED, from the error's JSON body,
+// which googleapi.Error doesn't keep.
+func apiErrorStatus(apiErr *googleapi.Error) string {
+	var body struct {
+		Error struct {
+			Status string `json:"status"`
+		} `json:"error"`
+	}
+	if json.Unmarshal([]byte(apiErr.Body), &body) != nil {
+		return ""
+	}
+	return body.Error.Status
+}
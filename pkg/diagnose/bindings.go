@@ -0,0 +1,258 @@
+package diagnose
+
+import (
+	"fmt"
+	"strings"
+
+	"google.golang.org/api/iam/v1"
+)
+
+var (
+	// ksaRoles are the roles on a GSA that let a KSA act as it, ranked from the narrowest.
+	ksaRoles = map[string]int{
+		"roles/iam.workloadIdentityUser":       0,
+		"roles/iam.serviceAccountTokenCreator": 1,
+		"roles/editor":                         2,
+		"roles/owner":                          3,
+	}
+	// narrowKSARoles are the ksaRoles other than the basic roles, which -no-broad-roles does not
+	// accept.
+	narrowKSARoles = map[string]int{
+		"roles/iam.workloadIdentityUser":       0,
+		"roles/iam.serviceAccountTokenCreator": 1,
+	}
+	// idTokenRoles are the roles on a GSA that let a KSA get OIDC ID tokens for it, ranked from the
+	// narrowest. serviceAccountOpenIdTokenCreator only grants ID tokens, not access tokens.
+	idTokenRoles = map[string]int{
+		"roles/iam.workloadIdentityUser":             0,
+		"roles/iam.serviceAccountOpenIdTokenCreator": 1,
+		"roles/iam.serviceAccountTokenCreator":       2,
+		"roles/editor":                               3,
+		"roles/owner":                                4,
+	}
+)
+
+// IsPrimitiveRole reports whether the role is one of the basic roles, editor and owner, that grant
+// far more than acting as the GSA.
+func IsPrimitiveRole(role string) bool {
+	return role == "roles/editor" || role == "roles/owner"
+}
+
+// KSAAccess returns the role in the GSA's IAM policy that lets the KSA act as the GSA, and the member
+// it is granted to. It returns false if the KSA is not granted any such role. The KSA is matched by
+// any of these members, where NUM is the pool's project number:
+//
+//	serviceAccount:POOL[NS/KSA]
+//	principal://iam.googleapis.com/projects/NUM/locations/global/workloadIdentityPools/POOL/subject/ns/NS/sa/KSA
+//	principalSet://iam.googleapis.com/projects/NUM/locations/global/workloadIdentityPools/POOL/namespace/NS
+//
+// The last grants access to every KSA in the namespace, as some operators do. If the KSA is granted
+// several of the roles, the narrowest is returned, preferring those granted unconditionally.
+func KSAAccess(gsaPolicy *iam.Policy, wiPool, ns, ksaName string) (role, member string, ok bool) {
+	return ksaAccess(gsaPolicy, ksaRoles, newKSAMatcher(wiPool, ns, ksaName).matches)
+}
+
+// KSAIDTokenAccess is like KSAAccess, but returns the role that lets the KSA get OIDC ID tokens for
+// the GSA, i.e. grants it iam.serviceAccounts.getOpenIdToken.
+func KSAIDTokenAccess(gsaPolicy *iam.Policy, wiPool, ns, ksaName string) (role, member string, ok bool) {
+	return ksaAccess(gsaPolicy, idTokenRoles, newKSAMatcher(wiPool, ns, ksaName).matches)
+}
+
+// ksaAccess returns the narrowest of the ranked roles that the GSA's policy grants a member matching
+// the KSA, preferring any granted unconditionally over narrower ones granted only under a condition.
+// Policies can have hundreds of bindings and thousands of members, so matches should compare with
+// forms built once, rather than for every member.
+func ksaAccess(gsaPolicy *iam.Policy, roles map[string]int, matches func(member string) bool) (role, member string, ok bool) {
+	conditional := false
+	for _, binding := range gsaPolicy.Bindings {
+		rank, present := roles[binding.Role]
+		if !present {
+			continue
+		}
+		bindingConditional := binding.Condition != nil && binding.Condition.Expression != ""
+		if ok && (bindingConditional && !conditional || bindingConditional == conditional && rank >= roles[role]) {
+			continue
+		}
+		for _, bm := range binding.Members {
+			if matches(bm) {
+				role, member, ok, conditional = binding.Role, bm, true, bindingConditional
+				break
+			}
+		}
+	}
+	return role, member, ok
+}
+
+// AccessCondition returns the condition of the bindings in the GSA's policy that grant the role to
+// the member, or nil if any of them grants it unconditionally. The tool cannot evaluate conditions, so
+// access granted only under one may be denied when the KSA asks for a token.
+func AccessCondition(gsaPolicy *iam.Policy, role, member string) *iam.Expr {
+	var condition *iam.Expr
+	for _, binding := range gsaPolicy.Bindings {
+		if binding.Role != role || !contains(binding.Members, member) {
+			continue
+		}
+		if binding.Condition == nil || binding.Condition.Expression == "" {
+			return nil
+		}
+		if condition == nil {
+			condition = binding.Condition
+		}
+	}
+	return condition
+}
+
+// describeCondition names the condition by its title, if it has one, and its expression.
+func describeCondition(c *iam.Expr) string {
+	if c.Title != "" {
+		return fmt.Sprintf("%q (%s)", c.Title, c.Expression)
+	}
+	return fmt.Sprintf("%q", c.Expression)
+}
+
+// ksaMatcher matches the IAM policy members that are one of the forms KSAAccess recognizes for a KSA.
+type ksaMatcher struct {
+	serviceAccount     string
+	principalSuffix    string
+	principalSetSuffix string
+}
+
+func newKSAMatcher(wiPool, ns, ksaName string) ksaMatcher {
+	poolPath := "/locations/global/workloadIdentityPools/" + wiPool + "/"
+	return ksaMatcher{
+		serviceAccount:     KSAIAMPolicyMember(wiPool, ns, ksaName),
+		principalSuffix:    poolPath + "subject/ns/" + ns + "/sa/" + ksaName,
+		principalSetSuffix: poolPath + "namespace/" + ns,
+	}
+}
+
+func (m ksaMatcher) matches(member string) bool {
+	switch {
+	case member == m.serviceAccount:
+		return true
+	case strings.HasPrefix(member, "principal://iam.googleapis.com/projects/"):
+		return strings.HasSuffix(member, m.principalSuffix)
+	case strings.HasPrefix(member, "principalSet://iam.googleapis.com/projects/"):
+		return strings.HasSuffix(member, m.principalSetSuffix)
+	}
+	return false
+}
+
+// KSAMembers returns the KSA members in the GSA's IAM policy that are granted one of the roles that
+// let them act as the GSA, in the order they appear.
+func KSAMembers(gsaPolicy *iam.Policy) []string {
+	seen := map[string]bool{}
+	var members []string
+	for _, binding := range gsaPolicy.Bindings {
+		if _, present := ksaRoles[binding.Role]; !present {
+			continue
+		}
+		for _, member := range binding.Members {
+			if _, _, _, ok := ParseKSAIAMPolicyMember(member); ok && !seen[member] {
+				seen[member] = true
+				members = append(members, member)
+			}
+		}
+	}
+	return members
+}
+
+// KSAInOtherPools returns the WI pools, other than wiPool, in which the GSA's policy lets a KSA with
+// the same namespace and name act as it. These are usually bindings made with the wrong project's
+// pool, e.g. the GSA's rather than the cluster's.
+func KSAInOtherPools(gsaPolicy *iam.Policy, wiPool, ns, ksaName string) []string {
+	var pools []string
+	for _, member := range KSAMembers(gsaPolicy) {
+		pool, mNS, mKSA, _ := ParseKSAIAMPolicyMember(member)
+		if pool != wiPool && mNS == ns && mKSA == ksaName && !contains(pools, pool) {
+			pools = append(pools, pool)
+		}
+	}
+	return pools
+}
+
+// CompareKSAMembers compares the KSA members that the GSA's policy lets act as it with the expected
+// ones, returning the expected members it is missing and the members it has but were not expected,
+// each in order.
+func CompareKSAMembers(gsaPolicy *iam.Policy, expected []string) (missing, surplus []string) {
+	members := KSAMembers(gsaPolicy)
+	for _, member := range expected {
+		if !contains(members, member) {
+			missing = append(missing, member)
+		}
+	}
+	for _, member := range members {
+		if !contains(expected, member) {
+			surplus = append(surplus, member)
+		}
+	}
+	return missing, surplus
+}
+
+// MemberPools returns the distinct WI pools of the KSA members that the GSA's policy lets act as it,
+// in the order they first appear.
+func MemberPools(gsaPolicy *iam.Policy) []string {
+	seen := map[string]bool{}
+	var pools []string
+	for _, member := range KSAMembers(gsaPolicy) {
+		if pool, _, _, _ := ParseKSAIAMPolicyMember(member); !seen[pool] {
+			seen[pool] = true
+			pools = append(pools, pool)
+		}
+	}
+	return pools
+}
+
+// BroadGrant is a binding on a GSA that lets far more identities than a single KSA act as the GSA.
+type BroadGrant struct {
+	Role   string
+	Member string
+	Reason string
+}
+
+func (bg BroadGrant) String() string {
+	return fmt.Sprintf("role %q is granted to %q, %s", bg.Role, bg.Member, bg.Reason)
+}
+
+// BroadGrants returns every binding in the GSA's IAM policy of a role that lets its member act as the
+// GSA, whose member covers far more identities than a single KSA.
+func BroadGrants(gsaPolicy *iam.Policy) []BroadGrant {
+	var broadGrants []BroadGrant
+	for _, binding := range gsaPolicy.Bindings {
+		if _, present := ksaRoles[binding.Role]; !present {
+			continue
+		}
+		for _, member := range binding.Members {
+			if reason, broad := broadMemberReason(member); broad {
+				broadGrants = append(broadGrants, BroadGrant{
+					Role:   binding.Role,
+					Member: member,
+					Reason: reason,
+				})
+			}
+		}
+	}
+	return broadGrants
+}
+
+// broadMemberReason reports whether the IAM policy member covers more than a single identity and,
+// if so, describes who it covers.
+func broadMemberReason(member string) (string, bool) {
+	switch {
+	case member == "allUsers":
+		return "which is anyone on the internet, authenticated or not", true
+	case member == "allAuthenticatedUsers":
+		return "which is every authenticated Google identity", true
+	case strings.HasPrefix(member, "projectOwner:"),
+		strings.HasPrefix(member, "projectEditor:"),
+		strings.HasPrefix(member, "projectViewer:"):
+		return "which is every principal holding that basic role on the project", true
+	case strings.HasPrefix(member, "domain:"):
+		return "which is every identity in the domain", true
+	case strings.HasPrefix(member, "principalSet://"):
+		return "which is a set of identities rather than a single KSA", true
+	case strings.HasPrefix(member, "serviceAccount:") && strings.Contains(member, "*"):
+		return "which uses a wildcard rather than naming a single KSA", true
+	}
+	return "", false
+}
@@ -0,0 +1,106 @@
+package diagnose
+
+import (
+	"fmt"
+	"testing"
+
+	"google.golang.org/api/cloudresourcemanager/v1"
+	"google.golang.org/api/iam/v1"
+)
+
+func TestKSAAccessMemberForms(t *testing.T) {
+	const (
+		pool    = "my-project.svc.id.goog"
+		poolURL = "//iam.googleapis.com/projects/123/locations/global/workloadIdentityPools/" + pool
+	)
+	for _, tc := range []struct {
+		member string
+		want   bool
+	}{
+		// The forms KSAAccess recognizes.
+		{member: "serviceAccount:" + pool + "[my-ns/agent]", want: true},
+		{member: "principal:" + poolURL + "/subject/ns/my-ns/sa/agent", want: true},
+		{member: "principalSet:" + poolURL + "/namespace/my-ns", want: true},
+		// Other KSAs, namespaces and pools.
+		{member: "serviceAccount:" + pool + "[my-ns/other]"},
+		{member: "serviceAccount:" + pool + "[other-ns/agent]"},
+		{member: "serviceAccount:other.svc.id.goog[my-ns/agent]"},
+		{member: "principal:" + poolURL + "/subject/ns/my-ns/sa/other"},
+		{member: "principal:" + poolURL + "/subject/ns/other-ns/sa/agent"},
+		{member: "principalSet:" + poolURL + "/namespace/other-ns"},
+		{member: "principalSet://iam.googleapis.com/projects/123/locations/global/workloadIdentityPools/other.svc.id.goog/namespace/my-ns"},
+		// Forms it does not recognize, as the KSA's membership can't be told from the member alone.
+		{member: "principalSet:" + poolURL + "/*"},
+		{member: "principalSet:" + poolURL + "/kubernetes.cluster/https://container.googleapis.com/v1/projects/my-project/locations/us-central1/clusters/my-cluster"},
+		{member: "serviceAccount:" + pool + "[my-ns/*]"},
+		{member: "serviceAccount:app-sa@my-project.iam.gserviceaccount.com"},
+	} {
+		policy := &iam.Policy{Bindings: []*iam.Binding{{Role: "roles/iam.workloadIdentityUser", Members: []string{tc.member}}}}
+		if _, _, got := KSAAccess(policy, pool, "my-ns", "agent"); got != tc.want {
+			t.Errorf("KSAAccess with member %q = %v, want %v", tc.member, got, tc.want)
+		}
+	}
+}
+
+// Sizes of the policies of the benchmarks, like those of GSAs and projects shared across an org.
+const (
+	benchmarkBindings = 200
+	benchmarkMembers  = 50
+)
+
+// largeGSAPolicy returns a GSA policy of benchmarkBindings bindings of benchmarkMembers KSA members
+// each, in all three forms, with the KSA being looked up only in the last binding of
+// roles/iam.workloadIdentityUser, so every binding is searched.
+func largeGSAPolicy() *iam.Policy {
+	policy := &iam.Policy{}
+	for b := 0; b < benchmarkBindings; b++ {
+		binding := &iam.Binding{Role: "roles/iam.workloadIdentityUser"}
+		if b%2 == 1 {
+			binding.Role = fmt.Sprintf("roles/custom.role%d", b)
+		}
+		for m := 0; m < benchmarkMembers; m++ {
+			ns, ksa := fmt.Sprintf("ns-%d", b), fmt.Sprintf("ksa-%d", m)
+			switch m % 3 {
+			case 0:
+				binding.Members = append(binding.Members, KSAIAMPolicyMember("my-project.svc.id.goog", ns, ksa))
+			case 1:
+				binding.Members = append(binding.Members, fmt.Sprintf(
+					"principal://iam.googleapis.com/projects/123/locations/global/workloadIdentityPools/my-project.svc.id.goog/subject/ns/%s/sa/%s", ns, ksa))
+			case 2:
+				binding.Members = append(binding.Members, fmt.Sprintf(
+					"principalSet://iam.googleapis.com/projects/123/locations/global/workloadIdentityPools/other.svc.id.goog/namespace/%s", ns))
+			}
+		}
+		policy.Bindings = append(policy.Bindings, binding)
+	}
+	last := policy.Bindings[benchmarkBindings-2]
+	last.Members = append(last.Members, KSAIAMPolicyMember("my-project.svc.id.goog", "my-ns", "agent"))
+	return policy
+}
+
+func BenchmarkKSAAccess(b *testing.B) {
+	policy := largeGSAPolicy()
+	if _, _, ok := KSAAccess(policy, "my-project.svc.id.goog", "my-ns", "agent"); !ok {
+		b.Fatal("KSAAccess = false, want the KSA's binding found")
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		KSAAccess(policy, "my-project.svc.id.goog", "my-ns", "agent")
+	}
+}
+
+func BenchmarkGSARolesInPolicy(b *testing.B) {
+	policy := &cloudresourcemanager.Policy{}
+	for r := 0; r < benchmarkBindings; r++ {
+		binding := &cloudresourcemanager.Binding{Role: fmt.Sprintf("roles/custom.role%d", r)}
+		for m := 0; m < benchmarkMembers; m++ {
+			binding.Members = append(binding.Members, GSAIAMPolicyMember(fmt.Sprintf("gsa-%d@my-project.iam.gserviceaccount.com", m)))
+		}
+		policy.Bindings = append(policy.Bindings, binding)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		GSARolesInPolicy(policy, "app-sa@my-project.iam.gserviceaccount.com")
+	}
+}
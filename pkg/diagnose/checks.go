@@ -0,0 +1,946 @@
+package diagnose
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// check is a Check implemented by a function.
+type check struct {
+	name        string
+	description string
+	severity    Status
+	run         func(ctx context.Context, in *Input) (CheckResult, error)
+}
+
+func (c *check) Name() string {
+	return c.name
+}
+
+func (c *check) Description() string {
+	return c.description
+}
+
+func (c *check) Severity() Status {
+	return c.severity
+}
+
+func (c *check) Run(ctx context.Context, in *Input) (CheckResult, error) {
+	return c.run(ctx, in)
+}
+
+// BuiltinChecks returns the checks that make up the standard diagnosis, in the order they run.
+func BuiltinChecks() []Check {
+	return []Check{
+		ownerChainCheck,
+		nodeIdentityCheck,
+		nodeScopesCheck,
+		schedulablePoolsCheck,
+		hostNetworkCheck,
+		meshSidecarCheck,
+		ksaAnnotationCheck,
+		expectedGSACheck,
+		gsaNamePatternCheck,
+		gsaDetailsCheck,
+		misplacedAnnotationCheck,
+		conflictingAnnotationsCheck,
+		ksaAutomountCheck,
+		wiPoolCheck,
+		wiPoolProjectCheck,
+		wifProviderCheck,
+		gkeVersionCheck,
+		oidcIssuerCheck,
+		ksaMemberCheck,
+		gsaBindingCheck,
+		idTokenBindingCheck,
+		configConnectorCheck,
+		troubleshooterCheck,
+		probeTokenCheck,
+		impersonationCheck,
+		projectReferencesCheck,
+		broadGrantsCheck,
+		gsaKeysCheck,
+		staleBindingsCheck,
+		gsaProjectCheck,
+		gsaProjectStateCheck,
+		rolesProjectCheck,
+		projectRolesCheck,
+		additionalGSAsCheck,
+		leastPrivilegeCheck,
+		ksaProjectRolesCheck,
+		ksaTokenRBACCheck,
+		policyEtagsCheck,
+	}
+}
+
+// CheckInfo describes a check, e.g. for a UI or documentation listing the available checks.
+type CheckInfo struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	// Severity is the worst Status the check reports for a problem it finds, rather than an error.
+	// It is empty for checks that don't say.
+	Severity Status `json:"severity,omitempty"`
+	// Live is whether the check needs access to the cluster or GCP. Every builtin check does, the
+	// CLI's offline mode runs its own.
+	Live bool `json:"live"`
+}
+
+// SeverityCheck is implemented by checks that declare the worst Status they report.
+type SeverityCheck interface {
+	Check
+	Severity() Status
+}
+
+// DescribeChecks returns the CheckInfo of each of the checks, in order. Pass BuiltinChecks() to list
+// the standard diagnosis.
+func DescribeChecks(checks []Check) []CheckInfo {
+	infos := make([]CheckInfo, 0, len(checks))
+	for _, c := range checks {
+		info := CheckInfo{Name: c.Name(), Description: c.Description(), Live: true}
+		if sc, ok := c.(SeverityCheck); ok {
+			info.Severity = sc.Severity()
+		}
+		infos = append(infos, info)
+	}
+	return infos
+}
+
+// FilterChecks returns the checks whose names are not in disabled. It is an error to disable a check
+// that isn't in checks.
+func FilterChecks(checks []Check, disabled []string) ([]Check, error) {
+	skip := make(map[string]bool, len(disabled))
+	for _, name := range disabled {
+		skip[name] = true
+	}
+	var filtered []Check
+	for _, c := range checks {
+		if skip[c.Name()] {
+			delete(skip, c.Name())
+			continue
+		}
+		filtered = append(filtered, c)
+	}
+	for name := range skip {
+		return nil, fmt.Errorf("unknown check %q", name)
+	}
+	return filtered, nil
+}
+
+var ksaAnnotationCheck = &check{
+	name:        "ksa-annotation",
+	description: "The KSA has the WI annotation, naming a valid GSA email.",
+	severity:    StatusFail,
+	run: func(ctx context.Context, in *Input) (CheckResult, error) {
+		// The KSA may have been read from a Pod or Deployment, rather than given by the user.
+		if err := ValidateKSAName(in.KSA); err != nil {
+			return Fail("%s: %v", in.Target, err), nil
+		}
+		sa, err := in.serviceAccount(ctx)
+		if apierrors.IsNotFound(err) {
+			cr := Fail("%s, which does not exist in namespace %q", in.Target, in.Namespace).
+				WithRemediation(in.ExpectGSA, CreateKSACommand(in.Namespace, in.KSA))
+			if in.ExpectGSA != "" {
+				cr = cr.WithRemediation(in.ExpectGSA, AnnotateKSACommand(in.Namespace, in.KSA, in.ExpectGSA))
+			}
+			return cr, nil
+		} else if err != nil {
+			return CheckResult{}, fmt.Errorf("getting the KSA: %w", err)
+		}
+		raw, present := sa.Annotations[WIGSAAnnotation]
+		if !present && in.NodeGSA != "" {
+			return Skip("the KSA's workloads run as the node's GSA, so the WI annotation is not needed"), nil
+		} else if !present {
+			cr := Fail("%s, which does not have the WI annotation, %q", in.Target, WIGSAAnnotation)
+			if in.ExpectGSA != "" {
+				cr = cr.WithRemediation(in.ExpectGSA, AnnotateKSACommand(in.Namespace, in.KSA, in.ExpectGSA))
+			}
+			return cr, nil
+		}
+		gsa := CleanGSAAnnotation(raw)
+		if err := ValidateGSAEmail(gsa); err != nil {
+			cr := Fail("%s, whose WI annotation is invalid: %v", in.Target, err)
+			if IsGSAUniqueID(gsa) {
+				// The IAM API gets GSAs by unique ID too, so the email can often be suggested. Failing
+				// to is no worse than not trying.
+				if sa, err := GetGSA(ctx, in.GCPOptions, gsa); err == nil {
+					cr = Fail("%s, whose WI annotation is GSA %q's numeric unique ID %q, but the email is required", in.Target, sa.Email, gsa).
+						WithRemediation(sa.Email, AnnotateKSACommand(in.Namespace, in.KSA, sa.Email))
+				}
+			}
+			return cr, nil
+		}
+		in.GSA = gsa
+		if gsa != raw {
+			return Warn("KSA %q's WI annotation %q has surrounding quotes or whitespace, using %q. Fix the template that sets it.",
+				in.KSA, raw, gsa), nil
+		}
+		return Pass("KSA %q is annotated with GSA %q", in.KSA, gsa), nil
+	},
+}
+
+var expectedGSACheck = &check{
+	name:        "expected-gsa",
+	description: "The KSA is annotated with the expected GSA.",
+	severity:    StatusFail,
+	run: func(ctx context.Context, in *Input) (CheckResult, error) {
+		switch {
+		case in.ExpectGSA == "":
+			return Skip("no expected GSA was given"), nil
+		case in.GSA == "":
+			return Skip("the KSA's GSA is unknown"), nil
+		case in.GSA != in.ExpectGSA:
+			return Fail("%s, which links to GSA %q, but the expected GSA is %q", in.Target, in.GSA, in.ExpectGSA).
+				WithRemediation(in.ExpectGSA, AnnotateKSACommand(in.Namespace, in.KSA, in.ExpectGSA)), nil
+		}
+		return Pass("GSA %q is the expected GSA", in.GSA), nil
+	},
+}
+
+var gsaNamePatternCheck = &check{
+	name:        "gsa-name-pattern",
+	description: "The GSA's name follows the naming convention.",
+	severity:    StatusFail,
+	run: func(ctx context.Context, in *Input) (CheckResult, error) {
+		switch {
+		case in.GSANamePattern == nil:
+			return Skip("no GSA name pattern was given"), nil
+		case in.GSA == "":
+			return Skip("the KSA's GSA is unknown"), nil
+		}
+		name := strings.SplitN(in.GSA, "@", 2)[0]
+		if !in.GSANamePattern.MatchString(name) {
+			return Fail("GSA %q's name %q does not match the naming convention %q", in.GSA, name, in.GSANamePattern), nil
+		}
+		return Pass("GSA %q's name %q matches the naming convention %q", in.GSA, name, in.GSANamePattern), nil
+	},
+}
+
+var gsaDetailsCheck = &check{
+	name:        "gsa-details",
+	description: "Reports the GSA's display name and description, to tell similarly named GSAs apart.",
+	severity:    StatusInfo,
+	run: func(ctx context.Context, in *Input) (CheckResult, error) {
+		switch {
+		case !in.ShowGSADetails:
+			return Skip(SkipNotEnabled), nil
+		case in.GSA == "":
+			return Skip("the KSA's GSA is unknown"), nil
+		}
+		gsa, err := GetGSA(ctx, in.GCPOptions, in.GSA)
+		if err != nil {
+			return CheckResult{}, err
+		}
+		in.GSADisplayName, in.GSADescription = gsa.DisplayName, gsa.Description
+		switch {
+		case gsa.DisplayName == "" && gsa.Description == "":
+			return Info("GSA %q has no display name or description", in.GSA), nil
+		case gsa.Description == "":
+			return Info("GSA %q is %q", in.GSA, gsa.DisplayName), nil
+		}
+		return Info("GSA %q is %q: %s", in.GSA, gsa.DisplayName, gsa.Description), nil
+	},
+}
+
+var misplacedAnnotationCheck = &check{
+	name:        "misplaced-annotation",
+	description: "The WI annotation is not on the Namespace or Deployment, where it has no effect.",
+	severity:    StatusWarn,
+	run: func(ctx context.Context, in *Input) (CheckResult, error) {
+		var misplaced []string
+		ns, err := in.Kube.CoreV1().Namespaces().Get(ctx, in.Namespace, v1.GetOptions{})
+		if err != nil {
+			return CheckResult{}, fmt.Errorf("getting the Namespace: %w", err)
+		}
+		misplaced = appendMisplaced(misplaced, "Namespace", ns.Name, ns.Annotations)
+		if in.Deployment != "" {
+			d, err := in.Kube.AppsV1().Deployments(in.Namespace).Get(ctx, in.Deployment, v1.GetOptions{})
+			if err != nil {
+				return CheckResult{}, fmt.Errorf("getting the Deployment: %w", err)
+			}
+			misplaced = appendMisplaced(misplaced, "Deployment", d.Name, d.Annotations)
+			misplaced = appendMisplaced(misplaced, "The Pod template of Deployment", d.Name, d.Spec.Template.Annotations)
+		}
+		if len(misplaced) > 0 {
+			return Warn("%s. The annotation only takes effect on a ServiceAccount, annotate the KSA instead.",
+				strings.Join(misplaced, "; ")), nil
+		}
+		return Pass("the WI annotation is not misplaced"), nil
+	},
+}
+
+func appendMisplaced(misplaced []string, kind, name string, annotations map[string]string) []string {
+	if gsa, present := annotations[WIGSAAnnotation]; present {
+		misplaced = append(misplaced, fmt.Sprintf("%s %q has the %q annotation (%q)", kind, name, WIGSAAnnotation, gsa))
+	}
+	return misplaced
+}
+
+var conflictingAnnotationsCheck = &check{
+	name:        "conflicting-annotations",
+	description: "The KSA has no other annotations naming a different GSA than its WI annotation.",
+	severity:    StatusWarn,
+	run: func(ctx context.Context, in *Input) (CheckResult, error) {
+		sa, err := in.serviceAccount(ctx)
+		if apierrors.IsNotFound(err) {
+			return Skip("the KSA does not exist"), nil
+		} else if err != nil {
+			return CheckResult{}, fmt.Errorf("getting the KSA: %w", err)
+		}
+		honored := CleanGSAAnnotation(sa.Annotations[WIGSAAnnotation])
+		var conflicts []string
+		for _, key := range sortedAnnotationKeys(sa.Annotations) {
+			if key == WIGSAAnnotation || !isGSAAnnotation(key, sa.Annotations[key]) {
+				continue
+			}
+			if other := CleanGSAAnnotation(sa.Annotations[key]); other != honored {
+				conflicts = append(conflicts, fmt.Sprintf("%q is %q", key, other))
+			}
+		}
+		if len(conflicts) > 0 {
+			return Warn("KSA %q has other annotations naming a GSA: %s. GKE only honors %q, which is %q; remove the others so it's clear which GSA the KSA acts as.",
+				in.KSA, strings.Join(conflicts, ", "), WIGSAAnnotation, honored), nil
+		}
+		return Pass("KSA %q has no annotations conflicting with its WI annotation", in.KSA), nil
+	},
+}
+
+var ksaAutomountCheck = &check{
+	name:        "ksa-automount",
+	description: "The KSA does not disable automounting its token into the Pods that use it.",
+	severity:    StatusWarn,
+	run: func(ctx context.Context, in *Input) (CheckResult, error) {
+		sa, err := in.serviceAccount(ctx)
+		if apierrors.IsNotFound(err) {
+			return Skip("the KSA does not exist"), nil
+		} else if err != nil {
+			return CheckResult{}, fmt.Errorf("getting the KSA: %w", err)
+		}
+		if sa.AutomountServiceAccountToken == nil || *sa.AutomountServiceAccountToken {
+			return Pass("KSA %q does not disable automounting its token", in.KSA), nil
+		}
+		if in.Pod != "" {
+			pod, err := in.Kube.CoreV1().Pods(in.Namespace).Get(ctx, in.Pod, v1.GetOptions{})
+			if err != nil {
+				return CheckResult{}, fmt.Errorf("getting the Pod: %w", err)
+			}
+			if a := pod.Spec.AutomountServiceAccountToken; a != nil && *a {
+				return Pass("KSA %q sets automountServiceAccountToken: false, but Pod %q overrides it", in.KSA, in.Pod), nil
+			}
+		} else if in.Deployment != "" {
+			d, err := in.Kube.AppsV1().Deployments(in.Namespace).Get(ctx, in.Deployment, v1.GetOptions{})
+			if err != nil {
+				return CheckResult{}, fmt.Errorf("getting the Deployment: %w", err)
+			}
+			if a := d.Spec.Template.Spec.AutomountServiceAccountToken; a != nil && *a {
+				return Pass("KSA %q sets automountServiceAccountToken: false, but Deployment %q's Pod template overrides it", in.KSA, in.Deployment), nil
+			}
+		}
+		return Warn("KSA %q sets automountServiceAccountToken: false, so Pods using it get no KSA token unless they set automountServiceAccountToken: true, which breaks WI for every one of them that doesn't",
+			in.KSA).WithRemediation(in.GSA, PatchKSAAutomountCommand(in.Namespace, in.KSA)), nil
+	},
+}
+
+// isGSAAnnotation reports whether the annotation looks like another attempt at naming the KSA's GSA,
+// either by a key resembling the WI annotation's or by a GSA email value.
+func isGSAAnnotation(key, value string) bool {
+	return strings.Contains(key, "gcp-service-account") || strings.HasSuffix(CleanGSAAnnotation(value), ".gserviceaccount.com")
+}
+
+func sortedAnnotationKeys(annotations map[string]string) []string {
+	keys := make([]string, 0, len(annotations))
+	for k := range annotations {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+var wiPoolCheck = &check{
+	name:        "wi-pool",
+	description: "The cluster has a WI pool.",
+	severity:    StatusFail,
+	run: func(ctx context.Context, in *Input) (CheckResult, error) {
+		pool, source, err := in.Env.wiPoolAndSource(ctx)
+		if err != nil {
+			return CheckResult{}, err
+		}
+		if pool == "" && in.NodeGSA != "" {
+			return Skip("Workload Identity is not enabled on the cluster, the KSA's workloads run as the node's GSA"), nil
+		} else if pool == "" {
+			return Fail("Workload Identity is not enabled on the cluster"), nil
+		}
+		in.WIPool, in.PoolSource = pool, source
+		switch source {
+		case PoolSourceAssumed:
+			return Info("assuming the cluster's WI pool is %q, the results are hypothetical", pool), nil
+		case PoolSourceFleet:
+			return Pass("the cluster's WI pool is the fleet's %q, from membership %q", pool, in.MembershipAPIName), nil
+		case PoolSourceFederation:
+			return Pass("the WI pool is %q, of Workload Identity Federation provider %q", pool, in.WIFProvider), nil
+		}
+		return Pass("the cluster's WI pool is %q", pool), nil
+	},
+}
+
+var wiPoolProjectCheck = &check{
+	name:        "wi-pool-project",
+	description: "The cluster's WI pool is its own project's, PROJECT.svc.id.goog.",
+	severity:    StatusWarn,
+	run: func(ctx context.Context, in *Input) (CheckResult, error) {
+		switch {
+		case in.WIPool == "":
+			return Skip("the cluster's WI pool is unknown"), nil
+		case in.PoolSource != PoolSourceCluster:
+			return Skip("the WI pool was not read from the cluster"), nil
+		case in.ClusterProject == "":
+			return Skip("the cluster's project is unknown"), nil
+		case isProjectNumber(in.ClusterProject):
+			return Skip("the cluster's project is given by number, %q, not ID", in.ClusterProject), nil
+		}
+		expected := in.ClusterProject + ".svc.id.goog"
+		if in.WIPool != expected {
+			// Changing the pool breaks every binding naming the current one, so no fix is suggested.
+			return Warn("the cluster's WI pool is %q, but the cluster is in project %q, whose pool is %q. Clusters using classic WI should use their own project's pool; check this is intended, e.g. for a Shared VPC, and that the bindings name %q",
+				in.WIPool, in.ClusterProject, expected, in.WIPool), nil
+		}
+		return Pass("the cluster's WI pool %q is its project's", in.WIPool), nil
+	},
+}
+
+var gkeVersionCheck = &check{
+	name:        "gke-version",
+	description: "The cluster's control plane and node pools are at GKE versions that support WI.",
+	severity:    StatusWarn,
+	run: func(ctx context.Context, in *Input) (CheckResult, error) {
+		switch {
+		case in.WIFProvider != "":
+			return Skip("the cluster is outside of GKE, federated through %q", in.WIFProvider), nil
+		case in.ClusterAPIName == "":
+			return Skip("the cluster is reached through its fleet membership"), nil
+		}
+		cluster, err := in.Env.Cluster(ctx)
+		if err != nil {
+			return CheckResult{}, err
+		}
+		var tooOld []string
+		for _, m := range minGKEVersions {
+			var below []string
+			if gkeVersionLess(cluster.CurrentMasterVersion, m.version) {
+				below = append(below, fmt.Sprintf("the control plane is at %q", cluster.CurrentMasterVersion))
+			}
+			for _, np := range cluster.NodePools {
+				if gkeVersionLess(np.Version, m.version) {
+					below = append(below, fmt.Sprintf("node pool %q is at %q", np.Name, np.Version))
+				}
+			}
+			if len(below) > 0 {
+				tooOld = append(tooOld, fmt.Sprintf("%s, below %q, the minimum for %s", strings.Join(below, ", "), m.version, m.feature))
+			}
+		}
+		if len(tooOld) > 0 {
+			return Warn("the cluster's GKE version is too old to honor its WI configuration: %s", strings.Join(tooOld, "; ")), nil
+		}
+		return Pass("the cluster's control plane and node pools are at GKE versions that support WI"), nil
+	},
+}
+
+var oidcIssuerCheck = &check{
+	name:        "oidc-issuer",
+	description: "Reports the issuer of the cluster's KSA tokens, which the WI pool must trust.",
+	severity:    StatusInfo,
+	run: func(ctx context.Context, in *Input) (CheckResult, error) {
+		switch {
+		case in.WIPool == "":
+			return Skip("the cluster's WI pool is unknown"), nil
+		case in.AssumePool != "":
+			return Skip("assuming the cluster's WI pool is %q", in.AssumePool), nil
+		case in.WIFProvider != "":
+			return Skip("the issuer is the one wif-provider reports the provider trusts"), nil
+		}
+		issuer := ClusterOIDCIssuer(in.ClusterAPIName)
+		if in.MembershipAPIName != "" {
+			membership, err := GetFleetMembership(ctx, in.GCPOptions, in.MembershipAPIName)
+			if err != nil {
+				return CheckResult{}, err
+			}
+			switch {
+			case membership.Authority != nil && membership.Authority.Issuer != "":
+				issuer = membership.Authority.Issuer
+			case membership.Endpoint != nil && membership.Endpoint.GkeCluster != nil && membership.Endpoint.GkeCluster.ResourceLink != "":
+				issuer = ClusterOIDCIssuer(strings.TrimPrefix(membership.Endpoint.GkeCluster.ResourceLink, "//container.googleapis.com/"))
+			default:
+				return Skip("fleet membership %q has no OIDC issuer", in.MembershipAPIName), nil
+			}
+		}
+		if poolProject := strings.TrimSuffix(in.WIPool, ".svc.id.goog"); poolProject != in.ClusterProject {
+			return Info("the cluster's KSA tokens are issued by %q, for WI pool %q, which belongs to project %q rather than the cluster's project %q",
+				issuer, in.WIPool, poolProject, in.ClusterProject), nil
+		}
+		return Info("the cluster's KSA tokens are issued by %q, for WI pool %q", issuer, in.WIPool), nil
+	},
+}
+
+var ksaMemberCheck = &check{
+	name:        "ksa-member",
+	description: "Reports the IAM policy member that represents the KSA.",
+	severity:    StatusInfo,
+	run: func(ctx context.Context, in *Input) (CheckResult, error) {
+		if in.WIPool == "" {
+			return Skip("the cluster's WI pool is unknown"), nil
+		}
+		return Info("KSA member: %s", in.ksaMember()), nil
+	},
+}
+
+var gsaBindingCheck = &check{
+	name:        "gsa-binding",
+	description: "The GSA's IAM policy lets the KSA act as the GSA.",
+	severity:    StatusFail,
+	run: func(ctx context.Context, in *Input) (CheckResult, error) {
+		switch {
+		case in.GSA == "":
+			return Skip("the KSA's GSA is unknown"), nil
+		case in.WIPool == "":
+			return Skip("the cluster's WI pool is unknown"), nil
+		}
+		policy, err := in.GSAPolicy(ctx)
+		if err != nil {
+			return CheckResult{}, err
+		}
+		in.AccessRole, in.AccessMember, in.HasAccess = ksaAccess(policy, ksaRoles, in.ksaMatcher())
+		if !in.HasAccess {
+			if pools := KSAInOtherPools(policy, in.WIPool, in.Namespace, in.KSA); len(pools) > 0 && in.WIFProvider == "" {
+				gsaPool := ""
+				if project, ok := GSAProject(in.GSA); ok && contains(pools, project+".svc.id.goog") {
+					gsaPool = ", including the GSA's own project's pool"
+				}
+				return Fail("%s, which links to GSA %q, but that GSA only grants access to the KSA in WI pools %v%s, not the cluster's pool %q. The member must name the pool of the cluster's project",
+					in.Target, in.GSA, pools, gsaPool, in.WIPool).
+					WithRemediation(in.GSA, GrantMemberRoleCommand("roles/iam.workloadIdentityUser", in.ksaMember(), in.GSA)), nil
+			}
+			return Fail("%s, which links to GSA %q, but that GSA does not grant access to the KSA", in.Target, in.GSA).
+				WithRemediation(in.GSA, GrantMemberRoleCommand("roles/iam.workloadIdentityUser", in.ksaMember(), in.GSA)), nil
+		}
+		if in.NoBroadRoles && IsPrimitiveRole(in.AccessRole) {
+			role, member, ok := ksaAccess(policy, narrowKSARoles, in.ksaMatcher())
+			if !ok {
+				in.HasAccess = false
+				return Fail("%s, which links to GSA %q, but that GSA only grants access to the KSA with the broad role %q, which is not accepted",
+					in.Target, in.GSA, in.AccessRole).
+					WithRemediation(in.GSA, GrantMemberRoleCommand("roles/iam.workloadIdentityUser", in.ksaMember(), in.GSA)), nil
+			}
+			// The broad role was only preferred for being granted unconditionally.
+			in.AccessRole, in.AccessMember = role, member
+		}
+		if c := AccessCondition(policy, in.AccessRole, in.AccessMember); c != nil {
+			if in.FailOnUnevaluableConditions {
+				in.HasAccess = false
+				return Fail("%s, which links to GSA %q, but that GSA only grants access to the KSA with role %q under the condition %s, which can't be evaluated",
+					in.Target, in.GSA, in.AccessRole, describeCondition(c)).
+					WithRemediation(in.GSA, GrantMemberRoleCommand("roles/iam.workloadIdentityUser", in.ksaMember(), in.GSA)), nil
+			}
+			return Warn("GSA %q grants access to the KSA with role %q on member %q, but only under the condition %s, which can't be evaluated, so access is assumed",
+				in.GSA, in.AccessRole, in.AccessMember, describeCondition(c)), nil
+		}
+		return Pass("GSA %q grants access to the KSA with role %q on member %q", in.GSA, in.AccessRole, in.AccessMember), nil
+	},
+}
+
+var idTokenBindingCheck = &check{
+	name:        "id-token-binding",
+	description: "The GSA's IAM policy lets the KSA get OIDC ID tokens for the GSA.",
+	severity:    StatusFail,
+	run: func(ctx context.Context, in *Input) (CheckResult, error) {
+		switch {
+		case !in.CheckIDToken:
+			return Skip(SkipNotEnabled), nil
+		case in.GSA == "":
+			return Skip("the KSA's GSA is unknown"), nil
+		case in.WIPool == "":
+			return Skip("the cluster's WI pool is unknown"), nil
+		}
+		policy, err := in.GSAPolicy(ctx)
+		if err != nil {
+			return CheckResult{}, err
+		}
+		role, member, ok := ksaAccess(policy, idTokenRoles, in.ksaMatcher())
+		if !ok {
+			return Fail("%s, which links to GSA %q, but that GSA does not let the KSA get ID tokens for it, which needs iam.serviceAccounts.getOpenIdToken", in.Target, in.GSA).
+				WithRemediation(in.GSA, GrantMemberRoleCommand("roles/iam.serviceAccountOpenIdTokenCreator", in.ksaMember(), in.GSA)), nil
+		}
+		c := AccessCondition(policy, role, member)
+		switch {
+		case c != nil && in.FailOnUnevaluableConditions:
+			return Fail("%s, which links to GSA %q, but that GSA only lets the KSA get ID tokens for it with role %q under the condition %s, which can't be evaluated",
+				in.Target, in.GSA, role, describeCondition(c)).
+				WithRemediation(in.GSA, GrantMemberRoleCommand("roles/iam.serviceAccountOpenIdTokenCreator", in.ksaMember(), in.GSA)), nil
+		case c != nil:
+			return Warn("GSA %q lets the KSA get ID tokens with role %q on member %q, but only under the condition %s, which can't be evaluated, so access is assumed",
+				in.GSA, role, member, describeCondition(c)), nil
+		case !in.HasAccess && role == "roles/iam.serviceAccountOpenIdTokenCreator":
+			return Pass("GSA %q lets the KSA get ID tokens with role %q on member %q, but not access tokens", in.GSA, role, member), nil
+		}
+		return Pass("GSA %q lets the KSA get ID tokens with role %q on member %q", in.GSA, role, member), nil
+	},
+}
+
+var probeTokenCheck = &check{
+	name:        "probe-token",
+	description: "An access token can be minted for the GSA with the caller's credentials.",
+	severity:    StatusFail,
+	run: func(ctx context.Context, in *Input) (CheckResult, error) {
+		switch {
+		case !in.ProbeToken:
+			return Skip(SkipNotEnabled), nil
+		case in.GSA == "":
+			return Skip("the KSA's GSA is unknown"), nil
+		}
+		expiry, err := GenerateGSAAccessToken(ctx, in.GCPOptions, in.GSA)
+		if err != nil {
+			return Fail("%s, which links to GSA %q, but minting an access token for it failed: %v", in.Target, in.GSA, err), nil
+		}
+		return Pass("minted an access token for GSA %q, expiring at %s", in.GSA, expiry), nil
+	},
+}
+
+var impersonationCheck = &check{
+	name:        "impersonation",
+	description: "Reports the GSAs the GSA can impersonate, directly or through other GSAs.",
+	severity:    StatusInfo,
+	run: func(ctx context.Context, in *Input) (CheckResult, error) {
+		switch {
+		case !in.FollowImpersonation:
+			return Skip(SkipNotEnabled), nil
+		case in.GSA == "":
+			return Skip("the KSA's GSA is unknown"), nil
+		}
+		maxDepth := in.MaxImpersonationDepth
+		if maxDepth == 0 {
+			maxDepth = DefaultMaxImpersonationDepth
+		}
+		chains, err := FollowImpersonation(ctx, in.GCPOptions, in.GSA, maxDepth, in.PolicyVersion)
+		if err != nil {
+			return CheckResult{}, err
+		}
+		in.ImpersonationChains = chains
+		if len(chains) == 0 {
+			return Pass("GSA %q can't impersonate any GSA in its project", in.GSA), nil
+		}
+		described := make([]string, len(chains))
+		for i, c := range chains {
+			described[i] = c.String()
+		}
+		return Info("through GSA %q, the KSA can also act as other GSAs: %s", in.GSA, strings.Join(described, "; ")), nil
+	},
+}
+
+var projectReferencesCheck = &check{
+	name:        "project-references",
+	description: "The GSA's bindings for the KSA use the project ID and project number where each is expected.",
+	severity:    StatusWarn,
+	run: func(ctx context.Context, in *Input) (CheckResult, error) {
+		switch {
+		case in.GSA == "":
+			return Skip("the KSA's GSA is unknown"), nil
+		case in.WIPool == "":
+			return Skip("the cluster's WI pool is unknown"), nil
+		}
+		policy, err := in.GSAPolicy(ctx)
+		if err != nil {
+			return CheckResult{}, err
+		}
+		poolProject := strings.TrimSuffix(in.WIPool, ".svc.id.goog")
+		var number int64
+		projectNumber := func() (int64, error) {
+			if number == 0 {
+				p, err := GetProject(ctx, in.GCPOptions, poolProject)
+				if err != nil {
+					return 0, err
+				}
+				number = p.ProjectNumber
+			}
+			return number, nil
+		}
+		var mismatches []string
+		for _, binding := range policy.Bindings {
+			for _, member := range binding.Members {
+				if pool, ns, ksa, ok := ParseKSAIAMPolicyMember(member); ok {
+					project := strings.TrimSuffix(pool, ".svc.id.goog")
+					if ns != in.Namespace || ksa != in.KSA || pool == in.WIPool || !isProjectNumber(project) {
+						continue
+					}
+					n, err := projectNumber()
+					if err != nil {
+						return CheckResult{}, err
+					}
+					if project == fmt.Sprint(n) {
+						mismatches = append(mismatches, fmt.Sprintf("%q uses the project number, the WI pool must use the project ID, as in %q",
+							member, KSAIAMPolicyMember(in.WIPool, ns, ksa)))
+					}
+					continue
+				}
+				project, ok := principalProject(member, in.WIPool, in.Namespace, in.KSA)
+				if !ok || isProjectNumber(project) {
+					continue
+				}
+				n, err := projectNumber()
+				if err != nil {
+					return CheckResult{}, err
+				}
+				mismatches = append(mismatches, fmt.Sprintf("%q uses project %q, principal identifiers must use the project number, %d",
+					member, project, n))
+			}
+		}
+		if len(mismatches) > 0 {
+			return Warn("GSA %q's bindings for the KSA mix up project IDs and numbers: %s",
+				in.GSA, strings.Join(mismatches, "; ")), nil
+		}
+		return Pass("GSA %q's bindings for the KSA use project IDs and numbers where expected", in.GSA), nil
+	},
+}
+
+// principalProject returns the project reference of a principal:// or principalSet:// member that
+// refers to the KSA or its namespace in the WI pool.
+func principalProject(member, wiPool, ns, ksaName string) (string, bool) {
+	for _, prefix := range []string{"principal://iam.googleapis.com/projects/", "principalSet://iam.googleapis.com/projects/"} {
+		rest := strings.TrimPrefix(member, prefix)
+		if rest == member {
+			continue
+		}
+		slash := strings.Index(rest, "/")
+		if slash < 0 {
+			return "", false
+		}
+		poolPath := rest[slash:]
+		if poolPath == "/locations/global/workloadIdentityPools/"+wiPool+"/subject/ns/"+ns+"/sa/"+ksaName ||
+			poolPath == "/locations/global/workloadIdentityPools/"+wiPool+"/namespace/"+ns {
+			return rest[:slash], true
+		}
+	}
+	return "", false
+}
+
+var broadGrantsCheck = &check{
+	name:        "broad-grants",
+	description: "The GSA does not let far broader sets of identities than a single KSA act as it.",
+	severity:    StatusWarn,
+	run: func(ctx context.Context, in *Input) (CheckResult, error) {
+		if in.GSA == "" {
+			return Skip("the KSA's GSA is unknown"), nil
+		}
+		policy, err := in.GSAPolicy(ctx)
+		if err != nil {
+			return CheckResult{}, err
+		}
+		broadGrants := BroadGrants(policy)
+		if len(broadGrants) == 0 {
+			return Pass("GSA %q has no bindings broader than necessary", in.GSA), nil
+		}
+		descriptions := make([]string, 0, len(broadGrants))
+		for _, bg := range broadGrants {
+			descriptions = append(descriptions, bg.String())
+		}
+		return Warn("GSA %q has bindings broader than necessary: %s", in.GSA, strings.Join(descriptions, "; ")), nil
+	},
+}
+
+var staleBindingsCheck = &check{
+	name:        "stale-bindings",
+	description: "Every KSA in this cluster that the GSA lets act as it still exists.",
+	severity:    StatusWarn,
+	run: func(ctx context.Context, in *Input) (CheckResult, error) {
+		switch {
+		case !in.CheckStaleBindings:
+			return Skip(SkipNotEnabled), nil
+		case in.GSA == "":
+			return Skip("the KSA's GSA is unknown"), nil
+		case in.WIPool == "":
+			return Skip("the cluster's WI pool is unknown"), nil
+		}
+		policy, err := in.GSAPolicy(ctx)
+		if err != nil {
+			return CheckResult{}, err
+		}
+		var stale []string
+		for _, member := range KSAMembers(policy) {
+			pool, ns, ksa, _ := ParseKSAIAMPolicyMember(member)
+			if pool != in.WIPool {
+				// The KSA is in another cluster's pool, so can't be looked up here.
+				continue
+			}
+			_, err := in.Kube.CoreV1().ServiceAccounts(ns).Get(ctx, ksa, v1.GetOptions{})
+			if apierrors.IsNotFound(err) {
+				stale = append(stale, member)
+			} else if err != nil {
+				return CheckResult{}, fmt.Errorf("getting KSA %s/%s: %w", ns, ksa, err)
+			}
+		}
+		if len(stale) > 0 {
+			return Warn("GSA %q grants access to KSAs that no longer exist, whose bindings are candidates for cleanup: %s",
+				in.GSA, strings.Join(stale, ", ")), nil
+		}
+		return Pass("every KSA in this cluster that GSA %q grants access to exists", in.GSA), nil
+	},
+}
+
+var gsaProjectCheck = &check{
+	name:        "gsa-project",
+	description: "The GSA is in the cluster's project or one of the allowed GSA projects.",
+	severity:    StatusWarn,
+	run: func(ctx context.Context, in *Input) (CheckResult, error) {
+		if in.GSA == "" {
+			return Skip("the KSA's GSA is unknown"), nil
+		}
+		project, ok := GSAProject(in.GSA)
+		if !ok {
+			return Skip("GSA %q's email does not contain its project ID", in.GSA), nil
+		}
+		if project == in.ClusterProject {
+			return Pass("GSA %q is in the cluster's project", in.GSA), nil
+		}
+		for _, allowed := range in.AllowedGSAProjects {
+			if allowed == project {
+				return Pass("GSA %q is in allowed project %q", in.GSA, project), nil
+			}
+		}
+		return Warn("GSA %q is in project %q, which is neither the cluster's project %q nor an allowed GSA project",
+			in.GSA, project, in.ClusterProject), nil
+	},
+}
+
+var gsaProjectStateCheck = &check{
+	name:        "gsa-project-state",
+	description: "The GSA's project is active, rather than pending deletion.",
+	severity:    StatusWarn,
+	run: func(ctx context.Context, in *Input) (CheckResult, error) {
+		if in.GSA == "" {
+			return Skip("the KSA's GSA is unknown"), nil
+		}
+		project, ok := GSAProject(in.GSA)
+		if !ok {
+			return Skip("GSA %q's email does not contain its project ID", in.GSA), nil
+		}
+		p, err := GetProject(ctx, in.GCPOptions, project)
+		if err != nil {
+			return CheckResult{}, err
+		}
+		switch p.LifecycleState {
+		case "ACTIVE":
+			return Pass("GSA %q's project %q is active", in.GSA, project), nil
+		case "DELETE_REQUESTED":
+			return Warn("GSA %q's project %q is pending deletion, so WI stops working for the KSA; restore it with gcloud projects undelete %s",
+				in.GSA, project, project), nil
+		}
+		return Warn("GSA %q's project %q is in lifecycle state %q rather than ACTIVE, so WI may not work for the KSA", in.GSA, project, p.LifecycleState), nil
+	},
+}
+
+var rolesProjectCheck = &check{
+	name:        "roles-project",
+	description: "The GSA's roles are read from the GSA's own project.",
+	severity:    StatusWarn,
+	run: func(ctx context.Context, in *Input) (CheckResult, error) {
+		switch {
+		case in.NodeGSA != "":
+			return Skip("the KSA's workloads run as the node's GSA"), nil
+		case in.GSA == "":
+			return Skip("the KSA's GSA is unknown"), nil
+		}
+		project, ok := GSAProject(in.GSA)
+		if !ok {
+			return Skip("GSA %q's email does not contain its project ID", in.GSA), nil
+		}
+		if rolesProject := in.RolesProject(); project != rolesProject {
+			return Warn("GSA %q is in project %q, but its roles are read from project %q, so roles it has on its own project are not reported; use -gsa-project to read them from %q instead",
+				in.GSA, project, rolesProject, project), nil
+		}
+		return Pass("GSA %q's roles are read from its own project %q", in.GSA, project), nil
+	},
+}
+
+var projectRolesCheck = &check{
+	name:        "project-roles",
+	description: "Reports the GSA's roles on the project, warning if it has none.",
+	severity:    StatusWarn,
+	run: func(ctx context.Context, in *Input) (CheckResult, error) {
+		switch {
+		case in.NodeGSA != "":
+			return Skip("the KSA's workloads run as the node's GSA, whose roles node-identity reported"), nil
+		case in.GSA == "":
+			return Skip("the KSA's GSA is unknown"), nil
+		}
+		policy, err := in.ProjectPolicy(ctx)
+		if err != nil {
+			return CheckResult{}, err
+		}
+		allRoles := GSARolesInPolicy(policy, in.GSA)
+		roles := in.filterRoles(allRoles)
+		in.Roles = roles
+		if len(allRoles) == 0 {
+			authenticates := ""
+			if in.HasAccess {
+				authenticates = "authenticates successfully but "
+			}
+			return Warn("GSA %q %shas no roles on project %q; workloads will get permission-denied on GCP calls, unless they only use resources that grant the GSA access themselves",
+				in.GSA, authenticates, in.RolesProject()), nil
+		}
+		if in.RoleFilter != nil {
+			return Pass("GSA %q's roles on the project %q matching %q are %v", in.GSA, in.RolesProject(), in.RoleFilter, roles), nil
+		}
+		return Pass("GSA %q's roles on the project %q are %v", in.GSA, in.RolesProject(), roles), nil
+	},
+}
+
+var policyEtagsCheck = &check{
+	name:        "policy-etags",
+	description: "Reports the etags of the GSA's and the project's IAM policies, to tell whether they changed between runs.",
+	severity:    StatusInfo,
+	run: func(ctx context.Context, in *Input) (CheckResult, error) {
+		switch {
+		case !in.ShowPolicyEtags:
+			return Skip(SkipNotEnabled), nil
+		case in.GSA == "":
+			return Skip("the KSA's GSA is unknown"), nil
+		}
+		gsaPolicy, err := in.GSAPolicy(ctx)
+		if err != nil {
+			return CheckResult{}, err
+		}
+		projectPolicy, err := in.ProjectPolicy(ctx)
+		if err != nil {
+			return CheckResult{}, err
+		}
+		in.GSAPolicyEtag, in.ProjectPolicyEtag = gsaPolicy.Etag, projectPolicy.Etag
+		return Info("GSA %q's IAM policy has etag %q, project %q's has etag %q. IAM changes can take minutes to take effect after the etag changes",
+			in.GSA, in.GSAPolicyEtag, in.RolesProject(), in.ProjectPolicyEtag), nil
+	},
+}
+
+var ksaProjectRolesCheck = &check{
+	name:        "ksa-project-roles",
+	description: "Reports the roles granted to the KSA directly on the project, rather than through the GSA.",
+	severity:    StatusInfo,
+	run: func(ctx context.Context, in *Input) (CheckResult, error) {
+		switch {
+		case !in.CheckKSAProjectRoles:
+			return Skip(SkipNotEnabled), nil
+		case in.WIPool == "":
+			return Skip("the cluster's WI pool is unknown"), nil
+		}
+		policy, err := in.ProjectPolicy(ctx)
+		if err != nil {
+			return CheckResult{}, err
+		}
+		var members []string
+		in.KSARoles, members = matchingRolesInPolicy(policy, in.ksaMatcher())
+		if len(in.KSARoles) == 0 {
+			return Pass("the KSA has no roles directly on the project %q", in.RolesProject()), nil
+		}
+		return Info("KSA member %s also has roles directly on the project %q: %v", strings.Join(members, ", "), in.RolesProject(), in.KSARoles), nil
+	},
+}
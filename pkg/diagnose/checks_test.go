@@ -0,0 +1,142 @@
+package diagnose
+
+import (
+	"context"
+	"testing"
+
+	"google.golang.org/api/iam/v1"
+	corev1 "k8s.io/api/core/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestKSAAnnotationCleanup(t *testing.T) {
+	const gsa = "app-sa@my-project.iam.gserviceaccount.com"
+	for _, tc := range []struct {
+		value      string
+		wantStatus Status
+		wantGSA    string
+	}{
+		{value: gsa, wantStatus: StatusPass, wantGSA: gsa},
+		// Values that needed cleanup are used, with a warning to fix the template.
+		{value: `"` + gsa + `"`, wantStatus: StatusWarn, wantGSA: gsa},
+		{value: "  " + gsa + "\n", wantStatus: StatusWarn, wantGSA: gsa},
+		{value: `"not-an-email"`, wantStatus: StatusFail},
+	} {
+		in := NewInput(&Env{}, Target{Namespace: "my-ns", KSA: "agent"})
+		in.ServiceAccount = &corev1.ServiceAccount{ObjectMeta: v1.ObjectMeta{
+			Name:        "agent",
+			Namespace:   "my-ns",
+			Annotations: map[string]string{WIGSAAnnotation: tc.value},
+		}}
+		cr, err := ksaAnnotationCheck.Run(context.Background(), in)
+		if err != nil {
+			t.Fatalf("annotation %q: %v", tc.value, err)
+		}
+		if cr.Status != tc.wantStatus || in.GSA != tc.wantGSA {
+			t.Errorf("annotation %q: status %s and GSA %q, want %s and %q: %s", tc.value, cr.Status, in.GSA, tc.wantStatus, tc.wantGSA, cr.Message)
+		}
+	}
+}
+
+func TestBindingChecksConditions(t *testing.T) {
+	const (
+		pool = "my-project.svc.id.goog"
+		ksa  = "serviceAccount:" + pool + "[my-ns/agent]"
+		ns   = "principalSet://iam.googleapis.com/projects/123/locations/global/workloadIdentityPools/" + pool + "/namespace/my-ns"
+	)
+	condition := &iam.Expr{Title: "business-hours", Expression: "request.time.getHours('UTC') < 17"}
+	conditional := &iam.Binding{Role: "roles/iam.workloadIdentityUser", Members: []string{ksa}, Condition: condition}
+	for _, tc := range []struct {
+		name     string
+		bindings []*iam.Binding
+		// want is the status of both gsa-binding and id-token-binding without and with
+		// FailOnUnevaluableConditions.
+		want, wantFailOn Status
+	}{
+		{
+			name:       "unconditional",
+			bindings:   []*iam.Binding{{Role: "roles/iam.workloadIdentityUser", Members: []string{ksa}}},
+			want:       StatusPass,
+			wantFailOn: StatusPass,
+		},
+		{
+			name:       "only conditional",
+			bindings:   []*iam.Binding{conditional},
+			want:       StatusWarn,
+			wantFailOn: StatusFail,
+		},
+		{
+			name:       "conditional and unconditional through a broader role",
+			bindings:   []*iam.Binding{conditional, {Role: "roles/iam.serviceAccountTokenCreator", Members: []string{ksa}}},
+			want:       StatusPass,
+			wantFailOn: StatusPass,
+		},
+		{
+			name:       "conditional and unconditional through the namespace",
+			bindings:   []*iam.Binding{conditional, {Role: "roles/iam.workloadIdentityUser", Members: []string{ns}}},
+			want:       StatusPass,
+			wantFailOn: StatusPass,
+		},
+		{
+			name:       "conditional through the namespace and the KSA",
+			bindings:   []*iam.Binding{conditional, {Role: "roles/iam.workloadIdentityUser", Members: []string{ns}, Condition: condition}},
+			want:       StatusWarn,
+			wantFailOn: StatusFail,
+		},
+	} {
+		for _, failOn := range []bool{false, true} {
+			want := tc.want
+			if failOn {
+				want = tc.wantFailOn
+			}
+			for _, c := range []*check{gsaBindingCheck, idTokenBindingCheck} {
+				in := NewInput(&Env{CheckIDToken: true, FailOnUnevaluableConditions: failOn}, Target{Namespace: "my-ns", KSA: "agent"})
+				in.GSA, in.WIPool = "app-sa@my-project.iam.gserviceaccount.com", pool
+				in.gsaPolicy = &iam.Policy{Bindings: tc.bindings}
+				cr, err := c.Run(context.Background(), in)
+				if err != nil {
+					t.Fatalf("%s: %s: %v", tc.name, c.Name(), err)
+				}
+				if cr.Status != want {
+					t.Errorf("%s: %s with FailOnUnevaluableConditions %v = %s, want %s: %s", tc.name, c.Name(), failOn, cr.Status, want, cr.Message)
+				}
+			}
+		}
+	}
+}
+
+func TestGSABindingNoBroadRoles(t *testing.T) {
+	const ksa = "serviceAccount:my-project.svc.id.goog[my-ns/agent]"
+	condition := &iam.Expr{Expression: "request.time.getHours('UTC') < 17"}
+	for _, tc := range []struct {
+		name     string
+		bindings []*iam.Binding
+		want     Status
+	}{
+		{
+			name:     "only broad",
+			bindings: []*iam.Binding{{Role: "roles/editor", Members: []string{ksa}}},
+			want:     StatusFail,
+		},
+		{
+			// The narrow role is used, with its condition, rather than the unconditional broad one.
+			name: "broad and conditional narrow",
+			bindings: []*iam.Binding{
+				{Role: "roles/editor", Members: []string{ksa}},
+				{Role: "roles/iam.workloadIdentityUser", Members: []string{ksa}, Condition: condition},
+			},
+			want: StatusWarn,
+		},
+	} {
+		in := NewInput(&Env{NoBroadRoles: true}, Target{Namespace: "my-ns", KSA: "agent"})
+		in.GSA, in.WIPool = "app-sa@my-project.iam.gserviceaccount.com", "my-project.svc.id.goog"
+		in.gsaPolicy = &iam.Policy{Bindings: tc.bindings}
+		cr, err := gsaBindingCheck.Run(context.Background(), in)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if cr.Status != tc.want {
+			t.Errorf("%s: gsa-binding = %s, want %s: %s", tc.name, cr.Status, tc.want, cr.Message)
+		}
+	}
+}
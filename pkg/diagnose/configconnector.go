@@ -0,0 +1,109 @@
+package diagnose
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+var (
+	// iamPolicyMemberResource is Config Connector's IAMPolicyMember, a single IAM binding.
+	iamPolicyMemberResource = schema.GroupVersionResource{Group: "iam.cnrm.cloud.google.com", Version: "v1beta1", Resource: "iampolicymembers"}
+	// iamServiceAccountResource is Config Connector's IAMServiceAccount, a GSA.
+	iamServiceAccountResource = schema.GroupVersionResource{Group: "iam.cnrm.cloud.google.com", Version: "v1beta1", Resource: "iamserviceaccounts"}
+)
+
+var configConnectorCheck = &check{
+	name:        "config-connector",
+	description: "A ready Config Connector IAMPolicyMember in the KSA's namespace declares the KSA's binding on the GSA.",
+	severity:    StatusWarn,
+	run: func(ctx context.Context, in *Input) (CheckResult, error) {
+		switch {
+		case !in.CheckConfigConnector || in.Dynamic == nil:
+			return Skip(SkipNotEnabled), nil
+		case in.GSA == "":
+			return Skip("the KSA's GSA is unknown"), nil
+		case in.WIPool == "":
+			return Skip("the cluster's WI pool is unknown"), nil
+		}
+		list, err := in.Dynamic.Resource(iamPolicyMemberResource).Namespace(in.Namespace).List(ctx, v1.ListOptions{})
+		if apierrors.IsNotFound(err) {
+			return Skip("Config Connector is not installed in the cluster"), nil
+		} else if err != nil {
+			return CheckResult{}, fmt.Errorf("listing the IAMPolicyMembers: %w", err)
+		}
+		member := KSAIAMPolicyMember(in.WIPool, in.Namespace, in.KSA)
+		for i := range list.Items {
+			pm := &list.Items[i]
+			pmMember, _, _ := unstructured.NestedString(pm.Object, "spec", "member")
+			pmRole, _, _ := unstructured.NestedString(pm.Object, "spec", "role")
+			if pmMember != member || pmRole != workloadIdentityUserRole {
+				continue
+			}
+			gsa, err := in.policyMemberGSA(ctx, pm)
+			if err != nil {
+				return CheckResult{}, err
+			}
+			if gsa != in.GSA {
+				continue
+			}
+			if ready, reason := readyCondition(pm); !ready {
+				return Warn("IAMPolicyMember %q declares the KSA's binding on GSA %q, but it is not ready, so the binding may not exist in GCP yet: %s",
+					pm.GetName(), in.GSA, reason), nil
+			}
+			return Pass("IAMPolicyMember %q declares the KSA's binding on GSA %q, and is ready", pm.GetName(), in.GSA), nil
+		}
+		return Warn("no Config Connector IAMPolicyMember in namespace %q grants %s %q on GSA %q; if Config Connector manages the GSA's policy, it may remove a binding made by hand",
+			in.Namespace, member, workloadIdentityUserRole, in.GSA), nil
+	},
+}
+
+// workloadIdentityUserRole is the role that lets a KSA act as a GSA.
+const workloadIdentityUserRole = "roles/iam.workloadIdentityUser"
+
+// policyMemberGSA returns the email of the GSA the IAMPolicyMember's resourceRef points at, or "" if
+// it is not a GSA. A reference by name is resolved through the IAMServiceAccount.
+func (in *Input) policyMemberGSA(ctx context.Context, pm *unstructured.Unstructured) (string, error) {
+	ref, _, _ := unstructured.NestedStringMap(pm.Object, "spec", "resourceRef")
+	if ref["kind"] != "IAMServiceAccount" {
+		return "", nil
+	}
+	if external := ref["external"]; external != "" {
+		// Either the email, or projects/PROJECT/serviceAccounts/EMAIL.
+		return external[strings.LastIndex(external, "/")+1:], nil
+	}
+	ns := ref["namespace"]
+	if ns == "" {
+		ns = pm.GetNamespace()
+	}
+	sa, err := in.Dynamic.Resource(iamServiceAccountResource).Namespace(ns).Get(ctx, ref["name"], v1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return "", nil
+	} else if err != nil {
+		return "", fmt.Errorf("getting IAMServiceAccount %s/%s: %w", ns, ref["name"], err)
+	}
+	email, _, _ := unstructured.NestedString(sa.Object, "status", "email")
+	return email, nil
+}
+
+// readyCondition returns whether the Config Connector resource's Ready condition is True, and if not,
+// why.
+func readyCondition(obj *unstructured.Unstructured) (bool, string) {
+	conditions, _, _ := unstructured.NestedSlice(obj.Object, "status", "conditions")
+	for _, c := range conditions {
+		cond, ok := c.(map[string]interface{})
+		if !ok || cond["type"] != "Ready" {
+			continue
+		}
+		if cond["status"] == "True" {
+			return true, ""
+		}
+		return false, fmt.Sprintf("%v: %v", cond["reason"], cond["message"])
+	}
+	return false, "it has no Ready condition, Config Connector may not have reconciled it"
+}
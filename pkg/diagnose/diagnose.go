@@ -0,0 +1,551 @@
+// Package diagnose checks whether a Kubernetes service account (KSA) in a GKE cluster can act as the
+// Google service account (GSA) it is annotated with via Workload Identity (WI), and what that GSA can
+// do. The diagnosis is a sequence of Checks run against an Input.
+package diagnose
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sync"
+
+	"google.golang.org/api/cloudresourcemanager/v1"
+	"google.golang.org/api/container/v1"
+	"google.golang.org/api/iam/v1"
+	"google.golang.org/api/option"
+	corev1 "k8s.io/api/core/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	// WIGSAAnnotation is the annotation on a KSA naming the GSA it acts as.
+	WIGSAAnnotation = "iam.gke.io/gcp-service-account"
+)
+
+// Env is the environment shared by every KSA diagnosed in the same cluster. Cluster level lookups,
+// such as the WI pool, are made once and shared by every Input using the Env.
+type Env struct {
+	// Kube reads the Kubernetes objects.
+	Kube kubernetes.Interface
+	// Dynamic reads the Config Connector resources, if CheckConfigConnector is set.
+	Dynamic dynamic.Interface
+	// GCPOptions are passed to every GCP API client.
+	GCPOptions []option.ClientOption
+
+	// ClusterAPIName is the cluster's resource name, projects/P/locations/L/clusters/N. Fleet
+	// registered clusters reached through the Connect gateway set MembershipAPIName instead,
+	// projects/P/locations/L/memberships/M.
+	ClusterAPIName    string
+	MembershipAPIName string
+	// ClusterProject is the project the cluster or its fleet membership is in.
+	ClusterProject string
+	// WIFProvider, if set, is the resource name of the Workload Identity Federation pool provider
+	// that a cluster outside of GKE, and not in a fleet, federates its KSAs through. Its pool is then
+	// the WI pool, and the KSA is matched by its principal in that pool.
+	WIFProvider string
+	// AssumePool, if not empty, is used as the cluster's WI pool instead of reading it, e.g. to see
+	// whether the bindings would work once WI is enabled with that pool. Results are hypothetical.
+	AssumePool string
+
+	// Project is the project the GSA's roles are read from.
+	Project string
+	// UseGSAProject reads the GSA's roles from the project in its email instead of Project, when the
+	// email contains one.
+	UseGSAProject bool
+	// RoleFilter, if not nil, limits the reported roles to those it matches.
+	RoleFilter *regexp.Regexp
+	// PolicyVersion is the IAM policy version to request. Version 3 is required to see conditional
+	// role bindings.
+	PolicyVersion int64
+
+	// NoBroadRoles fails the GSA binding check if only roles/editor or roles/owner grant the KSA
+	// access, rather than accepting them.
+	NoBroadRoles bool
+	// FailOnUnevaluableConditions fails the GSA binding checks if the KSA is only granted access under
+	// an IAM condition, which the tool cannot evaluate, rather than warning and assuming access.
+	FailOnUnevaluableConditions bool
+	// ExplainErrors records the errors of checks decoded with ExplainError, rather than as they are.
+	ExplainErrors bool
+	// AdditionalGSAs are GSAs, besides the annotated one, that the KSA's workloads act as through
+	// explicit credential configuration, e.g. in an init container. Each is checked for the KSA's
+	// access and its roles.
+	AdditionalGSAs []string
+	// ExpectGSA, if not empty, is the GSA the KSA must be annotated with.
+	ExpectGSA string
+	// GSANamePattern, if not nil, must match the name of the KSA's GSA, the part of its email before
+	// the @. Anchor it to require the whole name to match.
+	GSANamePattern *regexp.Regexp
+	// AllowedGSAProjects are the projects, besides ClusterProject, whose GSAs are expected to be used.
+	AllowedGSAProjects []string
+	// CheckStaleBindings enables the check for GSA bindings to KSAs that no longer exist.
+	CheckStaleBindings bool
+	// CheckGSAKeys enables the check for the GSA's user-managed keys, and the org policy disabling
+	// their creation.
+	CheckGSAKeys bool
+	// CheckKSAProjectRoles enables the check for roles granted to the KSA directly on the project.
+	CheckKSAProjectRoles bool
+	// CheckLeastPrivilege enables the check for the GSA's basic roles on the project, and the IAM
+	// Recommender's suggestions of smaller roles.
+	CheckLeastPrivilege bool
+	// CheckTokenRBAC enables the check for the KSA being allowed to create tokens for other KSAs.
+	CheckTokenRBAC bool
+	// ProbeToken enables minting an access token for the GSA with the caller's credentials.
+	ProbeToken bool
+	// CheckConfigConnector enables the check for a Config Connector IAMPolicyMember declaring the
+	// KSA's binding on the GSA.
+	CheckConfigConnector bool
+	// CheckIDToken enables the check that the KSA may get OIDC ID tokens for the GSA, for workloads
+	// calling services that authenticate them with ID tokens.
+	CheckIDToken bool
+	// Troubleshoot enables asking the Policy Troubleshooter whether the KSA may act as the GSA, and
+	// whether the GSA has each of the TroubleshootPermissions on the RolesProject.
+	Troubleshoot            bool
+	TroubleshootPermissions []string
+	// FollowImpersonation enables following the GSAs the GSA can impersonate, for at most
+	// MaxImpersonationDepth hops, or DefaultMaxImpersonationDepth if it is 0.
+	FollowImpersonation   bool
+	MaxImpersonationDepth int
+	// IncludeBindings includes the raw IAM bindings that were read in each Result.
+	IncludeBindings bool
+	// ShowGSADetails enables reading the GSA's display name and description, to tell similarly named
+	// GSAs apart.
+	ShowGSADetails bool
+	// ShowPolicyEtags enables reporting the etags of the GSA's and the project's IAM policies, which
+	// change whenever the policies do.
+	ShowPolicyEtags bool
+
+	mu              sync.Mutex
+	poolResolved    bool
+	wiPool          string
+	poolSource      PoolSource
+	wiPoolErr       error
+	clusterResolved bool
+	cluster         *container.Cluster
+	clusterErr      error
+}
+
+// PoolSource is where the cluster's WI pool was read from.
+type PoolSource string
+
+const (
+	// PoolSourceCluster is a GKE cluster's own WI configuration.
+	PoolSourceCluster PoolSource = "cluster"
+	// PoolSourceFleet is the fleet membership's identity provider, for clusters outside of GKE.
+	PoolSourceFleet PoolSource = "fleet"
+	// PoolSourceAssumed is the Env's AssumePool.
+	PoolSourceAssumed PoolSource = "assumed"
+	// PoolSourceFederation is the pool of the Env's WIFProvider.
+	PoolSourceFederation PoolSource = "federation"
+)
+
+// WIPool returns the cluster's WI pool, reading it from GCP on the first call, or AssumePool if it is
+// set.
+func (e *Env) WIPool(ctx context.Context) (string, error) {
+	pool, _, err := e.wiPoolAndSource(ctx)
+	return pool, err
+}
+
+// WIPoolSource returns where WIPool reads the cluster's WI pool from.
+func (e *Env) WIPoolSource(ctx context.Context) (PoolSource, error) {
+	_, source, err := e.wiPoolAndSource(ctx)
+	return source, err
+}
+
+func (e *Env) wiPoolAndSource(ctx context.Context) (string, PoolSource, error) {
+	if e.AssumePool != "" {
+		return e.AssumePool, PoolSourceAssumed, nil
+	}
+	if e.WIFProvider != "" {
+		p, err := ParseWIFProvider(e.WIFProvider)
+		if err != nil {
+			return "", "", err
+		}
+		return p.PoolName(), PoolSourceFederation, nil
+	}
+	if e.MembershipAPIName == "" {
+		cluster, err := e.Cluster(ctx)
+		if err != nil {
+			return "", "", err
+		}
+		return ClusterWIPool(cluster), PoolSourceCluster, nil
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if !e.poolResolved {
+		e.wiPool, e.poolSource, e.wiPoolErr = fleetMembershipWIPool(ctx, e.GCPOptions, e.MembershipAPIName)
+		e.poolResolved = true
+	}
+	return e.wiPool, e.poolSource, e.wiPoolErr
+}
+
+// Cluster returns the GKE cluster named by ClusterAPIName, reading it from GCP on the first call.
+func (e *Env) Cluster(ctx context.Context) (*container.Cluster, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if !e.clusterResolved {
+		e.cluster, e.clusterErr = GetCluster(ctx, e.GCPOptions, e.ClusterAPIName)
+		e.clusterResolved = true
+	}
+	return e.cluster, e.clusterErr
+}
+
+// Target is the KSA being diagnosed.
+type Target struct {
+	Namespace string `json:"namespace"`
+	KSA       string `json:"ksa"`
+	// Pod and Deployment name the object the KSA was found through, if any.
+	Pod        string `json:"pod,omitempty"`
+	Deployment string `json:"deployment,omitempty"`
+	// Selector is the label selector the Pods using the KSA were found by, if any. Pod is then one of
+	// them, whose checks stand for the others'.
+	Selector string `json:"selector,omitempty"`
+}
+
+// String describes how the target's KSA was found, e.g. `Pod "my-pod" uses KSA "my-ksa"`.
+func (t Target) String() string {
+	switch {
+	case t.Selector != "":
+		return fmt.Sprintf("Pods selected by %q, e.g. %q, use KSA %q", t.Selector, t.Pod, t.KSA)
+	case t.Pod != "":
+		return fmt.Sprintf("Pod %q uses KSA %q", t.Pod, t.KSA)
+	case t.Deployment != "":
+		return fmt.Sprintf("Deployment %q uses KSA %q", t.Deployment, t.KSA)
+	}
+	return fmt.Sprintf("KSA %q", t.KSA)
+}
+
+// Input is what the Checks diagnose. Checks run in order and record what they find in the Input, so
+// later checks can build on what earlier ones found.
+type Input struct {
+	*Env
+	Target
+
+	// ServiceAccount, if set, is the KSA to diagnose instead of reading it from the cluster, e.g. one
+	// that is about to be created or updated.
+	ServiceAccount *corev1.ServiceAccount
+
+	// GSA is the GSA the KSA is annotated with.
+	GSA string
+	// WIPool is the cluster's WI pool, and PoolSource where it was read from.
+	WIPool     string
+	PoolSource PoolSource
+	// HasAccess is whether the GSA lets the KSA act as it. AccessRole is the role that does so, and
+	// AccessMember the member it's granted to, see KSAAccess.
+	HasAccess    bool
+	AccessRole   string
+	AccessMember string
+	// NodeGSA is the node's GSA, if the KSA's workloads run on nodes that don't use WI.
+	NodeGSA string
+	// Roles are the GSA's roles on the RolesProject, or the NodeGSA's if it is set.
+	Roles []string
+	// KSARoles are the roles granted to the KSA's member directly on the RolesProject.
+	KSARoles []string
+	// ImpersonationChains are the chains of GSAs the GSA can impersonate.
+	ImpersonationChains []ImpersonationChain
+	// GSADisplayName and GSADescription are the GSA's human readable display name and description.
+	GSADisplayName string
+	GSADescription string
+	// GSAPolicyEtag and ProjectPolicyEtag are the etags of the GSA's and the RolesProject's IAM
+	// policies, as read.
+	GSAPolicyEtag     string
+	ProjectPolicyEtag string
+	// AdditionalGSAResults are the outcomes of checking the Env's AdditionalGSAs.
+	AdditionalGSAResults []AdditionalGSA
+	// OwnerChain is the Pod's controlling owners, from its direct owner up to the top-level workload.
+	OwnerChain []Owner
+
+	gsaPolicy     *iam.Policy
+	projectPolicy *cloudresourcemanager.Policy
+}
+
+// NewInput returns the Input to diagnose the target in the environment.
+func NewInput(env *Env, target Target) *Input {
+	return &Input{
+		Env:    env,
+		Target: target,
+	}
+}
+
+// GSAPolicy returns the IAM policy of the Input's GSA, reading it from GCP on the first call.
+func (in *Input) GSAPolicy(ctx context.Context) (*iam.Policy, error) {
+	if in.gsaPolicy == nil {
+		p, err := GetGSAIAMPolicy(ctx, in.GCPOptions, in.GSA, in.PolicyVersion)
+		if err != nil {
+			return nil, err
+		}
+		in.gsaPolicy = p
+	}
+	return in.gsaPolicy, nil
+}
+
+// ksaMatcher returns the function matching the IAM policy members that represent the KSA: its
+// federated principals if the Env has a WIFProvider, otherwise the forms KSAAccess recognizes.
+func (in *Input) ksaMatcher() func(member string) bool {
+	if p, err := ParseWIFProvider(in.WIFProvider); err == nil {
+		return wifMatcher(p, in.Namespace, in.KSA)
+	}
+	return newKSAMatcher(in.WIPool, in.Namespace, in.KSA).matches
+}
+
+// ksaMember returns the IAM policy member that represents the KSA in the WI pool.
+func (in *Input) ksaMember() string {
+	if p, err := ParseWIFProvider(in.WIFProvider); err == nil {
+		return WIFPrincipal(p, in.Namespace, in.KSA)
+	}
+	return KSAIAMPolicyMember(in.WIPool, in.Namespace, in.KSA)
+}
+
+// serviceAccount returns the Input's ServiceAccount, reading it from the cluster if it isn't set.
+func (in *Input) serviceAccount(ctx context.Context) (*corev1.ServiceAccount, error) {
+	if in.ServiceAccount != nil {
+		return in.ServiceAccount, nil
+	}
+	return in.Kube.CoreV1().ServiceAccounts(in.Namespace).Get(ctx, in.KSA, v1.GetOptions{})
+}
+
+// filterRoles returns the roles that match the Env's RoleFilter.
+func (in *Input) filterRoles(roles []string) []string {
+	if in.RoleFilter == nil {
+		return roles
+	}
+	var filtered []string
+	for _, role := range roles {
+		if in.RoleFilter.MatchString(role) {
+			filtered = append(filtered, role)
+		}
+	}
+	return filtered
+}
+
+// RolesProject returns the project the GSA's roles are read from: the GSA's own project if
+// UseGSAProject is set and the GSA is known, otherwise the Env's Project.
+func (in *Input) RolesProject() string {
+	if in.UseGSAProject {
+		if project, ok := GSAProject(in.GSA); ok {
+			return project
+		}
+	}
+	return in.Project
+}
+
+// ProjectPolicy returns the IAM policy of the RolesProject, reading it from GCP on the first call.
+func (in *Input) ProjectPolicy(ctx context.Context) (*cloudresourcemanager.Policy, error) {
+	if in.projectPolicy == nil {
+		p, err := GetProjectIAMPolicy(ctx, in.GCPOptions, in.RolesProject(), in.PolicyVersion)
+		if err != nil {
+			return nil, err
+		}
+		in.projectPolicy = p
+	}
+	return in.projectPolicy, nil
+}
+
+// Status is the outcome of a Check.
+type Status string
+
+const (
+	// StatusPass means the check found nothing wrong.
+	StatusPass Status = "PASS"
+	// StatusInfo means the check only reports information.
+	StatusInfo Status = "INFO"
+	// StatusWarn means the check found something likely to be wrong, that doesn't break WI.
+	StatusWarn Status = "WARN"
+	// StatusFail means the check found something that stops the KSA from using its GSA.
+	StatusFail Status = "FAIL"
+	// StatusSkip means the check did not run, e.g. because an earlier check failed.
+	StatusSkip Status = "SKIP"
+	// StatusError means the check could not complete, e.g. because an API call failed.
+	StatusError Status = "ERROR"
+)
+
+// CheckResult is the outcome of running a single Check.
+type CheckResult struct {
+	// Name is the name of the Check that produced the result.
+	Name    string `json:"name"`
+	Status  Status `json:"status"`
+	Message string `json:"message"`
+	// Remediations are the commands that fix what the check found, if it knows them.
+	Remediations []Remediation `json:"remediations,omitempty"`
+}
+
+// Remediation is a command that fixes what a check found.
+type Remediation struct {
+	// GSA is the GSA the command is about.
+	GSA     string `json:"gsa,omitempty"`
+	Command string `json:"command"`
+}
+
+// WithRemediation returns the CheckResult with the command that fixes what it found, which is about
+// the GSA.
+func (cr CheckResult) WithRemediation(gsa, command string) CheckResult {
+	cr.Remediations = append(cr.Remediations, Remediation{GSA: gsa, Command: command})
+	return cr
+}
+
+// Pass returns a passing CheckResult.
+func Pass(format string, args ...interface{}) CheckResult {
+	return CheckResult{Status: StatusPass, Message: fmt.Sprintf(format, args...)}
+}
+
+// Info returns an informational CheckResult.
+func Info(format string, args ...interface{}) CheckResult {
+	return CheckResult{Status: StatusInfo, Message: fmt.Sprintf(format, args...)}
+}
+
+// Warn returns a warning CheckResult.
+func Warn(format string, args ...interface{}) CheckResult {
+	return CheckResult{Status: StatusWarn, Message: fmt.Sprintf(format, args...)}
+}
+
+// Fail returns a failing CheckResult.
+func Fail(format string, args ...interface{}) CheckResult {
+	return CheckResult{Status: StatusFail, Message: fmt.Sprintf(format, args...)}
+}
+
+// SkipNotEnabled is the reason opt-in checks are skipped when their Env option is not set.
+const SkipNotEnabled = "not enabled"
+
+// Skip returns the CheckResult of a check that did not run, explaining why.
+func Skip(format string, args ...interface{}) CheckResult {
+	return CheckResult{Status: StatusSkip, Message: fmt.Sprintf(format, args...)}
+}
+
+// Check is a single step of the diagnosis.
+type Check interface {
+	// Name identifies the check, e.g. to disable it.
+	Name() string
+	// Description is a one line summary of what the check verifies.
+	Description() string
+	// Run runs the check. An error means the check could not complete.
+	Run(ctx context.Context, in *Input) (CheckResult, error)
+}
+
+// Result is the outcome of diagnosing a single KSA.
+type Result struct {
+	Target
+	GSA    string `json:"gsa"`
+	WIPool string `json:"wiPool"`
+	// PoolSource is where WIPool was read from.
+	PoolSource PoolSource `json:"poolSource,omitempty"`
+	// PoolAssumed is whether WIPool is the Env's AssumePool, making the result hypothetical.
+	PoolAssumed  bool     `json:"poolAssumed,omitempty"`
+	Project      string   `json:"project"`
+	HasAccess    bool     `json:"hasAccess"`
+	AccessRole   string   `json:"accessRole,omitempty"`
+	AccessMember string   `json:"accessMember,omitempty"`
+	NodeGSA      string   `json:"nodeGSA,omitempty"`
+	Roles        []string `json:"roles"`
+	KSARoles     []string `json:"ksaRoles,omitempty"`
+	// ImpersonationChains are only set if the Env's FollowImpersonation is.
+	ImpersonationChains []ImpersonationChain `json:"impersonationChains,omitempty"`
+	// GSADisplayName and GSADescription are only set if the Env's ShowGSADetails is.
+	GSADisplayName string `json:"gsaDisplayName,omitempty"`
+	GSADescription string `json:"gsaDescription,omitempty"`
+	// GSAPolicyEtag and ProjectPolicyEtag are only set if the Env's ShowPolicyEtags is.
+	GSAPolicyEtag     string `json:"gsaPolicyEtag,omitempty"`
+	ProjectPolicyEtag string `json:"projectPolicyEtag,omitempty"`
+	// OwnerChain is only set for Pods.
+	OwnerChain []Owner `json:"ownerChain,omitempty"`
+	// AdditionalGSAs are only set if the Env's AdditionalGSAs are.
+	AdditionalGSAs []AdditionalGSA `json:"additionalGSAs,omitempty"`
+	// GSABindings and ProjectBindings are the bindings of the GSA's and the project's IAM policies.
+	// They are only set if the Env's IncludeBindings is, and the policy was read.
+	GSABindings     []Binding `json:"gsaBindings,omitempty"`
+	ProjectBindings []Binding `json:"projectBindings,omitempty"`
+	// Checks are the results of every check, in the order they ran.
+	Checks []CheckResult `json:"checks"`
+}
+
+// Binding is a role binding in an IAM policy.
+type Binding struct {
+	Role    string   `json:"role"`
+	Members []string `json:"members"`
+	// Condition is nil for unconditional bindings.
+	Condition *BindingCondition `json:"condition,omitempty"`
+}
+
+// BindingCondition is the condition under which a Binding applies.
+type BindingCondition struct {
+	Title       string `json:"title"`
+	Description string `json:"description,omitempty"`
+	Expression  string `json:"expression"`
+}
+
+// Passed reports whether no check failed or errored.
+func (r *Result) Passed() bool {
+	for _, c := range r.Checks {
+		if c.Status == StatusFail || c.Status == StatusError {
+			return false
+		}
+	}
+	return true
+}
+
+// Skipped returns the results of the checks that did not run, whose messages say why.
+func (r *Result) Skipped() []CheckResult {
+	var skipped []CheckResult
+	for _, c := range r.Checks {
+		if c.Status == StatusSkip {
+			skipped = append(skipped, c)
+		}
+	}
+	return skipped
+}
+
+// Run runs the checks in order against the Input and collects their results. A check that returns
+// an error is recorded with StatusError, and the remaining checks still run.
+func Run(ctx context.Context, in *Input, checks []Check) *Result {
+	r := &Result{}
+	for _, c := range checks {
+		cr, err := c.Run(ctx, in)
+		if err != nil {
+			msg := err.Error()
+			if in.ExplainErrors {
+				msg = ExplainError(err)
+			}
+			cr = CheckResult{Status: StatusError, Message: msg}
+		}
+		cr.Name = c.Name()
+		r.Checks = append(r.Checks, cr)
+	}
+	r.Target = in.Target
+	r.GSA = in.GSA
+	r.WIPool = in.WIPool
+	r.PoolAssumed = in.AssumePool != ""
+	r.PoolSource = in.PoolSource
+	r.Project = in.RolesProject()
+	r.HasAccess = in.HasAccess
+	r.AccessRole = in.AccessRole
+	r.AccessMember = in.AccessMember
+	r.NodeGSA = in.NodeGSA
+	r.Roles = in.Roles
+	r.KSARoles = in.KSARoles
+	r.ImpersonationChains = in.ImpersonationChains
+	r.GSADisplayName = in.GSADisplayName
+	r.GSADescription = in.GSADescription
+	r.GSAPolicyEtag = in.GSAPolicyEtag
+	r.ProjectPolicyEtag = in.ProjectPolicyEtag
+	r.AdditionalGSAs = in.AdditionalGSAResults
+	r.OwnerChain = in.OwnerChain
+	if in.IncludeBindings {
+		if in.gsaPolicy != nil {
+			for _, b := range in.gsaPolicy.Bindings {
+				r.GSABindings = append(r.GSABindings, Binding{Role: b.Role, Members: b.Members})
+				if c := b.Condition; c != nil {
+					r.GSABindings[len(r.GSABindings)-1].Condition = &BindingCondition{Title: c.Title, Description: c.Description, Expression: c.Expression}
+				}
+			}
+		}
+		if in.projectPolicy != nil {
+			for _, b := range in.projectPolicy.Bindings {
+				r.ProjectBindings = append(r.ProjectBindings, Binding{Role: b.Role, Members: b.Members})
+				if c := b.Condition; c != nil {
+					r.ProjectBindings[len(r.ProjectBindings)-1].Condition = &BindingCondition{Title: c.Title, Description: c.Description, Expression: c.Expression}
+				}
+			}
+		}
+	}
+	return r
+}
@@ -0,0 +1,42 @@
+package diagnose
+
+import (
+	"google.golang.org/api/option"
+)
+
+// The GCP APIs whose endpoints can be overridden with WithAPIEndpoint.
+const (
+	IAMAPI                  = "iam"
+	IAMCredentialsAPI       = "iamcredentials"
+	ContainerAPI            = "container"
+	GKEHubAPI               = "gkehub"
+	CloudResourceManagerAPI = "cloudresourcemanager"
+	PolicyTroubleshooterAPI = "policytroubleshooter"
+	RecommenderAPI          = "recommender"
+)
+
+// apiEndpoint is an endpoint override that only applies to the clients of one API, so it can be
+// passed along with the options every client gets.
+type apiEndpoint struct {
+	option.ClientOption
+	api string
+}
+
+// WithAPIEndpoint returns an option that overrides the endpoint of the API's clients, e.g. to use
+// Private Google Access or a test double. The clients of other APIs ignore it.
+func WithAPIEndpoint(api, endpoint string) option.ClientOption {
+	return apiEndpoint{ClientOption: option.WithEndpoint(endpoint), api: api}
+}
+
+// apiOptions returns the options for a client of the API, dropping the endpoint overrides of other
+// APIs.
+func apiOptions(opts []option.ClientOption, api string) []option.ClientOption {
+	filtered := make([]option.ClientOption, 0, len(opts))
+	for _, o := range opts {
+		if e, ok := o.(apiEndpoint); ok && e.api != api {
+			continue
+		}
+		filtered = append(filtered, o)
+	}
+	return filtered
+}
@@ -0,0 +1,126 @@
+package diagnose
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/iam/v1"
+	"google.golang.org/api/option"
+)
+
+// wifProviderRegexp matches the resource name of a Workload Identity Federation pool provider.
+var wifProviderRegexp = regexp.MustCompile(`^projects/([0-9]+)/locations/global/workloadIdentityPools/([a-z0-9-]+)/providers/([a-z0-9-]+)$`)
+
+// WIFProvider is a Workload Identity Federation pool provider, through which KSAs of a cluster
+// outside of GKE, and not in a fleet, act as GSAs.
+type WIFProvider struct {
+	ProjectNumber string
+	Pool          string
+	Provider      string
+}
+
+// ParseWIFProvider parses the provider's resource name,
+// projects/NUM/locations/global/workloadIdentityPools/POOL/providers/PROVIDER, optionally prefixed by
+// //iam.googleapis.com/ as gcloud prints it. The project must be given by number, as it is in the
+// principal identifiers of the pool's members.
+func ParseWIFProvider(name string) (WIFProvider, error) {
+	m := wifProviderRegexp.FindStringSubmatch(strings.TrimPrefix(name, "//iam.googleapis.com/"))
+	if m == nil {
+		return WIFProvider{}, fmt.Errorf("%q is not a WI pool provider, expected projects/PROJECT_NUMBER/locations/global/workloadIdentityPools/POOL/providers/PROVIDER", name)
+	}
+	return WIFProvider{ProjectNumber: m[1], Pool: m[2], Provider: m[3]}, nil
+}
+
+// PoolName returns the resource name of the provider's pool.
+func (p WIFProvider) PoolName() string {
+	return fmt.Sprintf("projects/%s/locations/global/workloadIdentityPools/%s", p.ProjectNumber, p.Pool)
+}
+
+func (p WIFProvider) String() string {
+	return p.PoolName() + "/providers/" + p.Provider
+}
+
+// WIFKSASubject returns the subject of the KSA's tokens, which providers map to google.subject by
+// default.
+func WIFKSASubject(ns, ksaName string) string {
+	return fmt.Sprintf("system:serviceaccount:%s:%s", ns, ksaName)
+}
+
+// WIFPrincipal returns the IAM policy member that represents the KSA in the provider's pool, if the
+// provider maps google.subject to the token's subject.
+func WIFPrincipal(p WIFProvider, ns, ksaName string) string {
+	return "principal://iam.googleapis.com/" + p.PoolName() + "/subject/" + WIFKSASubject(ns, ksaName)
+}
+
+// WIFAccess is like KSAAccess, for a KSA federated through the provider. The KSA is matched by its
+// WIFPrincipal, or by the principalSet of every identity in the pool:
+//
+//	principalSet://iam.googleapis.com/projects/NUM/locations/global/workloadIdentityPools/POOL/*
+//
+// principalSets of custom attributes can't be matched without the attributes' values, so are not.
+func WIFAccess(gsaPolicy *iam.Policy, p WIFProvider, ns, ksaName string) (role, member string, ok bool) {
+	return ksaAccess(gsaPolicy, ksaRoles, wifMatcher(p, ns, ksaName))
+}
+
+func wifMatcher(p WIFProvider, ns, ksaName string) func(string) bool {
+	principal := WIFPrincipal(p, ns, ksaName)
+	poolSet := "principalSet://iam.googleapis.com/" + p.PoolName() + "/*"
+	return func(member string) bool {
+		return member == principal || member == poolSet
+	}
+}
+
+// GetWIFProvider returns the Workload Identity Federation pool provider.
+func GetWIFProvider(ctx context.Context, opts []option.ClientOption, p WIFProvider) (*iam.WorkloadIdentityPoolProvider, error) {
+	iamSVC, err := iam.NewService(ctx, apiOptions(opts, IAMAPI)...)
+	if err != nil {
+		return nil, fmt.Errorf("creating IAM.Service: %w", err)
+	}
+	provider, err := iam.NewProjectsLocationsWorkloadIdentityPoolsProvidersService(iamSVC).Get(p.String()).Do()
+	if err != nil {
+		return nil, fmt.Errorf("getting WI pool provider %q: %w", p, err)
+	}
+	return provider, nil
+}
+
+var wifProviderCheck = &check{
+	name:        "wif-provider",
+	description: "The Workload Identity Federation provider exists, is active, and maps google.subject to the KSA token's subject.",
+	severity:    StatusFail,
+	run: func(ctx context.Context, in *Input) (CheckResult, error) {
+		if in.WIFProvider == "" {
+			return Skip(SkipNotEnabled), nil
+		}
+		p, err := ParseWIFProvider(in.WIFProvider)
+		if err != nil {
+			return CheckResult{}, err
+		}
+		provider, err := GetWIFProvider(ctx, in.GCPOptions, p)
+		var apiErr *googleapi.Error
+		if errors.As(err, &apiErr) && apiErr.Code == http.StatusNotFound {
+			return Fail("WI pool provider %q does not exist", p), nil
+		} else if err != nil {
+			return CheckResult{}, err
+		}
+		switch {
+		case provider.Disabled:
+			return Fail("WI pool provider %q is disabled, so it does not exchange the KSA's tokens", p), nil
+		case provider.State != "" && provider.State != "ACTIVE":
+			return Fail("WI pool provider %q is %s, not ACTIVE", p, provider.State), nil
+		}
+		if mapping := provider.AttributeMapping["google.subject"]; mapping != "assertion.sub" {
+			return Warn("WI pool provider %q maps google.subject to %q, not assertion.sub, so the KSA's principal is not %q, and it must be bound by what the mapping yields",
+				p, mapping, WIFPrincipal(p, in.Namespace, in.KSA)), nil
+		}
+		issuer := ""
+		if provider.Oidc != nil {
+			issuer = fmt.Sprintf(", trusting issuer %q", provider.Oidc.IssuerUri)
+		}
+		return Pass("WI pool provider %q is active%s, and maps google.subject to the KSA token's subject", p, issuer), nil
+	},
+}
@@ -0,0 +1,396 @@
+package diagnose
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"google.golang.org/api/cloudresourcemanager/v1"
+	"google.golang.org/api/container/v1"
+	"google.golang.org/api/gkehub/v1"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/iam/v1"
+	"google.golang.org/api/iamcredentials/v1"
+	"google.golang.org/api/option"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// ClusterAPIName returns the resource name of the GKE cluster.
+func ClusterAPIName(project, location, name string) string {
+	return fmt.Sprintf("projects/%s/locations/%s/clusters/%s", project, location, name)
+}
+
+// ParseClusterAPIName is the inverse of ClusterAPIName. It also accepts the cluster's full resource
+// name, //container.googleapis.com/projects/P/locations/L/clusters/N, and its API URL, as gcloud and
+// the console show them.
+func ParseClusterAPIName(s string) (project, location, name string, err error) {
+	rest := s
+	for _, prefix := range []string{"//container.googleapis.com/", "https://container.googleapis.com/v1/"} {
+		rest = strings.TrimPrefix(rest, prefix)
+	}
+	parts := strings.Split(rest, "/")
+	if len(parts) != 6 || parts[0] != "projects" || parts[2] != "locations" || parts[4] != "clusters" ||
+		parts[1] == "" || parts[5] == "" {
+		return "", "", "", fmt.Errorf("%q is not a GKE cluster, expected projects/PROJECT/locations/LOCATION/clusters/NAME", s)
+	}
+	if err := ValidateClusterLocation(parts[3]); err != nil {
+		return "", "", "", err
+	}
+	return parts[1], parts[3], parts[5], nil
+}
+
+// MembershipAPIName returns the resource name of the fleet membership.
+func MembershipAPIName(project, location, membership string) string {
+	return fmt.Sprintf("projects/%s/locations/%s/memberships/%s", project, location, membership)
+}
+
+// GSAAPIResource returns the resource name of the GSA.
+func GSAAPIResource(gsaEmail string) string {
+	return fmt.Sprintf("projects/-/serviceAccounts/%s", gsaEmail)
+}
+
+// KSAIAMPolicyMember returns the IAM policy member that represents the KSA. Fleet WI uses the same
+// format, with the fleet's pool.
+func KSAIAMPolicyMember(wiPool, ns, ksaName string) string {
+	return fmt.Sprintf("serviceAccount:%s[%s/%s]", wiPool, ns, ksaName)
+}
+
+// ParseKSAIAMPolicyMember is the inverse of KSAIAMPolicyMember. It returns false if the member does
+// not represent a KSA.
+func ParseKSAIAMPolicyMember(member string) (wiPool, ns, ksaName string, ok bool) {
+	rest := strings.TrimPrefix(member, "serviceAccount:")
+	open := strings.Index(rest, "[")
+	if rest == member || open < 0 || !strings.HasSuffix(rest, "]") {
+		return "", "", "", false
+	}
+	nsKSA := strings.SplitN(rest[open+1:len(rest)-1], "/", 2)
+	if len(nsKSA) != 2 {
+		return "", "", "", false
+	}
+	return rest[:open], nsKSA[0], nsKSA[1], true
+}
+
+// GSAIAMPolicyMember returns the IAM policy member that represents the GSA.
+func GSAIAMPolicyMember(gsaEmail string) string {
+	return fmt.Sprintf("serviceAccount:%s", gsaEmail)
+}
+
+// GSAProject returns the ID of the project that owns the GSA. It returns false for GSAs whose email
+// does not contain the project ID, such as the Compute Engine default service account, which
+// contains the project number instead.
+func GSAProject(gsaEmail string) (string, bool) {
+	at := strings.LastIndex(gsaEmail, "@")
+	if at < 0 {
+		return "", false
+	}
+	name, domain := gsaEmail[:at], gsaEmail[at+1:]
+	switch {
+	case strings.HasSuffix(domain, ".iam.gserviceaccount.com"):
+		return strings.TrimSuffix(domain, ".iam.gserviceaccount.com"), true
+	case domain == "appspot.gserviceaccount.com":
+		return name, true
+	}
+	return "", false
+}
+
+// GetCluster returns the GKE cluster.
+func GetCluster(ctx context.Context, opts []option.ClientOption, clusterAPIName string) (*container.Cluster, error) {
+	gkeSVC, err := container.NewService(ctx, apiOptions(opts, ContainerAPI)...)
+	if err != nil {
+		return nil, fmt.Errorf("creating GKE.Service: %w", err)
+	}
+
+	cluster, err := gkeSVC.Projects.Locations.Clusters.Get(clusterAPIName).Do()
+	var apiErr *googleapi.Error
+	switch {
+	case err == nil:
+		return cluster, nil
+	case errors.As(err, &apiErr) && apiErr.Code == http.StatusForbidden:
+		return nil, &ClusterPermissionError{ClusterAPIName: clusterAPIName, Err: err}
+	case errors.As(err, &apiErr) && apiErr.Code == http.StatusNotFound:
+		return nil, fmt.Errorf("GKE Cluster %q does not exist, check its project, location and name: %w", clusterAPIName, err)
+	}
+	return nil, fmt.Errorf("getting GKE Cluster %q: %w", clusterAPIName, err)
+}
+
+// ClusterPermissionError is returned when the identity running the diagnosis may not read the GKE
+// cluster. The API returns it whether or not the cluster exists, so it is not a sign of a typo.
+type ClusterPermissionError struct {
+	ClusterAPIName string
+	Err            error
+}
+
+func (e *ClusterPermissionError) Error() string {
+	return fmt.Sprintf("the identity running the diagnosis lacks container.clusters.get on GKE Cluster %q, grant it roles/container.viewer: %v",
+		e.ClusterAPIName, e.Err)
+}
+
+func (e *ClusterPermissionError) Unwrap() error {
+	return e.Err
+}
+
+// FindClusterByLabels returns the one GKE cluster in the project whose resource labels match the
+// selector. It is an error if no cluster, or more than one, matches.
+func FindClusterByLabels(ctx context.Context, opts []option.ClientOption, project string, selector labels.Selector) (*container.Cluster, error) {
+	gkeSVC, err := container.NewService(ctx, apiOptions(opts, ContainerAPI)...)
+	if err != nil {
+		return nil, fmt.Errorf("creating GKE.Service: %w", err)
+	}
+
+	// Clusters.List has no page token, it returns every cluster at once, see
+	// https://cloud.google.com/kubernetes-engine/docs/reference/rest/v1/projects.locations.clusters/list
+	// and container.ListClustersResponse, which has no NextPageToken. Instead zones it could not reach
+	// are reported as missing, in which case a match could be incomplete.
+	parent := fmt.Sprintf("projects/%s/locations/-", project)
+	resp, err := gkeSVC.Projects.Locations.Clusters.List(parent).Do()
+	if err != nil {
+		return nil, fmt.Errorf("listing the GKE Clusters in %q: %w", parent, err)
+	}
+	if len(resp.MissingZones) > 0 {
+		return nil, fmt.Errorf("listing the GKE Clusters in %q: clusters in zones %s could not be listed, try again",
+			parent, strings.Join(resp.MissingZones, ", "))
+	}
+	var matches []*container.Cluster
+	var names []string
+	for _, c := range resp.Clusters {
+		if selector.Matches(labels.Set(c.ResourceLabels)) {
+			matches = append(matches, c)
+			names = append(names, ClusterAPIName(project, c.Location, c.Name))
+		}
+	}
+	switch len(matches) {
+	case 0:
+		return nil, fmt.Errorf("no GKE Cluster in project %q has labels matching %q", project, selector)
+	case 1:
+		return matches[0], nil
+	}
+	return nil, fmt.Errorf("%d GKE Clusters in project %q have labels matching %q, narrow the selector: %s",
+		len(matches), project, selector, strings.Join(names, ", "))
+}
+
+// ClusterWIPool returns the WI pool of the GKE cluster, or the empty string if WI is not enabled.
+func ClusterWIPool(cluster *container.Cluster) string {
+	if cluster.WorkloadIdentityConfig == nil {
+		return ""
+	}
+	return cluster.WorkloadIdentityConfig.WorkloadPool
+}
+
+// GetWIPool returns the WI pool of the GKE cluster.
+func GetWIPool(ctx context.Context, opts []option.ClientOption, clusterAPIName string) (string, error) {
+	cluster, err := GetCluster(ctx, opts, clusterAPIName)
+	if err != nil {
+		return "", err
+	}
+	return ClusterWIPool(cluster), nil
+}
+
+// GetFleetMembership returns the fleet membership.
+func GetFleetMembership(ctx context.Context, opts []option.ClientOption, membershipAPIName string) (*gkehub.Membership, error) {
+	hubSVC, err := gkehub.NewService(ctx, apiOptions(opts, GKEHubAPI)...)
+	if err != nil {
+		return nil, fmt.Errorf("creating GKEHub.Service: %w", err)
+	}
+
+	membership, err := hubSVC.Projects.Locations.Memberships.Get(membershipAPIName).Do()
+	if err != nil {
+		return nil, fmt.Errorf("getting Fleet Membership %q: %w", membershipAPIName, err)
+	}
+	return membership, nil
+}
+
+// ClusterOIDCIssuer returns the issuer of the GKE cluster's KSA tokens, which its WI pool trusts.
+func ClusterOIDCIssuer(clusterAPIName string) string {
+	return "https://container.googleapis.com/v1/" + clusterAPIName
+}
+
+// GetFleetMembershipWIPool resolves the WI pool of the cluster registered as the fleet membership.
+// GKE clusters use their own WI pool, other clusters use the pool of the fleet's identity provider.
+func GetFleetMembershipWIPool(ctx context.Context, opts []option.ClientOption, membershipAPIName string) (string, error) {
+	pool, _, err := fleetMembershipWIPool(ctx, opts, membershipAPIName)
+	return pool, err
+}
+
+func fleetMembershipWIPool(ctx context.Context, opts []option.ClientOption, membershipAPIName string) (string, PoolSource, error) {
+	membership, err := GetFleetMembership(ctx, opts, membershipAPIName)
+	if err != nil {
+		return "", "", err
+	}
+	if ep := membership.Endpoint; ep != nil && ep.GkeCluster != nil && ep.GkeCluster.ResourceLink != "" {
+		clusterAPIName := strings.TrimPrefix(ep.GkeCluster.ResourceLink, "//container.googleapis.com/")
+		pool, err := GetWIPool(ctx, opts, clusterAPIName)
+		return pool, PoolSourceCluster, err
+	}
+	if membership.Authority == nil || membership.Authority.WorkloadIdentityPool == "" {
+		return "", "", fmt.Errorf("fleet membership %q does not have a workload identity pool", membershipAPIName)
+	}
+	return membership.Authority.WorkloadIdentityPool, PoolSourceFleet, nil
+}
+
+// GetGSAIAMPolicy returns the IAM policy of the GSA, which controls who may act as it.
+func GetGSAIAMPolicy(ctx context.Context, opts []option.ClientOption, gsaEmail string, policyVersion int64) (*iam.Policy, error) {
+	iamSVC, err := iam.NewService(ctx, apiOptions(opts, IAMAPI)...)
+	if err != nil {
+		return nil, fmt.Errorf("creating IAM.Service: %w", err)
+	}
+	saSVC := iam.NewProjectsServiceAccountsService(iamSVC)
+	gsaAPIResource := GSAAPIResource(gsaEmail)
+	gsaPolicy, err := saSVC.GetIamPolicy(gsaAPIResource).OptionsRequestedPolicyVersion(policyVersion).Do()
+	if err != nil {
+		return nil, fmt.Errorf("getting GSA %q IAMPolicy: %w", gsaAPIResource, err)
+	}
+	return gsaPolicy, nil
+}
+
+// GetGSA returns the GSA, including its display name and description.
+func GetGSA(ctx context.Context, opts []option.ClientOption, gsaEmail string) (*iam.ServiceAccount, error) {
+	iamSVC, err := iam.NewService(ctx, apiOptions(opts, IAMAPI)...)
+	if err != nil {
+		return nil, fmt.Errorf("creating IAM.Service: %w", err)
+	}
+	gsa, err := iam.NewProjectsServiceAccountsService(iamSVC).Get(GSAAPIResource(gsaEmail)).Do()
+	if err != nil {
+		return nil, fmt.Errorf("getting GSA %q: %w", gsaEmail, err)
+	}
+	return gsa, nil
+}
+
+// ListProjectGSAs returns the emails of every GSA in the project.
+func ListProjectGSAs(ctx context.Context, opts []option.ClientOption, project string) ([]string, error) {
+	iamSVC, err := iam.NewService(ctx, apiOptions(opts, IAMAPI)...)
+	if err != nil {
+		return nil, fmt.Errorf("creating IAM.Service: %w", err)
+	}
+	var gsas []string
+	err = iam.NewProjectsServiceAccountsService(iamSVC).List("projects/"+project).Pages(ctx, func(resp *iam.ListServiceAccountsResponse) error {
+		for _, sa := range resp.Accounts {
+			gsas = append(gsas, sa.Email)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("listing the GSAs in project %q: %w", project, err)
+	}
+	return gsas, nil
+}
+
+// GetGSAsRolesOnProject returns the roles granted directly to the GSA on the project.
+func GetGSAsRolesOnProject(ctx context.Context, opts []option.ClientOption, project, gsaEmail string, policyVersion int64) ([]string, error) {
+	iamPolicy, err := GetProjectIAMPolicy(ctx, opts, project, policyVersion)
+	if err != nil {
+		return []string{}, err
+	}
+	return GSARolesInPolicy(iamPolicy, gsaEmail), nil
+}
+
+// GetProjectIAMPolicy returns the IAM policy of the project.
+func GetProjectIAMPolicy(ctx context.Context, opts []option.ClientOption, project string, policyVersion int64) (*cloudresourcemanager.Policy, error) {
+	crmSVC, err := cloudresourcemanager.NewService(ctx, apiOptions(opts, CloudResourceManagerAPI)...)
+	if err != nil {
+		return nil, fmt.Errorf("creating CloudResourceManager.Service: %w", err)
+	}
+	projSVC := cloudresourcemanager.NewProjectsService(crmSVC)
+	iamPolicy, err := projSVC.GetIamPolicy(project, &cloudresourcemanager.GetIamPolicyRequest{
+		Options: &cloudresourcemanager.GetPolicyOptions{
+			RequestedPolicyVersion: policyVersion,
+		},
+	}).Do()
+	if err != nil {
+		return nil, fmt.Errorf("getting Project %q IAMPolicy: %w", project, err)
+	}
+	return iamPolicy, nil
+}
+
+// GSARolesInPolicy returns the roles the project's IAM policy grants directly to the GSA.
+func GSARolesInPolicy(iamPolicy *cloudresourcemanager.Policy, gsaEmail string) []string {
+	return MemberRolesInPolicy(iamPolicy, GSAIAMPolicyMember(gsaEmail))
+}
+
+// MemberRolesInPolicy returns the roles the project's IAM policy grants directly to the member.
+func MemberRolesInPolicy(iamPolicy *cloudresourcemanager.Policy, policyMember string) []string {
+	var roles []string
+	for _, binding := range iamPolicy.Bindings {
+		for _, member := range binding.Members {
+			if member == policyMember {
+				roles = append(roles, binding.Role)
+				break
+			}
+		}
+	}
+	return roles
+}
+
+// matchingRolesInPolicy is like MemberRolesInPolicy, for every member that matches, such as the
+// forms of a KSA's member. It also returns the members that were granted the roles.
+func matchingRolesInPolicy(iamPolicy *cloudresourcemanager.Policy, matches func(member string) bool) (roles, members []string) {
+	for _, binding := range iamPolicy.Bindings {
+		for _, member := range binding.Members {
+			if matches(member) {
+				roles = append(roles, binding.Role)
+				if !contains(members, member) {
+					members = append(members, member)
+				}
+				break
+			}
+		}
+	}
+	return roles, members
+}
+
+// GenerateGSAAccessToken mints a short-lived access token for the GSA with the caller's credentials,
+// which need roles/iam.serviceAccountTokenCreator on the GSA. The token itself is discarded, only its
+// expiry time is returned.
+func GenerateGSAAccessToken(ctx context.Context, opts []option.ClientOption, gsaEmail string) (string, error) {
+	credsSVC, err := iamcredentials.NewService(ctx, apiOptions(opts, IAMCredentialsAPI)...)
+	if err != nil {
+		return "", fmt.Errorf("creating IAMCredentials.Service: %w", err)
+	}
+	gsaAPIResource := GSAAPIResource(gsaEmail)
+	resp, err := credsSVC.Projects.ServiceAccounts.GenerateAccessToken(gsaAPIResource, &iamcredentials.GenerateAccessTokenRequest{
+		Scope:    []string{"https://www.googleapis.com/auth/cloud-platform"},
+		Lifetime: "300s",
+	}).Do()
+	if err != nil {
+		return "", fmt.Errorf("generating an access token for GSA %q: %w", gsaAPIResource, err)
+	}
+	return resp.ExpireTime, nil
+}
+
+// GetProject returns the project with the given ID or number, e.g. for its number, lifecycle state
+// or parent.
+func GetProject(ctx context.Context, opts []option.ClientOption, project string) (*cloudresourcemanager.Project, error) {
+	crmSVC, err := cloudresourcemanager.NewService(ctx, apiOptions(opts, CloudResourceManagerAPI)...)
+	if err != nil {
+		return nil, fmt.Errorf("creating CloudResourceManager.Service: %w", err)
+	}
+	p, err := cloudresourcemanager.NewProjectsService(crmSVC).Get(project).Do()
+	if err != nil {
+		return nil, fmt.Errorf("getting Project %q: %w", project, err)
+	}
+	return p, nil
+}
+
+// isProjectNumber reports whether the project reference is a project number rather than an ID.
+// Project IDs must start with a letter, so a reference that is all digits is a number.
+func isProjectNumber(project string) bool {
+	if project == "" {
+		return false
+	}
+	for _, r := range project {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// DescribeProject describes the project's display name and where it sits in the resource hierarchy.
+func DescribeProject(p *cloudresourcemanager.Project) string {
+	parent := "no parent"
+	if p.Parent != nil {
+		parent = fmt.Sprintf("%s %q", p.Parent.Type, p.Parent.Id)
+	}
+	return fmt.Sprintf("Project %q is %q (number %d), whose parent is %s", p.ProjectId, p.Name, p.ProjectNumber, parent)
+}
@@ -0,0 +1,192 @@
+package diagnose
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"google.golang.org/api/option"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// fakeAPI serves the canned JSON responses, keyed by "METHOD PATH", and a 404 for any other request.
+// It returns the options that point the API's clients at it.
+func fakeAPI(t *testing.T, api string, responses map[string]string) []option.ClientOption {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, present := responses[r.Method+" "+r.URL.Path]
+		w.Header().Set("Content-Type", "application/json")
+		if !present {
+			w.WriteHeader(http.StatusNotFound)
+			body = `{"error": {"code": 404, "message": "not found"}}`
+		}
+		io.WriteString(w, body)
+	}))
+	t.Cleanup(server.Close)
+	return []option.ClientOption{WithAPIEndpoint(api, server.URL+"/"), option.WithoutAuthentication()}
+}
+
+func TestGetWIPool(t *testing.T) {
+	opts := fakeAPI(t, ContainerAPI, map[string]string{
+		"GET /v1/projects/my-project/locations/us-central1/clusters/my-cluster": `{
+			"name": "my-cluster",
+			"workloadIdentityConfig": {"workloadPool": "my-project.svc.id.goog"}
+		}`,
+		"GET /v1/projects/my-project/locations/us-central1/clusters/no-wi": `{"name": "no-wi"}`,
+	})
+	for cluster, want := range map[string]string{
+		"my-cluster": "my-project.svc.id.goog",
+		"no-wi":      "",
+	} {
+		got, err := GetWIPool(context.Background(), opts, ClusterAPIName("my-project", "us-central1", cluster))
+		if err != nil {
+			t.Fatalf("GetWIPool(%q): %v", cluster, err)
+		}
+		if got != want {
+			t.Errorf("GetWIPool(%q) = %q, want %q", cluster, got, want)
+		}
+	}
+}
+
+func TestGetWIPoolNotFound(t *testing.T) {
+	opts := fakeAPI(t, ContainerAPI, map[string]string{})
+	if _, err := GetWIPool(context.Background(), opts, ClusterAPIName("my-project", "us-central1", "missing")); err == nil {
+		t.Error("GetWIPool of a missing cluster succeeded, want an error")
+	}
+}
+
+func TestKSAAccessFromAPI(t *testing.T) {
+	opts := fakeAPI(t, IAMAPI, map[string]string{
+		"POST /v1/projects/-/serviceAccounts/app@my-project.iam.gserviceaccount.com:getIamPolicy": `{
+			"version": 3,
+			"bindings": [
+				{"role": "roles/iam.serviceAccountTokenCreator", "members": ["serviceAccount:my-project.svc.id.goog[my-ns/agent]"]},
+				{"role": "roles/iam.workloadIdentityUser", "members": [
+					"user:someone@example.com",
+					"serviceAccount:my-project.svc.id.goog[my-ns/agent]"
+				]}
+			]
+		}`,
+	})
+	policy, err := GetGSAIAMPolicy(context.Background(), opts, "app@my-project.iam.gserviceaccount.com", 3)
+	if err != nil {
+		t.Fatalf("GetGSAIAMPolicy: %v", err)
+	}
+	role, member, ok := KSAAccess(policy, "my-project.svc.id.goog", "my-ns", "agent")
+	if !ok || role != "roles/iam.workloadIdentityUser" || member != "serviceAccount:my-project.svc.id.goog[my-ns/agent]" {
+		t.Errorf("KSAAccess = %q, %q, %v, want the workloadIdentityUser binding", role, member, ok)
+	}
+	if _, _, ok := KSAAccess(policy, "my-project.svc.id.goog", "my-ns", "other"); ok {
+		t.Error("KSAAccess of an unbound KSA = true, want false")
+	}
+}
+
+func TestGetProjectIAMPolicy(t *testing.T) {
+	opts := fakeAPI(t, CloudResourceManagerAPI, map[string]string{
+		"POST /v1/projects/my-project:getIamPolicy": `{
+			"version": 3,
+			"bindings": [
+				{"role": "roles/storage.objectViewer", "members": ["serviceAccount:app@my-project.iam.gserviceaccount.com"]},
+				{"role": "roles/logging.logWriter", "members": [
+					"serviceAccount:other@my-project.iam.gserviceaccount.com",
+					"serviceAccount:app@my-project.iam.gserviceaccount.com"
+				]},
+				{"role": "roles/owner", "members": ["user:someone@example.com"]}
+			]
+		}`,
+	})
+	policy, err := GetProjectIAMPolicy(context.Background(), opts, "my-project", 3)
+	if err != nil {
+		t.Fatalf("GetProjectIAMPolicy: %v", err)
+	}
+	want := []string{"roles/storage.objectViewer", "roles/logging.logWriter"}
+	if got := GSARolesInPolicy(policy, "app@my-project.iam.gserviceaccount.com"); !reflect.DeepEqual(got, want) {
+		t.Errorf("GSARolesInPolicy = %v, want %v", got, want)
+	}
+}
+
+func TestListProjectGSAsPages(t *testing.T) {
+	pages := map[string]string{
+		"":       `{"accounts": [{"email": "a@my-project.iam.gserviceaccount.com"}, {"email": "b@my-project.iam.gserviceaccount.com"}], "nextPageToken": "page-2"}`,
+		"page-2": `{"accounts": [{"email": "c@my-project.iam.gserviceaccount.com"}]}`,
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, present := pages[r.URL.Query().Get("pageToken")]
+		if r.URL.Path != "/v1/projects/my-project/serviceAccounts" || !present {
+			t.Errorf("unexpected request %s", r.URL)
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, body)
+	}))
+	defer server.Close()
+	opts := []option.ClientOption{WithAPIEndpoint(IAMAPI, server.URL+"/"), option.WithoutAuthentication()}
+
+	got, err := ListProjectGSAs(context.Background(), opts, "my-project")
+	if err != nil {
+		t.Fatalf("ListProjectGSAs: %v", err)
+	}
+	want := []string{"a@my-project.iam.gserviceaccount.com", "b@my-project.iam.gserviceaccount.com", "c@my-project.iam.gserviceaccount.com"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ListProjectGSAs = %v, want the GSAs of both pages %v", got, want)
+	}
+}
+
+func TestFindClusterByLabels(t *testing.T) {
+	opts := fakeAPI(t, ContainerAPI, map[string]string{
+		"GET /v1/projects/my-project/locations/-/clusters": `{"clusters": [
+			{"name": "prod", "location": "us-central1", "resourceLabels": {"env": "prod"}},
+			{"name": "dev", "location": "us-east1", "resourceLabels": {"env": "dev"}}
+		]}`,
+		"GET /v1/projects/partial/locations/-/clusters": `{"clusters": [], "missingZones": ["us-west1-a"]}`,
+	})
+	cluster, err := FindClusterByLabels(context.Background(), opts, "my-project", labels.SelectorFromSet(labels.Set{"env": "dev"}))
+	if err != nil {
+		t.Fatalf("FindClusterByLabels: %v", err)
+	}
+	if cluster.Name != "dev" {
+		t.Errorf("FindClusterByLabels = %q, want dev", cluster.Name)
+	}
+	if _, err := FindClusterByLabels(context.Background(), opts, "my-project", labels.Everything()); err == nil {
+		t.Error("FindClusterByLabels matching two clusters succeeded, want an error")
+	}
+	if _, err := FindClusterByLabels(context.Background(), opts, "partial", labels.Everything()); err == nil {
+		t.Error("FindClusterByLabels with missing zones succeeded, want an error")
+	}
+}
+
+func TestGetFleetMembership(t *testing.T) {
+	opts := fakeAPI(t, GKEHubAPI, map[string]string{
+		"GET /v1/projects/my-project/locations/global/memberships/my-membership": `{
+			"name": "projects/my-project/locations/global/memberships/my-membership",
+			"authority": {"workloadIdentityPool": "my-project.svc.id.goog"}
+		}`,
+	})
+	m, err := GetFleetMembership(context.Background(), opts, "projects/my-project/locations/global/memberships/my-membership")
+	if err != nil {
+		t.Fatalf("GetFleetMembership: %v", err)
+	}
+	if m.Authority == nil || m.Authority.WorkloadIdentityPool != "my-project.svc.id.goog" {
+		t.Errorf("GetFleetMembership = %+v, want the fleet's WI pool", m)
+	}
+}
+
+func TestGenerateGSAAccessToken(t *testing.T) {
+	opts := fakeAPI(t, IAMCredentialsAPI, map[string]string{
+		"POST /v1/projects/-/serviceAccounts/app-sa@my-project.iam.gserviceaccount.com:generateAccessToken": `{
+			"accessToken": "token",
+			"expireTime": "2023-01-01T00:05:00Z"
+		}`,
+	})
+	expiry, err := GenerateGSAAccessToken(context.Background(), opts, "app-sa@my-project.iam.gserviceaccount.com")
+	if err != nil {
+		t.Fatalf("GenerateGSAAccessToken: %v", err)
+	}
+	if expiry != "2023-01-01T00:05:00Z" {
+		t.Errorf("GenerateGSAAccessToken = %q, want the token's expiry", expiry)
+	}
+}
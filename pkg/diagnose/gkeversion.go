@@ -0,0 +1,54 @@
+package diagnose
+
+import (
+	"strconv"
+	"strings"
+)
+
+// minGKEVersions are the minimum GKE versions known to support each WI feature the diagnosis relies
+// on. Both the control plane and the node pools must be at least at the minimum.
+var minGKEVersions = []struct {
+	feature string
+	version string
+}{
+	// WI became generally available, serving GSA tokens from the GKE metadata server.
+	{feature: "Workload Identity", version: "1.13.7-gke.8"},
+}
+
+// gkeVersionLess reports whether GKE version a, e.g. "1.27.3-gke.100", is older than b. Versions that
+// can't be parsed are never less, so an unexpected version format doesn't cause a false warning.
+func gkeVersionLess(a, b string) bool {
+	av, aOK := parseGKEVersion(a)
+	bv, bOK := parseGKEVersion(b)
+	if !aOK || !bOK {
+		return false
+	}
+	for i := range av {
+		if av[i] != bv[i] {
+			return av[i] < bv[i]
+		}
+	}
+	return false
+}
+
+// parseGKEVersion parses a GKE version, MAJOR.MINOR.PATCH-gke.N, into its four numbers. The -gke.N
+// suffix is optional.
+func parseGKEVersion(v string) ([4]int, bool) {
+	var parsed [4]int
+	semver, gke := v, "0"
+	if i := strings.Index(v, "-gke."); i >= 0 {
+		semver, gke = v[:i], v[i+len("-gke."):]
+	}
+	parts := strings.Split(semver, ".")
+	if len(parts) != 3 {
+		return parsed, false
+	}
+	for i, p := range append(parts, gke) {
+		n, err := strconv.Atoi(p)
+		if err != nil {
+			return parsed, false
+		}
+		parsed[i] = n
+	}
+	return parsed, true
+}
@@ -0,0 +1,150 @@
+package diagnose
+
+import (
+	"context"
+	"strings"
+
+	"google.golang.org/api/iam/v1"
+	"google.golang.org/api/option"
+)
+
+// tokenCreatorRole is the role that lets one GSA impersonate another.
+const tokenCreatorRole = "roles/iam.serviceAccountTokenCreator"
+
+// DefaultMaxImpersonationDepth is how many impersonation hops FollowImpersonation follows by default.
+const DefaultMaxImpersonationDepth = 5
+
+// The reasons an ImpersonationChain was cut short.
+const (
+	// ImpersonationCycle stops a chain whose last GSA appears earlier in it.
+	ImpersonationCycle = "cycle"
+	// ImpersonationMaxDepth stops a chain whose last GSA can impersonate more GSAs, beyond the
+	// maximum depth.
+	ImpersonationMaxDepth = "max-depth"
+)
+
+// ImpersonationChain is a sequence of GSAs, each of which can impersonate the next.
+type ImpersonationChain struct {
+	GSAs []string `json:"gsas"`
+	// Stop is why the chain was not followed further, if it was cut short: ImpersonationCycle or
+	// ImpersonationMaxDepth.
+	Stop string `json:"stop,omitempty"`
+}
+
+func (c ImpersonationChain) String() string {
+	s := strings.Join(c.GSAs, " -> ")
+	switch c.Stop {
+	case ImpersonationCycle:
+		s += " (cycle, not followed further)"
+	case ImpersonationMaxDepth:
+		s += " (depth limit reached, not followed further)"
+	}
+	return s
+}
+
+// FollowImpersonation returns the chains of GSAs that the GSA can impersonate, directly or through
+// other GSAs, by being granted roles/iam.serviceAccountTokenCreator on them. Only the GSAs in each
+// GSA's own project are considered. Chains are followed for at most maxDepth hops, and cycles are
+// cut where they close.
+func FollowImpersonation(ctx context.Context, opts []option.ClientOption, gsaEmail string, maxDepth int, policyVersion int64) ([]ImpersonationChain, error) {
+	f := &impersonationFollower{
+		opts:          opts,
+		policyVersion: policyVersion,
+		maxDepth:      maxDepth,
+		projectGSAs:   map[string][]string{},
+		policies:      map[string]*iam.Policy{},
+	}
+	if err := f.follow(ctx, []string{gsaEmail}); err != nil {
+		return nil, err
+	}
+	return f.chains, nil
+}
+
+// impersonationFollower remembers the GSAs listed in each project and each GSA's policy, so each is
+// only read once however many chains lead through it.
+type impersonationFollower struct {
+	opts          []option.ClientOption
+	policyVersion int64
+	maxDepth      int
+	projectGSAs   map[string][]string
+	policies      map[string]*iam.Policy
+	chains        []ImpersonationChain
+}
+
+// follow extends the chain with every GSA its last GSA can impersonate.
+func (f *impersonationFollower) follow(ctx context.Context, chain []string) error {
+	targets, err := f.impersonatable(ctx, chain[len(chain)-1])
+	if err != nil {
+		return err
+	}
+	if len(targets) == 0 {
+		if len(chain) > 1 {
+			f.chains = append(f.chains, ImpersonationChain{GSAs: chain})
+		}
+		return nil
+	}
+	if len(chain)-1 >= f.maxDepth {
+		f.chains = append(f.chains, ImpersonationChain{GSAs: chain, Stop: ImpersonationMaxDepth})
+		return nil
+	}
+	for _, target := range targets {
+		next := append(append([]string(nil), chain...), target)
+		if contains(chain, target) {
+			f.chains = append(f.chains, ImpersonationChain{GSAs: next, Stop: ImpersonationCycle})
+			continue
+		}
+		if err := f.follow(ctx, next); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// impersonatable returns the GSAs in the GSA's project that grant it roles/iam.serviceAccountTokenCreator.
+func (f *impersonationFollower) impersonatable(ctx context.Context, gsaEmail string) ([]string, error) {
+	project, ok := GSAProject(gsaEmail)
+	if !ok {
+		return nil, nil
+	}
+	gsas, present := f.projectGSAs[project]
+	if !present {
+		var err error
+		gsas, err = ListProjectGSAs(ctx, f.opts, project)
+		if err != nil {
+			return nil, err
+		}
+		f.projectGSAs[project] = gsas
+	}
+	member := "serviceAccount:" + gsaEmail
+	var targets []string
+	for _, target := range gsas {
+		if target == gsaEmail {
+			continue
+		}
+		policy, present := f.policies[target]
+		if !present {
+			var err error
+			policy, err = GetGSAIAMPolicy(ctx, f.opts, target, f.policyVersion)
+			if err != nil {
+				return nil, err
+			}
+			f.policies[target] = policy
+		}
+		for _, binding := range policy.Bindings {
+			if binding.Role == tokenCreatorRole && contains(binding.Members, member) {
+				targets = append(targets, target)
+				break
+			}
+		}
+	}
+	return targets, nil
+}
+
+func contains(s []string, v string) bool {
+	for _, e := range s {
+		if e == v {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,110 @@
+package diagnose
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"google.golang.org/api/cloudresourcemanager/v1"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/iam/v1"
+	"google.golang.org/api/option"
+)
+
+// disableKeyCreationConstraint is the org policy constraint that stops keys being created for the
+// GSAs of the projects it is enforced on.
+const disableKeyCreationConstraint = "constraints/iam.disableServiceAccountKeyCreation"
+
+// ListUserManagedKeys returns the GSA's user-managed keys that are not disabled. Unlike the
+// system-managed keys Google rotates, these are downloaded, and can leak.
+func ListUserManagedKeys(ctx context.Context, opts []option.ClientOption, gsaEmail string) ([]*iam.ServiceAccountKey, error) {
+	iamSVC, err := iam.NewService(ctx, apiOptions(opts, IAMAPI)...)
+	if err != nil {
+		return nil, fmt.Errorf("creating IAM.Service: %w", err)
+	}
+	resp, err := iam.NewProjectsServiceAccountsKeysService(iamSVC).List(GSAAPIResource(gsaEmail)).KeyTypes("USER_MANAGED").Do()
+	if err != nil {
+		return nil, fmt.Errorf("listing the keys of GSA %q: %w", gsaEmail, err)
+	}
+	var keys []*iam.ServiceAccountKey
+	for _, k := range resp.Keys {
+		if !k.Disabled {
+			keys = append(keys, k)
+		}
+	}
+	return keys, nil
+}
+
+// KeyCreationDisabled returns whether the iam.disableServiceAccountKeyCreation org policy is
+// enforced on the project, whether set on the project itself or inherited from its folders or
+// organization.
+func KeyCreationDisabled(ctx context.Context, opts []option.ClientOption, project string) (bool, error) {
+	crmSVC, err := cloudresourcemanager.NewService(ctx, apiOptions(opts, CloudResourceManagerAPI)...)
+	if err != nil {
+		return false, fmt.Errorf("creating CloudResourceManager.Service: %w", err)
+	}
+	policy, err := cloudresourcemanager.NewProjectsService(crmSVC).GetEffectiveOrgPolicy("projects/"+project,
+		&cloudresourcemanager.GetEffectiveOrgPolicyRequest{Constraint: disableKeyCreationConstraint}).Do()
+	if err != nil {
+		return false, fmt.Errorf("getting the effective %s policy of project %q: %w", disableKeyCreationConstraint, project, err)
+	}
+	return policy.BooleanPolicy != nil && policy.BooleanPolicy.Enforced, nil
+}
+
+var gsaKeysCheck = &check{
+	name:        "gsa-keys",
+	description: "The GSA has no user-managed keys, which WI makes unnecessary, and key creation is disabled by org policy.",
+	severity:    StatusWarn,
+	run: func(ctx context.Context, in *Input) (CheckResult, error) {
+		switch {
+		case !in.CheckGSAKeys:
+			return Skip(SkipNotEnabled), nil
+		case in.GSA == "":
+			return Skip("the KSA's GSA is unknown"), nil
+		}
+		keys, err := ListUserManagedKeys(ctx, in.GCPOptions, in.GSA)
+		if err != nil {
+			return CheckResult{}, err
+		}
+
+		// The policy only tells whether more keys can be created, so not being allowed to read it
+		// doesn't stop the keys being reported.
+		policy := ""
+		if project, ok := GSAProject(in.GSA); ok {
+			disabled, err := KeyCreationDisabled(ctx, in.GCPOptions, project)
+			var apiErr *googleapi.Error
+			switch {
+			case errors.As(err, &apiErr) && apiErr.Code == http.StatusForbidden:
+				policy = fmt.Sprintf("whether key creation is disabled on project %q is unknown, as its org policy can't be read", project)
+			case err != nil:
+				return CheckResult{}, err
+			case disabled:
+				policy = fmt.Sprintf("key creation is disabled on project %q by the iam.disableServiceAccountKeyCreation org policy", project)
+			default:
+				policy = fmt.Sprintf("key creation is not disabled on project %q by the iam.disableServiceAccountKeyCreation org policy", project)
+			}
+		}
+
+		if len(keys) == 0 {
+			if policy == "" {
+				return Pass("GSA %q has no user-managed keys", in.GSA), nil
+			}
+			return Pass("GSA %q has no user-managed keys, and %s", in.GSA, policy), nil
+		}
+		ids := make([]string, 0, len(keys))
+		for _, k := range keys {
+			ids = append(ids, k.Name[strings.LastIndex(k.Name, "/")+1:])
+		}
+		msg := fmt.Sprintf("GSA %q, used through WI, has %d user-managed keys, %s, which can leak and are not needed", in.GSA, len(keys), strings.Join(ids, ", "))
+		if policy != "" {
+			msg += "; " + policy
+		}
+		cr := CheckResult{Status: StatusWarn, Message: msg}
+		for _, id := range ids {
+			cr = cr.WithRemediation(in.GSA, DeleteGSAKeyCommand(id, in.GSA))
+		}
+		return cr, nil
+	},
+}
@@ -0,0 +1,199 @@
+package diagnose
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// GetPodKSA returns the KSA used by the Pod.
+func GetPodKSA(ctx context.Context, client kubernetes.Interface, ns, podName string) (string, error) {
+	pod, err := client.CoreV1().Pods(ns).Get(ctx, podName, v1.GetOptions{})
+	if err != nil {
+		return "", err
+	}
+	return pod.Spec.ServiceAccountName, nil
+}
+
+// listPageSize is the number of objects requested per page when listing from the Kubernetes API.
+const listPageSize = 500
+
+// GetPodsKSAs returns the KSA used by each of the Pods in the namespace, using paged List calls.
+// Pods are selected by the label selector and, if podNames is not empty, by name. The names of
+// requested Pods that no longer exist are returned separately.
+func GetPodsKSAs(ctx context.Context, client kubernetes.Interface, ns string, podNames []string, selector string) (map[string]string, []string, error) {
+	wanted := make(map[string]struct{}, len(podNames))
+	for _, name := range podNames {
+		wanted[name] = struct{}{}
+	}
+	podKSAs := map[string]string{}
+	opts := v1.ListOptions{LabelSelector: selector, Limit: listPageSize}
+	for {
+		podList, err := client.CoreV1().Pods(ns).List(ctx, opts)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, pod := range podList.Items {
+			if _, present := wanted[pod.Name]; len(wanted) > 0 && !present {
+				continue
+			}
+			podKSAs[pod.Name] = pod.Spec.ServiceAccountName
+		}
+		if opts.Continue = podList.Continue; opts.Continue == "" {
+			break
+		}
+	}
+	var missing []string
+	for _, name := range podNames {
+		if _, present := podKSAs[name]; !present {
+			missing = append(missing, name)
+		}
+	}
+	return podKSAs, missing, nil
+}
+
+// GetDeploymentKSA returns the KSA used by the Deployment's Pods.
+func GetDeploymentKSA(ctx context.Context, client kubernetes.Interface, ns, deploymentName string) (string, error) {
+	deployment, err := client.AppsV1().Deployments(ns).Get(ctx, deploymentName, v1.GetOptions{})
+	if err != nil {
+		return "", err
+	}
+	if ksa := deployment.Spec.Template.Spec.ServiceAccountName; ksa != "" {
+		return ksa, nil
+	}
+	return "default", nil
+}
+
+// GetAnnotatedKSAs returns the GSA each KSA in the namespace with the WI annotation is linked to,
+// using paged List calls.
+func GetAnnotatedKSAs(ctx context.Context, client kubernetes.Interface, ns string) (map[string]string, error) {
+	ksaGSAs := map[string]string{}
+	opts := v1.ListOptions{Limit: listPageSize}
+	for {
+		saList, err := client.CoreV1().ServiceAccounts(ns).List(ctx, opts)
+		if err != nil {
+			return nil, err
+		}
+		for _, sa := range saList.Items {
+			if gsa, present := sa.Annotations[WIGSAAnnotation]; present {
+				ksaGSAs[sa.Name] = CleanGSAAnnotation(gsa)
+			}
+		}
+		if opts.Continue = saList.Continue; opts.Continue == "" {
+			break
+		}
+	}
+	return ksaGSAs, nil
+}
+
+// GetKSAsAnnotatedWith returns the names of the KSAs in the namespace whose WI annotation links them
+// to the GSA, sorted.
+func GetKSAsAnnotatedWith(ctx context.Context, client kubernetes.Interface, ns, gsa string) ([]string, error) {
+	ksaGSAs, err := GetAnnotatedKSAs(ctx, client, ns)
+	if err != nil {
+		return nil, err
+	}
+	var ksas []string
+	for ksa, annotated := range ksaGSAs {
+		if strings.EqualFold(annotated, gsa) {
+			ksas = append(ksas, ksa)
+		}
+	}
+	sort.Strings(ksas)
+	return ksas, nil
+}
+
+// GetKSAConsumers returns, for each KSA in the namespace that is used, the Pods and controllers using
+// it, as KIND/NAME. Controllers are included so KSAs of Deployments scaled to zero, or CronJobs
+// between runs, are not mistaken for unused ones.
+func GetKSAConsumers(ctx context.Context, client kubernetes.Interface, ns string) (map[string][]string, error) {
+	consumers := map[string][]string{}
+	add := func(ksa, kind, name string) {
+		if ksa == "" {
+			ksa = "default"
+		}
+		consumers[ksa] = append(consumers[ksa], kind+"/"+name)
+	}
+	lists := []struct {
+		kind string
+		list func(opts v1.ListOptions) (string, error)
+	}{
+		{"Pod", func(opts v1.ListOptions) (string, error) {
+			l, err := client.CoreV1().Pods(ns).List(ctx, opts)
+			if err != nil {
+				return "", err
+			}
+			for _, o := range l.Items {
+				add(o.Spec.ServiceAccountName, "Pod", o.Name)
+			}
+			return l.Continue, nil
+		}},
+		{"Deployment", func(opts v1.ListOptions) (string, error) {
+			l, err := client.AppsV1().Deployments(ns).List(ctx, opts)
+			if err != nil {
+				return "", err
+			}
+			for _, o := range l.Items {
+				add(o.Spec.Template.Spec.ServiceAccountName, "Deployment", o.Name)
+			}
+			return l.Continue, nil
+		}},
+		{"StatefulSet", func(opts v1.ListOptions) (string, error) {
+			l, err := client.AppsV1().StatefulSets(ns).List(ctx, opts)
+			if err != nil {
+				return "", err
+			}
+			for _, o := range l.Items {
+				add(o.Spec.Template.Spec.ServiceAccountName, "StatefulSet", o.Name)
+			}
+			return l.Continue, nil
+		}},
+		{"DaemonSet", func(opts v1.ListOptions) (string, error) {
+			l, err := client.AppsV1().DaemonSets(ns).List(ctx, opts)
+			if err != nil {
+				return "", err
+			}
+			for _, o := range l.Items {
+				add(o.Spec.Template.Spec.ServiceAccountName, "DaemonSet", o.Name)
+			}
+			return l.Continue, nil
+		}},
+		{"Job", func(opts v1.ListOptions) (string, error) {
+			l, err := client.BatchV1().Jobs(ns).List(ctx, opts)
+			if err != nil {
+				return "", err
+			}
+			for _, o := range l.Items {
+				add(o.Spec.Template.Spec.ServiceAccountName, "Job", o.Name)
+			}
+			return l.Continue, nil
+		}},
+		{"CronJob", func(opts v1.ListOptions) (string, error) {
+			l, err := client.BatchV1().CronJobs(ns).List(ctx, opts)
+			if err != nil {
+				return "", err
+			}
+			for _, o := range l.Items {
+				add(o.Spec.JobTemplate.Spec.Template.Spec.ServiceAccountName, "CronJob", o.Name)
+			}
+			return l.Continue, nil
+		}},
+	}
+	for _, l := range lists {
+		opts := v1.ListOptions{Limit: listPageSize}
+		for {
+			next, err := l.list(opts)
+			if err != nil {
+				return nil, fmt.Errorf("listing the %ss: %w", l.kind, err)
+			}
+			if opts.Continue = next; opts.Continue == "" {
+				break
+			}
+		}
+	}
+	return consumers, nil
+}
@@ -0,0 +1,144 @@
+package diagnose
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"google.golang.org/api/option"
+	"google.golang.org/api/recommender/v1"
+)
+
+// iamRecommender is the Recommender that suggests smaller roles, based on the permissions a
+// principal used over the last 90 days.
+const iamRecommender = "google.iam.policy.Recommender"
+
+// RoleRecommendation is an IAM Recommender suggestion to replace some of a GSA's roles on a project
+// with others that cover the permissions it actually uses. Add is empty if the roles are unused.
+type RoleRecommendation struct {
+	Description string
+	Remove      []string
+	Add         []string
+}
+
+// GetRoleRecommendations returns the IAM Recommender's active suggestions for the GSA's roles on the
+// project. The Recommender API must be enabled in the project.
+func GetRoleRecommendations(ctx context.Context, opts []option.ClientOption, project, gsaEmail string) ([]RoleRecommendation, error) {
+	recSVC, err := recommender.NewService(ctx, apiOptions(opts, RecommenderAPI)...)
+	if err != nil {
+		return nil, fmt.Errorf("creating Recommender.Service: %w", err)
+	}
+	parent := fmt.Sprintf("projects/%s/locations/global/recommenders/%s", project, iamRecommender)
+	member := GSAIAMPolicyMember(gsaEmail)
+	var recs []RoleRecommendation
+	err = recSVC.Projects.Locations.Recommenders.Recommendations.List(parent).Filter("stateInfo.state = ACTIVE").Pages(ctx,
+		func(resp *recommender.GoogleCloudRecommenderV1ListRecommendationsResponse) error {
+			for _, r := range resp.Recommendations {
+				if rec, ok := roleRecommendation(r, member); ok {
+					recs = append(recs, rec)
+				}
+			}
+			return nil
+		})
+	if err != nil {
+		return nil, fmt.Errorf("listing the IAM recommendations in %q: %w", parent, err)
+	}
+	return recs, nil
+}
+
+// roleRecommendation returns the roles the recommendation removes from and adds to the member. It
+// returns false if the recommendation is about other members.
+func roleRecommendation(r *recommender.GoogleCloudRecommenderV1Recommendation, member string) (RoleRecommendation, bool) {
+	rec := RoleRecommendation{Description: r.Description}
+	if r.Content == nil {
+		return rec, false
+	}
+	for _, group := range r.Content.OperationGroups {
+		for _, op := range group.Operations {
+			var filters map[string]interface{}
+			if err := json.Unmarshal(op.PathFilters, &filters); err != nil {
+				continue
+			}
+			role, _ := filters["/iamPolicy/bindings/*/role"].(string)
+			switch op.Action {
+			case "remove":
+				if filters["/iamPolicy/bindings/*/members/*"] == member {
+					rec.Remove = append(rec.Remove, role)
+				}
+			case "add":
+				if op.Value == member {
+					rec.Add = append(rec.Add, role)
+				}
+			}
+		}
+	}
+	return rec, len(rec.Remove) > 0
+}
+
+// isBasicRole reports whether the role is one of the basic roles, owner, editor and viewer, which
+// grant permissions on nearly every service in the project.
+func isBasicRole(role string) bool {
+	return IsPrimitiveRole(role) || role == "roles/viewer"
+}
+
+var leastPrivilegeCheck = &check{
+	name:        "least-privilege",
+	description: "The GSA has no basic roles on the project, or roles the IAM Recommender would replace with smaller ones.",
+	severity:    StatusWarn,
+	run: func(ctx context.Context, in *Input) (CheckResult, error) {
+		switch {
+		case !in.CheckLeastPrivilege:
+			return Skip(SkipNotEnabled), nil
+		case in.NodeGSA != "":
+			return Skip("the KSA's workloads run as the node's GSA"), nil
+		case in.GSA == "":
+			return Skip("the KSA's GSA is unknown"), nil
+		}
+		policy, err := in.ProjectPolicy(ctx)
+		if err != nil {
+			return CheckResult{}, err
+		}
+		project := in.RolesProject()
+		var basic []string
+		for _, role := range GSARolesInPolicy(policy, in.GSA) {
+			if isBasicRole(role) {
+				basic = append(basic, role)
+			}
+		}
+		var findings []string
+		if len(basic) > 0 {
+			findings = append(findings, fmt.Sprintf("GSA %q has the basic roles %v on project %q, which grant nearly every permission in it; grant predefined roles covering only what the workloads use instead",
+				in.GSA, basic, project))
+		}
+		recs, recErr := GetRoleRecommendations(ctx, in.GCPOptions, project, in.GSA)
+		var remediations []string
+		for _, rec := range recs {
+			finding := fmt.Sprintf("the IAM Recommender suggests replacing %v with %v", rec.Remove, rec.Add)
+			if len(rec.Add) == 0 {
+				finding = fmt.Sprintf("the IAM Recommender suggests removing the unused %v", rec.Remove)
+			}
+			findings = append(findings, finding)
+			for _, role := range rec.Add {
+				remediations = append(remediations, GrantProjectRoleCommand(project, role, in.GSA))
+			}
+			for _, role := range rec.Remove {
+				remediations = append(remediations, RevokeProjectRoleCommand(project, role, in.GSA))
+			}
+		}
+		if len(findings) == 0 {
+			if recErr != nil {
+				return CheckResult{}, recErr
+			}
+			return Pass("GSA %q has no basic roles on project %q, and the IAM Recommender has no smaller roles to suggest", in.GSA, project), nil
+		}
+		if recErr != nil {
+			findings = append(findings, fmt.Sprintf("no IAM Recommender suggestions, which need the Recommender API: %v", recErr))
+		}
+		cr := Warn("%s", strings.Join(findings, "; "))
+		for _, command := range remediations {
+			cr = cr.WithRemediation(in.GSA, command)
+		}
+		return cr, nil
+	},
+}
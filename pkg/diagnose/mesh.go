@@ -0,0 +1,76 @@
+package diagnose
+
+import (
+	"context"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// istioProxyContainer is the name of the sidecar Istio and Anthos Service Mesh inject.
+const istioProxyContainer = "istio-proxy"
+
+var meshSidecarCheck = &check{
+	name:        "mesh-sidecar",
+	description: "Reports whether the KSA's Pod has an Istio or Anthos Service Mesh sidecar, whose egress identity is separate from WI's.",
+	severity:    StatusInfo,
+	run: func(ctx context.Context, in *Input) (CheckResult, error) {
+		var sidecar string
+		switch {
+		case in.Pod != "":
+			pod, err := in.Kube.CoreV1().Pods(in.Namespace).Get(ctx, in.Pod, v1.GetOptions{})
+			if err != nil {
+				return CheckResult{}, fmt.Errorf("getting the Pod: %w", err)
+			}
+			if hasContainer(pod.Spec.Containers, istioProxyContainer) || hasContainer(pod.Spec.InitContainers, istioProxyContainer) {
+				sidecar = fmt.Sprintf("has an %q sidecar", istioProxyContainer)
+			}
+		case in.Deployment != "":
+			// The sidecar is injected when the Pods are created, so only the request for it can be seen.
+			d, err := in.Kube.AppsV1().Deployments(in.Namespace).Get(ctx, in.Deployment, v1.GetOptions{})
+			if err != nil {
+				return CheckResult{}, fmt.Errorf("getting the Deployment: %w", err)
+			}
+			ns, err := in.Kube.CoreV1().Namespaces().Get(ctx, in.Namespace, v1.GetOptions{})
+			if err != nil {
+				return CheckResult{}, fmt.Errorf("getting the Namespace: %w", err)
+			}
+			if reason := sidecarInjection(d.Spec.Template.ObjectMeta, ns.Labels); reason != "" {
+				sidecar = "is likely to get an " + istioProxyContainer + " sidecar, as " + reason
+			}
+		default:
+			return Skip("no Pod or Deployment was given"), nil
+		}
+		if sidecar == "" {
+			return Pass("%s, which has no service mesh sidecar", in.Target), nil
+		}
+		return Info("%s, which %s. WI applies to the app container's own GCP calls; the sidecar's mTLS and egress use the mesh's identity, so a failure on a mesh route is not a WI problem, and vice versa",
+			in.Target, sidecar), nil
+	},
+}
+
+// sidecarInjection returns why Pods from the template get an Istio sidecar injected, or "" if there
+// is no sign that they do.
+func sidecarInjection(template v1.ObjectMeta, nsLabels map[string]string) string {
+	switch {
+	case template.Labels["sidecar.istio.io/inject"] == "false" || template.Annotations["sidecar.istio.io/inject"] == "false":
+		return ""
+	case template.Labels["sidecar.istio.io/inject"] == "true" || template.Annotations["sidecar.istio.io/inject"] == "true":
+		return "its Pod template asks for injection"
+	case nsLabels["istio-injection"] == "enabled":
+		return "its namespace has istio-injection=enabled"
+	case nsLabels["istio.io/rev"] != "":
+		return fmt.Sprintf("its namespace has istio.io/rev=%s", nsLabels["istio.io/rev"])
+	}
+	return ""
+}
+
+func hasContainer(containers []corev1.Container, name string) bool {
+	for _, c := range containers {
+		if c.Name == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,158 @@
+package diagnose
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"google.golang.org/api/container/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// nodePoolLabel is the label on GKE nodes naming their node pool.
+const nodePoolLabel = "cloud.google.com/gke-nodepool"
+
+var nodeIdentityCheck = &check{
+	name:        "node-identity",
+	description: "Reports when the KSA's workloads run as the node's GSA, because their node pools don't use WI.",
+	severity:    StatusWarn,
+	run: func(ctx context.Context, in *Input) (CheckResult, error) {
+		switch {
+		case in.AssumePool != "":
+			return Skip("assuming the cluster's WI pool is %q", in.AssumePool), nil
+		case in.WIFProvider != "":
+			return Skip("the cluster is outside of GKE, federated through %q", in.WIFProvider), nil
+		case in.ClusterAPIName == "":
+			return Skip("the cluster is reached through its fleet membership"), nil
+		}
+		cluster, err := in.Env.Cluster(ctx)
+		if err != nil {
+			return CheckResult{}, err
+		}
+		pools, err := inputNodePools(ctx, in, cluster)
+		if err != nil {
+			return CheckResult{}, err
+		}
+
+		var nodeSAPools []*container.NodePool
+		for _, np := range pools {
+			if usesNodeServiceAccount(cluster, np) {
+				nodeSAPools = append(nodeSAPools, np)
+			}
+		}
+		if len(nodeSAPools) == 0 {
+			return Pass("the KSA's node pools use WI"), nil
+		}
+		if len(nodeSAPools) < len(pools) {
+			names := make([]string, 0, len(nodeSAPools))
+			for _, np := range nodeSAPools {
+				names = append(names, fmt.Sprintf("%q", np.Name))
+			}
+			return Warn("node pools %s don't use WI, workloads scheduled there run as the node's GSA instead of the KSA's",
+				strings.Join(names, ", ")), nil
+		}
+
+		np := nodeSAPools[0]
+		gsa, err := nodeGSA(ctx, in, np)
+		if err != nil {
+			return CheckResult{}, err
+		}
+		policy, err := in.ProjectPolicy(ctx)
+		if err != nil {
+			return CheckResult{}, err
+		}
+		in.NodeGSA = gsa
+		in.Roles = in.filterRoles(GSARolesInPolicy(policy, gsa))
+		return Info("node pool %q doesn't use WI, so %s runs as the node's GSA %q, and the KSA's WI annotation is ignored",
+			np.Name, in.Target, gsa), nil
+	},
+}
+
+var hostNetworkCheck = &check{
+	name:        "host-network",
+	description: "The KSA's Pod does not use the host network, where it may bypass the GKE metadata server.",
+	severity:    StatusWarn,
+	run: func(ctx context.Context, in *Input) (CheckResult, error) {
+		var hostNetwork bool
+		switch {
+		case in.Pod != "":
+			pod, err := in.Kube.CoreV1().Pods(in.Namespace).Get(ctx, in.Pod, v1.GetOptions{})
+			if err != nil {
+				return CheckResult{}, fmt.Errorf("getting the Pod: %w", err)
+			}
+			hostNetwork = pod.Spec.HostNetwork
+		case in.Deployment != "":
+			d, err := in.Kube.AppsV1().Deployments(in.Namespace).Get(ctx, in.Deployment, v1.GetOptions{})
+			if err != nil {
+				return CheckResult{}, fmt.Errorf("getting the Deployment: %w", err)
+			}
+			hostNetwork = d.Spec.Template.Spec.HostNetwork
+		default:
+			return Skip("no Pod or Deployment was given"), nil
+		}
+		if hostNetwork {
+			return Warn("%s, which uses the host network, so its requests to the metadata server may bypass the GKE metadata server and get the node's GSA's credentials instead of the KSA's GSA's",
+				in.Target), nil
+		}
+		return Pass("%s, which does not use the host network", in.Target), nil
+	},
+}
+
+// usesNodeServiceAccount reports whether workloads in the node pool get the node's GSA from the
+// Compute Engine metadata server, rather than their KSA's GSA from the GKE metadata server.
+func usesNodeServiceAccount(cluster *container.Cluster, np *container.NodePool) bool {
+	if np.Config != nil && np.Config.WorkloadMetadataConfig != nil && np.Config.WorkloadMetadataConfig.Mode != "MODE_UNSPECIFIED" {
+		return np.Config.WorkloadMetadataConfig.Mode == "GCE_METADATA"
+	}
+	return ClusterWIPool(cluster) == ""
+}
+
+// inputNodePools returns the node pools the Input's workloads may run on: the Pod's node pool, if it
+// is scheduled on one, otherwise all of them.
+func inputNodePools(ctx context.Context, in *Input, cluster *container.Cluster) ([]*container.NodePool, error) {
+	if in.Pod != "" {
+		np, err := podNodePool(ctx, in, cluster)
+		if err != nil {
+			return nil, err
+		}
+		if np != nil {
+			return []*container.NodePool{np}, nil
+		}
+	}
+	return cluster.NodePools, nil
+}
+
+// podNodePool returns the node pool the Input's Pod is scheduled on, or nil if it is not scheduled
+// or its node is not in a node pool of the cluster.
+func podNodePool(ctx context.Context, in *Input, cluster *container.Cluster) (*container.NodePool, error) {
+	pod, err := in.Kube.CoreV1().Pods(in.Namespace).Get(ctx, in.Pod, v1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("getting the Pod: %w", err)
+	}
+	if pod.Spec.NodeName == "" {
+		return nil, nil
+	}
+	node, err := in.Kube.CoreV1().Nodes().Get(ctx, pod.Spec.NodeName, v1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("getting the Pod's Node: %w", err)
+	}
+	for _, np := range cluster.NodePools {
+		if np.Name == node.Labels[nodePoolLabel] {
+			return np, nil
+		}
+	}
+	return nil, nil
+}
+
+// nodeGSA returns the email of the GSA the node pool's nodes run as. Node pools without one use the
+// project's Compute Engine default service account.
+func nodeGSA(ctx context.Context, in *Input, np *container.NodePool) (string, error) {
+	if np.Config != nil && np.Config.ServiceAccount != "" && np.Config.ServiceAccount != "default" {
+		return np.Config.ServiceAccount, nil
+	}
+	p, err := GetProject(ctx, in.GCPOptions, in.ClusterProject)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%d-compute@developer.gserviceaccount.com", p.ProjectNumber), nil
+}
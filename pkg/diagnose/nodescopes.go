@@ -0,0 +1,49 @@
+package diagnose
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// cloudPlatformScope is the OAuth scope that lets the node's GSA use every GCP API its roles allow.
+const cloudPlatformScope = "https://www.googleapis.com/auth/cloud-platform"
+
+var nodeScopesCheck = &check{
+	name:        "node-scopes",
+	description: "Reports the OAuth scopes of the KSA's node pools, warning when WI node pools give the node's GSA broad scopes.",
+	severity:    StatusWarn,
+	run: func(ctx context.Context, in *Input) (CheckResult, error) {
+		switch {
+		case in.WIFProvider != "":
+			return Skip("the cluster is outside of GKE, federated through %q", in.WIFProvider), nil
+		case in.ClusterAPIName == "":
+			return Skip("the cluster is reached through its fleet membership"), nil
+		}
+		cluster, err := in.Env.Cluster(ctx)
+		if err != nil {
+			return CheckResult{}, err
+		}
+		pools, err := inputNodePools(ctx, in, cluster)
+		if err != nil {
+			return CheckResult{}, err
+		}
+
+		var described, broad []string
+		for _, np := range pools {
+			var scopes []string
+			if np.Config != nil {
+				scopes = np.Config.OauthScopes
+			}
+			described = append(described, fmt.Sprintf("%q has %v", np.Name, scopes))
+			if !usesNodeServiceAccount(cluster, np) && contains(scopes, cloudPlatformScope) {
+				broad = append(broad, fmt.Sprintf("%q", np.Name))
+			}
+		}
+		if len(broad) > 0 {
+			return Warn("node pools %s use WI, but give the node's GSA the cloud-platform scope, so anything that bypasses the GKE metadata server, such as hostNetwork Pods, can use all of the node GSA's roles; consider narrower scopes or a minimal node GSA. Scopes: %s",
+				strings.Join(broad, ", "), strings.Join(described, "; ")), nil
+		}
+		return Info("node pool OAuth scopes: %s", strings.Join(described, "; ")), nil
+	},
+}
@@ -0,0 +1,133 @@
+package diagnose
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// maxOwnerDepth bounds how far ownerChain follows owner references, in case they form a cycle.
+const maxOwnerDepth = 10
+
+// Owner is an object in a Pod's chain of controlling owners.
+type Owner struct {
+	Kind string `json:"kind"`
+	Name string `json:"name"`
+	// Missing is whether the owner no longer exists, e.g. while it is being deleted.
+	Missing bool `json:"missing,omitempty"`
+}
+
+func (o Owner) String() string {
+	if o.Missing {
+		return fmt.Sprintf("%s %q, which no longer exists", o.Kind, o.Name)
+	}
+	return fmt.Sprintf("%s %q", o.Kind, o.Name)
+}
+
+var ownerChainCheck = &check{
+	name:        "owner-chain",
+	description: "Reports the controllers that own the KSA's Pod, up to the top-level workload.",
+	severity:    StatusInfo,
+	run: func(ctx context.Context, in *Input) (CheckResult, error) {
+		if in.Pod == "" {
+			return Skip("no Pod was given"), nil
+		}
+		pod, err := in.Kube.CoreV1().Pods(in.Namespace).Get(ctx, in.Pod, v1.GetOptions{})
+		if err != nil {
+			return CheckResult{}, fmt.Errorf("getting the Pod: %w", err)
+		}
+		chain, err := ownerChain(ctx, in, pod.OwnerReferences)
+		if err != nil {
+			return CheckResult{}, err
+		}
+		in.OwnerChain = chain
+		if len(chain) == 0 {
+			return Info("Pod %q has no controlling owner, it is managed directly", in.Pod), nil
+		}
+		parts := make([]string, 0, len(chain))
+		for _, o := range chain {
+			parts = append(parts, o.String())
+		}
+		top := chain[len(chain)-1]
+		return Info("Pod %q is part of %s %q, through %s", in.Pod, top.Kind, top.Name, strings.Join(parts, " -> ")), nil
+	},
+}
+
+// ownerChain follows the controlling owner references up from an object with the references, for
+// the kinds of the builtin workload controllers. An owner of another kind, such as a custom
+// resource's, ends the chain, as does one that no longer exists.
+func ownerChain(ctx context.Context, in *Input, refs []v1.OwnerReference) ([]Owner, error) {
+	var chain []Owner
+	for len(chain) < maxOwnerDepth {
+		ref := v1.GetControllerOfNoCopy(&v1.ObjectMeta{OwnerReferences: refs})
+		if ref == nil {
+			return chain, nil
+		}
+		owner := Owner{Kind: ref.Kind, Name: ref.Name}
+		group := strings.SplitN(ref.APIVersion, "/", 2)[0]
+		get, known := ownerGetters[group+"/"+ref.Kind]
+		if !known {
+			return append(chain, owner), nil
+		}
+		var err error
+		refs, err = get(ctx, in, ref.Name)
+		switch {
+		case apierrors.IsNotFound(err):
+			owner.Missing = true
+			return append(chain, owner), nil
+		case err != nil:
+			return nil, fmt.Errorf("getting the Pod's owner %s %q: %w", ref.Kind, ref.Name, err)
+		}
+		chain = append(chain, owner)
+	}
+	return chain, nil
+}
+
+// ownerGetters get the owner references of the builtin workload controllers, by GROUP/KIND.
+var ownerGetters = map[string]func(ctx context.Context, in *Input, name string) ([]v1.OwnerReference, error){
+	"apps/ReplicaSet": func(ctx context.Context, in *Input, name string) ([]v1.OwnerReference, error) {
+		o, err := in.Kube.AppsV1().ReplicaSets(in.Namespace).Get(ctx, name, v1.GetOptions{})
+		if err != nil {
+			return nil, err
+		}
+		return o.OwnerReferences, nil
+	},
+	"apps/Deployment": func(ctx context.Context, in *Input, name string) ([]v1.OwnerReference, error) {
+		o, err := in.Kube.AppsV1().Deployments(in.Namespace).Get(ctx, name, v1.GetOptions{})
+		if err != nil {
+			return nil, err
+		}
+		return o.OwnerReferences, nil
+	},
+	"apps/StatefulSet": func(ctx context.Context, in *Input, name string) ([]v1.OwnerReference, error) {
+		o, err := in.Kube.AppsV1().StatefulSets(in.Namespace).Get(ctx, name, v1.GetOptions{})
+		if err != nil {
+			return nil, err
+		}
+		return o.OwnerReferences, nil
+	},
+	"apps/DaemonSet": func(ctx context.Context, in *Input, name string) ([]v1.OwnerReference, error) {
+		o, err := in.Kube.AppsV1().DaemonSets(in.Namespace).Get(ctx, name, v1.GetOptions{})
+		if err != nil {
+			return nil, err
+		}
+		return o.OwnerReferences, nil
+	},
+	"batch/Job": func(ctx context.Context, in *Input, name string) ([]v1.OwnerReference, error) {
+		o, err := in.Kube.BatchV1().Jobs(in.Namespace).Get(ctx, name, v1.GetOptions{})
+		if err != nil {
+			return nil, err
+		}
+		return o.OwnerReferences, nil
+	},
+	"batch/CronJob": func(ctx context.Context, in *Input, name string) ([]v1.OwnerReference, error) {
+		o, err := in.Kube.BatchV1().CronJobs(in.Namespace).Get(ctx, name, v1.GetOptions{})
+		if err != nil {
+			return nil, err
+		}
+		return o.OwnerReferences, nil
+	},
+}
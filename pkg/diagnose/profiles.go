@@ -0,0 +1,71 @@
+package diagnose
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Profile is a named selection of the builtin checks for a common intent.
+type Profile struct {
+	Name        string
+	Description string
+	// Checks are the names of the checks the profile runs, or nil for every one. Every profile
+	// includes the checks that find the GSA, the WI pool, the binding and the roles, which later
+	// checks rely on.
+	Checks []string
+}
+
+// Profiles are the predefined profiles.
+var Profiles = []Profile{
+	{
+		Name:        "connectivity",
+		Description: "Whether the workload gets the GSA's credentials: the annotation, the binding and the metadata server.",
+		Checks: []string{
+			"owner-chain", "node-identity", "schedulable-pools", "host-network", "mesh-sidecar",
+			"ksa-annotation", "expected-gsa", "misplaced-annotation", "conflicting-annotations",
+			"ksa-automount", "wi-pool", "wi-pool-project", "wif-provider", "gke-version", "oidc-issuer",
+			"ksa-member", "gsa-binding", "id-token-binding", "project-references", "roles-project",
+			"project-roles",
+		},
+	},
+	{
+		Name:        "security",
+		Description: "Whether the GSA and KSA are granted more than they need, or to more identities than they should be.",
+		Checks: []string{
+			"node-identity", "node-scopes", "ksa-annotation", "gsa-name-pattern", "wi-pool",
+			"wi-pool-project", "wif-provider", "ksa-member", "gsa-binding", "impersonation",
+			"broad-grants", "gsa-keys", "stale-bindings", "gsa-project", "project-roles",
+			"least-privilege", "ksa-project-roles", "ksa-token-rbac",
+		},
+	},
+	{
+		Name:        "full",
+		Description: "Every check.",
+	},
+}
+
+// LookupProfile returns the predefined profile with the name.
+func LookupProfile(name string) (Profile, error) {
+	names := make([]string, 0, len(Profiles))
+	for _, p := range Profiles {
+		if p.Name == name {
+			return p, nil
+		}
+		names = append(names, p.Name)
+	}
+	return Profile{}, fmt.Errorf("unknown profile %q, expected one of %s", name, strings.Join(names, ", "))
+}
+
+// ProfileChecks returns the checks the profile runs, in the order of checks.
+func ProfileChecks(checks []Check, p Profile) []Check {
+	if p.Checks == nil {
+		return checks
+	}
+	var selected []Check
+	for _, c := range checks {
+		if contains(p.Checks, c.Name()) {
+			selected = append(selected, c)
+		}
+	}
+	return selected
+}
@@ -0,0 +1,48 @@
+package diagnose
+
+import "fmt"
+
+// CreateKSACommand returns the kubectl command that creates the KSA.
+func CreateKSACommand(ns, ksaName string) string {
+	return fmt.Sprintf("kubectl create serviceaccount --namespace %s %s", ns, ksaName)
+}
+
+// AnnotateKSACommand returns the kubectl command that links the KSA to the GSA, replacing any GSA it
+// is already linked to.
+func AnnotateKSACommand(ns, ksaName, gsaEmail string) string {
+	return fmt.Sprintf("kubectl annotate serviceaccount --namespace %s --overwrite %s %s=%s", ns, ksaName, WIGSAAnnotation, gsaEmail)
+}
+
+// PatchKSAAutomountCommand returns the kubectl command that makes Pods using the KSA get its token by
+// default again.
+func PatchKSAAutomountCommand(ns, ksaName string) string {
+	return fmt.Sprintf(`kubectl patch serviceaccount --namespace %s %s -p '{"automountServiceAccountToken":true}'`, ns, ksaName)
+}
+
+// GrantKSAAccessCommand returns the gcloud command that lets the KSA act as the GSA.
+func GrantKSAAccessCommand(wiPool, ns, ksaName, gsaEmail string) string {
+	return fmt.Sprintf("gcloud iam service-accounts add-iam-policy-binding --role roles/iam.workloadIdentityUser --member %q %s",
+		KSAIAMPolicyMember(wiPool, ns, ksaName), gsaEmail)
+}
+
+// GrantMemberRoleCommand returns the gcloud command that grants the member the role on the GSA, e.g.
+// for a KSA federated through a WI pool provider.
+func GrantMemberRoleCommand(role, member, gsaEmail string) string {
+	return fmt.Sprintf("gcloud iam service-accounts add-iam-policy-binding --role %s --member %q %s", role, member, gsaEmail)
+}
+
+// RevokeProjectRoleCommand returns the gcloud command that removes the role on the project from the
+// GSA.
+func RevokeProjectRoleCommand(project, role, gsaEmail string) string {
+	return fmt.Sprintf("gcloud projects remove-iam-policy-binding %s --role %s --member %q", project, role, GSAIAMPolicyMember(gsaEmail))
+}
+
+// GrantProjectRoleCommand returns the gcloud command that grants the GSA the role on the project.
+func GrantProjectRoleCommand(project, role, gsaEmail string) string {
+	return fmt.Sprintf("gcloud projects add-iam-policy-binding %s --role %s --member %q", project, role, GSAIAMPolicyMember(gsaEmail))
+}
+
+// DeleteGSAKeyCommand returns the gcloud command that deletes the GSA's key.
+func DeleteGSAKeyCommand(keyID, gsaEmail string) string {
+	return fmt.Sprintf("gcloud iam service-accounts keys delete %s --iam-account %s", keyID, gsaEmail)
+}
@@ -0,0 +1,88 @@
+package diagnose
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// GSAResolver looks up the GSA each KSA is annotated with, remembering the answer for a TTL, so
+// controllers resolving the same KSAs in a loop don't read them from the Kubernetes API every time.
+// It is safe for concurrent use.
+type GSAResolver struct {
+	kube kubernetes.Interface
+	ttl  time.Duration
+	// now returns the current time, and is only replaced in tests.
+	now func() time.Time
+
+	mu      sync.Mutex
+	entries map[Target]resolvedGSA
+}
+
+type resolvedGSA struct {
+	gsa     string
+	expires time.Time
+}
+
+// NewGSAResolver returns a GSAResolver that remembers each KSA's GSA for ttl.
+func NewGSAResolver(kube kubernetes.Interface, ttl time.Duration) *GSAResolver {
+	return &GSAResolver{
+		kube:    kube,
+		ttl:     ttl,
+		now:     time.Now,
+		entries: map[Target]resolvedGSA{},
+	}
+}
+
+// Resolve returns the GSA the KSA is annotated with, or the empty string if it has no WI annotation.
+// Errors, including the KSA not existing, are not remembered. Expired KSAs are forgotten whenever a
+// KSA has to be read, so KSAs that are no longer resolved don't accumulate.
+func (r *GSAResolver) Resolve(ctx context.Context, ns, ksaName string) (string, error) {
+	key := Target{Namespace: ns, KSA: ksaName}
+	r.mu.Lock()
+	e, present := r.entries[key]
+	if present && r.now().Before(e.expires) {
+		r.mu.Unlock()
+		return e.gsa, nil
+	}
+	r.removeExpired()
+	r.mu.Unlock()
+
+	sa, err := r.kube.CoreV1().ServiceAccounts(ns).Get(ctx, ksaName, v1.GetOptions{})
+	if err != nil {
+		return "", err
+	}
+	gsa := CleanGSAAnnotation(sa.Annotations[WIGSAAnnotation])
+	r.mu.Lock()
+	r.entries[key] = resolvedGSA{gsa: gsa, expires: r.now().Add(r.ttl)}
+	r.mu.Unlock()
+	return gsa, nil
+}
+
+// removeExpired forgets the KSAs whose GSA has expired. r.mu must be held.
+func (r *GSAResolver) removeExpired() {
+	now := r.now()
+	for key, e := range r.entries {
+		if !now.Before(e.expires) {
+			delete(r.entries, key)
+		}
+	}
+}
+
+// Invalidate forgets the KSA's GSA, e.g. when a watch reports the KSA changed, so the next Resolve
+// reads it again.
+func (r *GSAResolver) Invalidate(ns, ksaName string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.entries, Target{Namespace: ns, KSA: ksaName})
+}
+
+// InvalidateAll forgets every KSA's GSA.
+func (r *GSAResolver) InvalidateAll() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.entries = map[Target]resolvedGSA{}
+}
@@ -0,0 +1,109 @@
+package diagnose
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// newTestResolver returns a GSAResolver of the KSA, with a clock that only moves when the returned
+// function is called, and a pointer to the number of times the KSA was read.
+func newTestResolver(t *testing.T, ttl time.Duration, sa *corev1.ServiceAccount) (*GSAResolver, func(time.Duration), *int) {
+	t.Helper()
+	client := fake.NewSimpleClientset(sa)
+	gets := 0
+	client.PrependReactor("get", "serviceaccounts", func(k8stesting.Action) (bool, runtime.Object, error) {
+		gets++
+		return false, nil, nil
+	})
+	r := NewGSAResolver(client, ttl)
+	now := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	r.now = func() time.Time { return now }
+	return r, func(d time.Duration) { now = now.Add(d) }, &gets
+}
+
+func testKSA(gsa string) *corev1.ServiceAccount {
+	return &corev1.ServiceAccount{ObjectMeta: v1.ObjectMeta{
+		Name:        "agent",
+		Namespace:   "my-ns",
+		Annotations: map[string]string{WIGSAAnnotation: gsa},
+	}}
+}
+
+func TestGSAResolverTTL(t *testing.T) {
+	ctx := context.Background()
+	r, advance, gets := newTestResolver(t, time.Minute, testKSA("app-sa@my-project.iam.gserviceaccount.com"))
+
+	for i, step := range []struct {
+		advance  time.Duration
+		wantGets int
+	}{
+		{advance: 0, wantGets: 1},
+		{advance: 30 * time.Second, wantGets: 1},
+		// The entry expires exactly a TTL after it was read.
+		{advance: 30 * time.Second, wantGets: 2},
+		{advance: 59 * time.Second, wantGets: 2},
+		{advance: time.Hour, wantGets: 3},
+	} {
+		advance(step.advance)
+		gsa, err := r.Resolve(ctx, "my-ns", "agent")
+		if err != nil {
+			t.Fatalf("step %d: Resolve: %v", i, err)
+		}
+		if gsa != "app-sa@my-project.iam.gserviceaccount.com" {
+			t.Errorf("step %d: Resolve = %q, want the annotated GSA", i, gsa)
+		}
+		if *gets != step.wantGets {
+			t.Errorf("step %d: the KSA was read %d times, want %d", i, *gets, step.wantGets)
+		}
+	}
+}
+
+func TestGSAResolverInvalidate(t *testing.T) {
+	ctx := context.Background()
+	r, _, gets := newTestResolver(t, time.Hour, testKSA("app-sa@my-project.iam.gserviceaccount.com"))
+	if _, err := r.Resolve(ctx, "my-ns", "agent"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The annotation changes, which the resolver only sees once it is invalidated.
+	if _, err := r.kube.CoreV1().ServiceAccounts("my-ns").Update(ctx, testKSA("other-sa@my-project.iam.gserviceaccount.com"), v1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if gsa, _ := r.Resolve(ctx, "my-ns", "agent"); gsa != "app-sa@my-project.iam.gserviceaccount.com" {
+		t.Errorf("Resolve before Invalidate = %q, want the remembered GSA", gsa)
+	}
+	r.Invalidate("my-ns", "agent")
+	if gsa, _ := r.Resolve(ctx, "my-ns", "agent"); gsa != "other-sa@my-project.iam.gserviceaccount.com" {
+		t.Errorf("Resolve after Invalidate = %q, want the new GSA", gsa)
+	}
+	r.InvalidateAll()
+	if _, err := r.Resolve(ctx, "my-ns", "agent"); err != nil {
+		t.Fatal(err)
+	}
+	if *gets != 3 {
+		t.Errorf("the KSA was read %d times, want 3", *gets)
+	}
+}
+
+func TestGSAResolverRemovesExpired(t *testing.T) {
+	ctx := context.Background()
+	r, advance, _ := newTestResolver(t, time.Minute, testKSA("app-sa@my-project.iam.gserviceaccount.com"))
+	if _, err := r.Resolve(ctx, "my-ns", "agent"); err != nil {
+		t.Fatal(err)
+	}
+	advance(time.Hour)
+	// Reading another KSA, even one that doesn't exist, forgets the expired one.
+	if _, err := r.Resolve(ctx, "my-ns", "missing"); err == nil {
+		t.Fatal("Resolve of a missing KSA succeeded, want an error")
+	}
+	if n := len(r.entries); n != 0 {
+		t.Errorf("%d KSAs are remembered, want the expired one forgotten", n)
+	}
+}
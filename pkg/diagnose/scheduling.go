@@ -0,0 +1,198 @@
+package diagnose
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"google.golang.org/api/container/v1"
+	corev1 "k8s.io/api/core/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+var schedulablePoolsCheck = &check{
+	name:        "schedulable-pools",
+	description: "Every node pool the KSA's Pod could be scheduled onto uses WI.",
+	severity:    StatusWarn,
+	run: func(ctx context.Context, in *Input) (CheckResult, error) {
+		switch {
+		case in.Pod == "" && in.Deployment == "":
+			return Skip("no Pod or Deployment was given"), nil
+		case in.AssumePool != "":
+			return Skip("assuming the cluster's WI pool is %q", in.AssumePool), nil
+		case in.WIFProvider != "":
+			return Skip("the cluster is outside of GKE, federated through %q", in.WIFProvider), nil
+		case in.ClusterAPIName == "":
+			return Skip("the cluster is reached through its fleet membership"), nil
+		}
+		cluster, err := in.Env.Cluster(ctx)
+		if err != nil {
+			return CheckResult{}, err
+		}
+		if cluster.Autopilot != nil && cluster.Autopilot.Enabled {
+			return Skip("Autopilot clusters always use WI"), nil
+		}
+		spec, err := podSpec(ctx, in)
+		if err != nil {
+			return CheckResult{}, err
+		}
+
+		var pools, nodeSAPools []string
+		for _, np := range cluster.NodePools {
+			if !schedulableOn(spec, np) {
+				continue
+			}
+			pools = append(pools, fmt.Sprintf("%q", np.Name))
+			if usesNodeServiceAccount(cluster, np) {
+				nodeSAPools = append(nodeSAPools, fmt.Sprintf("%q", np.Name))
+			}
+		}
+		switch {
+		case len(pools) == 0:
+			return Warn("%s, but no node pool matches its node selector, node affinity and tolerations, so it can't be scheduled until one is added", in.Target), nil
+		case len(nodeSAPools) == len(pools):
+			return Skip("none of the node pools the Pod can be scheduled onto use WI, see node-identity"), nil
+		case len(nodeSAPools) > 0:
+			return Warn("%s, which can be scheduled onto node pools %s, but %s don't use WI. Pods landing there run as the node's GSA instead of the KSA's, so WI breaks only on some nodes. Enable GKE_METADATA on them, or keep the Pods off them with a node selector",
+				in.Target, strings.Join(pools, ", "), strings.Join(nodeSAPools, ", ")), nil
+		}
+		return Pass("%s, which can be scheduled onto node pools %s, all of which use WI", in.Target, strings.Join(pools, ", ")), nil
+	},
+}
+
+// podSpec returns the spec of the Input's Pod, or of its Deployment's Pod template.
+func podSpec(ctx context.Context, in *Input) (*corev1.PodSpec, error) {
+	if in.Pod != "" {
+		pod, err := in.Kube.CoreV1().Pods(in.Namespace).Get(ctx, in.Pod, v1.GetOptions{})
+		if err != nil {
+			return nil, fmt.Errorf("getting the Pod: %w", err)
+		}
+		return &pod.Spec, nil
+	}
+	d, err := in.Kube.AppsV1().Deployments(in.Namespace).Get(ctx, in.Deployment, v1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("getting the Deployment: %w", err)
+	}
+	return &d.Spec.Template.Spec, nil
+}
+
+// schedulableOn reports whether Pods with the spec may be scheduled onto the node pool's nodes: the
+// nodes' labels match the spec's node selector and required node affinity, and the spec tolerates
+// the nodes' NoSchedule and NoExecute taints. Preferences, resources and Pod affinity are ignored.
+func schedulableOn(spec *corev1.PodSpec, np *container.NodePool) bool {
+	labels := nodePoolLabels(np)
+	for k, v := range spec.NodeSelector {
+		if labels[k] != v {
+			return false
+		}
+	}
+	if a := spec.Affinity; a != nil && a.NodeAffinity != nil && a.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution != nil {
+		matched := false
+		for _, term := range a.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms {
+			if termMatches(term, labels) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	if np.Config == nil {
+		return true
+	}
+	for _, t := range np.Config.Taints {
+		taint := corev1.Taint{Key: t.Key, Value: t.Value}
+		switch t.Effect {
+		case "NO_SCHEDULE":
+			taint.Effect = corev1.TaintEffectNoSchedule
+		case "NO_EXECUTE":
+			taint.Effect = corev1.TaintEffectNoExecute
+		default:
+			continue
+		}
+		if !tolerates(spec.Tolerations, &taint) {
+			return false
+		}
+	}
+	return true
+}
+
+// nodePoolLabels returns the labels of the node pool's nodes, both those set on the node pool and
+// those GKE adds.
+func nodePoolLabels(np *container.NodePool) map[string]string {
+	labels := map[string]string{nodePoolLabel: np.Name}
+	if np.Config == nil {
+		return labels
+	}
+	for k, v := range np.Config.Labels {
+		labels[k] = v
+	}
+	if np.Config.MachineType != "" {
+		labels["node.kubernetes.io/instance-type"] = np.Config.MachineType
+	}
+	if np.Config.Spot {
+		labels["cloud.google.com/gke-spot"] = "true"
+	}
+	if np.Config.Preemptible {
+		labels["cloud.google.com/gke-preemptible"] = "true"
+	}
+	return labels
+}
+
+// termMatches reports whether the labels match all of the node selector term's label expressions.
+// Field expressions, which select single nodes by name, never match a node pool.
+func termMatches(term corev1.NodeSelectorTerm, labels map[string]string) bool {
+	if len(term.MatchExpressions) == 0 || len(term.MatchFields) > 0 {
+		return false
+	}
+	for _, req := range term.MatchExpressions {
+		v, present := labels[req.Key]
+		switch req.Operator {
+		case corev1.NodeSelectorOpIn:
+			if !present || !contains(req.Values, v) {
+				return false
+			}
+		case corev1.NodeSelectorOpNotIn:
+			if present && contains(req.Values, v) {
+				return false
+			}
+		case corev1.NodeSelectorOpExists:
+			if !present {
+				return false
+			}
+		case corev1.NodeSelectorOpDoesNotExist:
+			if present {
+				return false
+			}
+		case corev1.NodeSelectorOpGt, corev1.NodeSelectorOpLt:
+			if !present || len(req.Values) != 1 {
+				return false
+			}
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				return false
+			}
+			want, err := strconv.ParseInt(req.Values[0], 10, 64)
+			if err != nil {
+				return false
+			}
+			if (req.Operator == corev1.NodeSelectorOpGt && n <= want) || (req.Operator == corev1.NodeSelectorOpLt && n >= want) {
+				return false
+			}
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+func tolerates(tolerations []corev1.Toleration, taint *corev1.Taint) bool {
+	for i := range tolerations {
+		if tolerations[i].ToleratesTaint(taint) {
+			return true
+		}
+	}
+	return false
+}
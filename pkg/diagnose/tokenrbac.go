@@ -0,0 +1,58 @@
+package diagnose
+
+import (
+	"context"
+	"fmt"
+
+	authorizationv1 "k8s.io/api/authorization/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+var ksaTokenRBACCheck = &check{
+	name:        "ksa-token-rbac",
+	description: "Reports whether the KSA's RBAC lets it create tokens for other KSAs, and so act as their GSAs.",
+	severity:    StatusInfo,
+	run: func(ctx context.Context, in *Input) (CheckResult, error) {
+		if !in.CheckTokenRBAC {
+			return Skip(SkipNotEnabled), nil
+		}
+		// An empty namespace asks about every namespace.
+		for _, ns := range []string{"", in.Namespace} {
+			allowed, err := ksaCanCreateTokens(ctx, in, ns)
+			if err != nil {
+				return CheckResult{}, err
+			}
+			if !allowed {
+				continue
+			}
+			where := fmt.Sprintf("in namespace %q", ns)
+			if ns == "" {
+				where = "in every namespace"
+			}
+			return Info("KSA %q can create tokens for the service accounts %s (serviceaccounts/token create), so its workloads can act as those KSAs' GSAs too",
+				in.KSA, where), nil
+		}
+		return Pass("KSA %q can't create tokens for other service accounts", in.KSA), nil
+	},
+}
+
+// ksaCanCreateTokens asks the API server whether the KSA may create tokens for the service accounts
+// in the namespace, or in every namespace if ns is empty.
+func ksaCanCreateTokens(ctx context.Context, in *Input, ns string) (bool, error) {
+	sar, err := in.Kube.AuthorizationV1().SubjectAccessReviews().Create(ctx, &authorizationv1.SubjectAccessReview{
+		Spec: authorizationv1.SubjectAccessReviewSpec{
+			User:   fmt.Sprintf("system:serviceaccount:%s:%s", in.Namespace, in.KSA),
+			Groups: []string{"system:serviceaccounts", "system:serviceaccounts:" + in.Namespace, "system:authenticated"},
+			ResourceAttributes: &authorizationv1.ResourceAttributes{
+				Namespace:   ns,
+				Verb:        "create",
+				Resource:    "serviceaccounts",
+				Subresource: "token",
+			},
+		},
+	}, v1.CreateOptions{})
+	if err != nil {
+		return false, fmt.Errorf("reviewing the KSA's access to serviceaccounts/token: %w", err)
+	}
+	return sar.Status.Allowed, nil
+}
@@ -0,0 +1,108 @@
+package diagnose
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"google.golang.org/api/option"
+	"google.golang.org/api/policytroubleshooter/v1"
+)
+
+// The access states TroubleshootAccess returns.
+const (
+	AccessGranted     = "GRANTED"
+	AccessNotGranted  = "NOT_GRANTED"
+	AccessConditional = "UNKNOWN_CONDITIONAL"
+	AccessInfoDenied  = "UNKNOWN_INFO_DENIED"
+)
+
+// getAccessTokenPermission is the permission that lets a principal act as a GSA, which
+// roles/iam.workloadIdentityUser grants.
+const getAccessTokenPermission = "iam.serviceAccounts.getAccessToken"
+
+// TroubleshootAccess asks the Policy Troubleshooter whether the principal has the permission on the
+// resource, given by its full resource name, evaluating every applicable IAM policy, including
+// inherited ones and conditions. It returns one of the Access states.
+func TroubleshootAccess(ctx context.Context, opts []option.ClientOption, principal, fullResourceName, permission string) (string, error) {
+	ptSVC, err := policytroubleshooter.NewService(ctx, apiOptions(opts, PolicyTroubleshooterAPI)...)
+	if err != nil {
+		return "", fmt.Errorf("creating PolicyTroubleshooter.Service: %w", err)
+	}
+	resp, err := ptSVC.Iam.Troubleshoot(&policytroubleshooter.GoogleCloudPolicytroubleshooterV1TroubleshootIamPolicyRequest{
+		AccessTuple: &policytroubleshooter.GoogleCloudPolicytroubleshooterV1AccessTuple{
+			Principal:        principal,
+			FullResourceName: fullResourceName,
+			Permission:       permission,
+		},
+	}).Do()
+	if err != nil {
+		return "", fmt.Errorf("troubleshooting %q's %s on %q: %w", principal, permission, fullResourceName, err)
+	}
+	return resp.Access, nil
+}
+
+// GSAFullResourceName returns the full resource name of the GSA, as the Policy Troubleshooter takes.
+func GSAFullResourceName(gsaEmail string) string {
+	return "//iam.googleapis.com/" + GSAAPIResource(gsaEmail)
+}
+
+// ProjectFullResourceName returns the full resource name of the project.
+func ProjectFullResourceName(project string) string {
+	return "//cloudresourcemanager.googleapis.com/projects/" + project
+}
+
+var troubleshooterCheck = &check{
+	name:        "troubleshooter",
+	description: "The Policy Troubleshooter grants the KSA access to the GSA, and the GSA the permissions the workload needs.",
+	severity:    StatusFail,
+	run: func(ctx context.Context, in *Input) (CheckResult, error) {
+		switch {
+		case !in.Troubleshoot:
+			return Skip(SkipNotEnabled), nil
+		case in.GSA == "":
+			return Skip("the KSA's GSA is unknown"), nil
+		}
+		var denied, unknown, granted []string
+		record := func(what, access string) {
+			switch access {
+			case AccessGranted:
+				granted = append(granted, what)
+			case AccessNotGranted:
+				denied = append(denied, what)
+			case AccessConditional:
+				unknown = append(unknown, what+" depends on an IAM condition")
+			case AccessInfoDenied:
+				unknown = append(unknown, what+" is unknown, you may not read every policy involved")
+			default:
+				unknown = append(unknown, fmt.Sprintf("%s is %q", what, access))
+			}
+		}
+		if in.WIPool != "" {
+			// The troubleshooter takes the principal's email-like form, without the member type.
+			principal := strings.TrimPrefix(KSAIAMPolicyMember(in.WIPool, in.Namespace, in.KSA), "serviceAccount:")
+			access, err := TroubleshootAccess(ctx, in.GCPOptions, principal, GSAFullResourceName(in.GSA), getAccessTokenPermission)
+			if err != nil {
+				return CheckResult{}, err
+			}
+			record(fmt.Sprintf("KSA %q's %s on GSA %q", in.KSA, getAccessTokenPermission, in.GSA), access)
+		}
+		project := in.RolesProject()
+		for _, permission := range in.TroubleshootPermissions {
+			access, err := TroubleshootAccess(ctx, in.GCPOptions, in.GSA, ProjectFullResourceName(project), permission)
+			if err != nil {
+				return CheckResult{}, err
+			}
+			record(fmt.Sprintf("GSA %q's %s on project %q", in.GSA, permission, project), access)
+		}
+		switch {
+		case len(denied) > 0:
+			return Fail("the Policy Troubleshooter does not grant %s", strings.Join(append(denied, unknown...), "; ")), nil
+		case len(unknown) > 0:
+			return Warn("the Policy Troubleshooter is not sure of %s", strings.Join(unknown, "; ")), nil
+		case len(granted) == 0:
+			return Skip("the WI pool is unknown and no permissions were given"), nil
+		}
+		return Pass("the Policy Troubleshooter grants %s", strings.Join(granted, "; ")), nil
+	},
+}
@@ -0,0 +1,77 @@
+package diagnose
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+var (
+	// userGSAEmailRegexp matches the email of a user-managed GSA, whose name is 6 to 30 characters.
+	userGSAEmailRegexp = regexp.MustCompile(`^[a-z][a-z0-9-]{4,28}[a-z0-9]@[a-z][a-z0-9-]{4,28}[a-z0-9]\.iam\.gserviceaccount\.com$`)
+	// googleGSAEmailRegexp matches the emails of the default GSAs created by Compute Engine and App Engine.
+	googleGSAEmailRegexp = regexp.MustCompile(`^([0-9]+-compute@developer|[a-z][a-z0-9-]{4,28}[a-z0-9]@appspot)\.gserviceaccount\.com$`)
+	// gsaUniqueIDRegexp matches a GSA's numeric unique ID, which is sometimes pasted in place of its email.
+	gsaUniqueIDRegexp = regexp.MustCompile(`^[0-9]{10,}$`)
+	// locationRegexp matches a GCP region, such as us-central1, or zone, such as us-central1-a.
+	locationRegexp = regexp.MustCompile(`^[a-z]+(-[a-z]+)+[0-9]+(-[a-z])?$`)
+)
+
+// ValidateNamespace returns an error if ns is not a valid Namespace name, which must be a DNS-1123 label.
+func ValidateNamespace(ns string) error {
+	if errs := validation.IsDNS1123Label(ns); len(errs) > 0 {
+		return fmt.Errorf("invalid namespace name %q: %s", ns, strings.Join(errs, ", "))
+	}
+	return nil
+}
+
+// ValidateKSAName returns an error if ksaName is not a valid ServiceAccount name, which must be a
+// DNS-1123 subdomain.
+func ValidateKSAName(ksaName string) error {
+	if errs := validation.IsDNS1123Subdomain(ksaName); len(errs) > 0 {
+		return fmt.Errorf("invalid service account name %q: %s", ksaName, strings.Join(errs, ", "))
+	}
+	return nil
+}
+
+// ValidateObjectName returns an error if name is not a valid name for an object of the kind, such as
+// a Pod or Deployment, whose names must be DNS-1123 subdomains.
+func ValidateObjectName(kind, name string) error {
+	if errs := validation.IsDNS1123Subdomain(name); len(errs) > 0 {
+		return fmt.Errorf("invalid %s name %q: %s", kind, name, strings.Join(errs, ", "))
+	}
+	return nil
+}
+
+// ValidateGSAEmail returns an error if gsaEmail is not shaped like the email of a GSA.
+func ValidateGSAEmail(gsaEmail string) error {
+	if userGSAEmailRegexp.MatchString(gsaEmail) || googleGSAEmailRegexp.MatchString(gsaEmail) {
+		return nil
+	}
+	if IsGSAUniqueID(gsaEmail) {
+		return fmt.Errorf("%q is a GSA's numeric unique ID, but the email is required, NAME@PROJECT_ID.iam.gserviceaccount.com. Find it with: gcloud iam service-accounts describe %s --format='value(email)'", gsaEmail, gsaEmail)
+	}
+	return fmt.Errorf("%q is not a GSA email, expected NAME@PROJECT_ID.iam.gserviceaccount.com where NAME is 6 to 30 characters", gsaEmail)
+}
+
+// IsGSAUniqueID reports whether the value is shaped like a GSA's numeric unique ID, rather than its email.
+func IsGSAUniqueID(value string) bool {
+	return gsaUniqueIDRegexp.MatchString(value)
+}
+
+// ValidateClusterLocation returns an error if location is not shaped like a GCP region or zone, the
+// locations a GKE cluster can be in.
+func ValidateClusterLocation(location string) error {
+	if locationRegexp.MatchString(location) {
+		return nil
+	}
+	return fmt.Errorf("invalid cluster location %q, expected a region such as us-central1 or a zone such as us-central1-a", location)
+}
+
+// CleanGSAAnnotation strips the whitespace and quotes that templating tools sometimes leave around
+// the annotation's value.
+func CleanGSAAnnotation(value string) string {
+	return strings.Trim(value, " \t\r\n\"'`")
+}
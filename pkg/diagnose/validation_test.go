@@ -0,0 +1,19 @@
+package diagnose
+
+import "testing"
+
+func TestCleanGSAAnnotation(t *testing.T) {
+	const gsa = "app-sa@my-project.iam.gserviceaccount.com"
+	for _, value := range []string{
+		gsa,
+		`"` + gsa + `"`,
+		`'` + gsa + `'`,
+		"`" + gsa + "`",
+		"  " + gsa + "\n",
+		"\t\"" + gsa + "\" ",
+	} {
+		if got := CleanGSAAnnotation(value); got != gsa {
+			t.Errorf("CleanGSAAnnotation(%q) = %q, want %q", value, got, gsa)
+		}
+	}
+}